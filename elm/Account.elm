@@ -0,0 +1,248 @@
+module Account exposing (main)
+
+import Util.Loader as Loader
+import Util.Form exposing (spinnerButton)
+import Navigation
+import Http
+import Json.Decode as Decode exposing (Decoder, Value, field, string, int, list, nullable, andThen)
+import Json.Decode.Pipeline exposing (decode, required, hardcoded, custom)
+import Json.Encode as Encode
+import Html exposing (..)
+import Html.Attributes exposing (href, class)
+import Models.Menu as Menu
+import Models.Currency as Currency exposing (Currency)
+import Models.OrderStatus as OrderStatus
+import Util.Csrf as Csrf
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table
+import Bootstrap.Alert as Alert
+import Bootstrap.Form.Input as Input
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { customer : Maybe Customer
+  , orders : List CustomerOrder
+  , login : String
+  , code : String
+  , codeSent : Bool
+  , busy : Bool
+  , error : Maybe String
+  , csrfToken : Csrf.Token
+  }
+
+type alias Customer =
+  { login : String
+  , name : String
+  }
+
+type alias CustomerOrder =
+  { restaurantName : String
+  , number : Int
+  , total : Menu.Money
+  , currency : Currency
+  , status : OrderStatus.OrderStatus
+  , trackingUrl : String
+  , reorderUrl : String
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> required "Customer" (nullable decodeCustomer)
+    |> required "Orders" (list decodeOrder)
+    |> hardcoded ""
+    |> hardcoded ""
+    |> hardcoded False
+    |> hardcoded False
+    |> hardcoded Nothing
+    |> custom Csrf.decoder
+
+decodeCustomer : Decoder Customer
+decodeCustomer =
+  decode Customer
+    |> required "Login" string
+    |> required "Name" string
+
+decodeOrder : Decoder CustomerOrder
+decodeOrder =
+  decode CustomerOrder
+    |> required "RestaurantName" string
+    |> required "Number" int
+    |> required "Total" int
+    |> required "Currency" Currency.decode
+    |> custom OrderStatus.statusDecoder
+    |> required "TrackingURL" string
+    |> required "ReorderURL" string
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+  | UpdateLogin String
+  | UpdateCode String
+  | SendCode
+  | Verify
+  | Logout
+  | LogoutAll
+  | SendCodeResponse (Result Http.Error Response)
+  | LoggedInResponse (Result Http.Error Response)
+
+type Response = Okay
+              | Error String
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+    UpdateLogin login ->
+      ({ model | login = login }, Cmd.none)
+
+    UpdateCode code ->
+      ({ model | code = code }, Cmd.none)
+
+    SendCode ->
+      ({ model | busy = True, error = Nothing }
+      , post model.csrfToken "/account/login" [ ("Login", Encode.string model.login) ] SendCodeResponse)
+
+    Verify ->
+      ({ model | busy = True, error = Nothing }
+      , post model.csrfToken "/account/verify"
+          [ ("Login", Encode.string model.login)
+          , ("Code", Encode.string model.code)
+          ]
+          LoggedInResponse)
+
+    Logout ->
+      ({ model | busy = True, error = Nothing }
+      , post model.csrfToken "/account/logout" [] LoggedInResponse)
+
+    LogoutAll ->
+      ({ model | busy = True, error = Nothing }
+      , post model.csrfToken "/account/logoutAll" [] LoggedInResponse)
+
+    SendCodeResponse (Ok Okay) ->
+      ({ model | busy = False, codeSent = True }, Cmd.none)
+
+    LoggedInResponse (Ok Okay) ->
+      (model, Navigation.reload)
+
+    SendCodeResponse (Ok (Error msg)) ->
+      ({ model | busy = False, error = Just msg }, Cmd.none)
+
+    LoggedInResponse (Ok (Error msg)) ->
+      ({ model | busy = False, error = Just msg }, Cmd.none)
+
+    SendCodeResponse (Err err) ->
+      ({ model | busy = False, error = Just "Network error, please try again." }, Cmd.none)
+
+    LoggedInResponse (Err err) ->
+      ({ model | busy = False, error = Just "Network error, please try again." }, Cmd.none)
+
+
+post : Csrf.Token -> String -> List (String, Value) -> (Result Http.Error Response -> Msg) -> Cmd Msg
+post csrfToken url fields toMsg =
+  Csrf.post csrfToken url (Http.jsonBody (Encode.object fields)) decodeResponse
+    |> Http.send toMsg
+
+
+decodeResponse : Decoder Response
+decodeResponse =
+  field "Status" string
+    |> andThen (\str ->
+      case str of
+        "OK" -> Decode.succeed Okay
+        "ERR" -> Decode.map Error (field "Error" string)
+        _ -> Decode.fail ("Bad 'Status': " ++ str)
+    )
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text "Your Account" ]
+    , case model.error of
+        Just msg -> Alert.simpleDanger [] [ text msg ]
+        Nothing -> text ""
+    , case model.customer of
+        Nothing -> loginView model
+        Just customer -> historyView model customer
+    ]
+
+
+loginView : Model -> Html Msg
+loginView model =
+  if model.codeSent then
+    div []
+      [ p [] [ text ("We have sent a code to " ++ model.login ++ ", enter it below to log in.") ]
+      , Input.text [ Input.value model.code, Input.onInput UpdateCode ]
+      , p [] [ spinnerButton "Log In" (String.isEmpty model.code) model.busy Verify ]
+      ]
+  else
+    div []
+      [ p [] [ text "Log in with your email address or mobile number to see your orders and order again." ]
+      , Input.text [ Input.value model.login, Input.onInput UpdateLogin ]
+      , p [] [ spinnerButton "Send Code" (String.isEmpty model.login) model.busy SendCode ]
+      ]
+
+
+historyView : Model -> Customer -> Html Msg
+historyView model customer =
+  div []
+    [ p []
+        [ text ("Logged in as " ++ customer.login ++ " ")
+        , spinnerButton "Log Out" False model.busy Logout
+        , text " "
+        , spinnerButton "Log Out Everywhere" False model.busy LogoutAll
+        ]
+    , h2 [] [ text "Order History" ]
+    , if List.isEmpty model.orders then
+        p [] [ text "You have not placed any orders yet." ]
+      else
+        Table.simpleTable
+          ( Table.simpleThead
+              [ Table.th [] [ text "Restaurant" ]
+              , Table.th [] [ text "#" ]
+              , Table.th [] [ text "Total" ]
+              , Table.th [] [ text "Status" ]
+              , Table.th [] []
+              ]
+          , Table.tbody [] (List.map orderRowView model.orders)
+          )
+    ]
+
+
+orderRowView : CustomerOrder -> Table.Row Msg
+orderRowView order =
+  Table.tr []
+    [ Table.td [] [ text order.restaurantName ]
+    , Table.td [] [ a [ href order.trackingUrl ] [ text (toString order.number) ] ]
+    , Table.td [] [ text (Menu.priceString order.currency order.total) ]
+    , Table.td [] [ text (statusString order.status) ]
+    , Table.td [] [ a [ href order.reorderUrl ] [ text "Order again" ] ]
+    ]
+
+
+statusString : OrderStatus.OrderStatus -> String
+statusString status =
+  case status of
+    OrderStatus.New _ -> "Received"
+    OrderStatus.Expected _ -> "Being prepared"
+    OrderStatus.Ready -> "Ready"
+    OrderStatus.PickedUp -> "Picked up"
+    OrderStatus.Rejected -> "Rejected"
+    OrderStatus.Cancelled _ -> "Cancelled"
@@ -12,6 +12,7 @@ import Json.Decode as Decode exposing (
 import Json.Encode as Encode
 import Views.Layout as Layout
 import Models.Restaurant as Restaurant
+import Models.Currency exposing (Currency)
 import Models.Menu as Menu
 import Models.OrderStatus as OrderStatus exposing (
   OrderStatus, StatusUpdate,
@@ -25,8 +26,12 @@ import Task
 import Bootstrap.Table as Table exposing (cellAttr)
 import Bootstrap.Button as Button
 import Bootstrap.Modal as Modal
+import Bootstrap.Form.Input as Input
 import Process
 import Util.SSE as SSE
+import Util.Idempotency as Idempotency
+import Util.Csrf as Csrf
+import Random
 import Http
 import Task
 
@@ -52,22 +57,43 @@ init flags location =
 
 type alias Model =
   { restaurant : Restaurant.Restaurant
+  , hasPrinter : Bool
   , orders : List Order
   , now : Time.Time
   , modalOrder : Maybe Order
   , expected : Int
   , muted : Bool
   , networkError : Bool
+  , refundPin : String
+  , refundError : Maybe String
+  , confirmCloseDay : Bool
+  , csrfToken : Csrf.Token
   }
 
 type alias Order =
   { number : Int
+  , displayNumber : Int
   , name : String
   , telephone : String
   , menu : Menu.Menu
   , order : Menu.Order
+  , discounts : List Menu.Discount
+  , charges : List Menu.Charge
+  , total : Menu.Money
+  , allergens : List String
   , created : Time.Time
   , status : OrderStatus
+  , paymentStatus : String
+  , refunded : Menu.Money
+  , normalisedTelephone : String
+  , suspicious : List String
+  , blocked : Bool
+  }
+
+type alias RefundUpdate =
+  { number : Int
+  , paymentStatus : String
+  , refunded : Menu.Money
   }
 
 
@@ -75,29 +101,52 @@ modelDecoder : Decoder Model
 modelDecoder =
     decode Model
       |> required "Restaurant" Restaurant.decode
+      |> required "HasPrinter" Decode.bool
       |> hardcoded []
       |> hardcoded 0
       |> hardcoded Nothing
       |> hardcoded 15
       |> hardcoded True
       |> hardcoded False
+      |> hardcoded ""
+      |> hardcoded Nothing
+      |> hardcoded False
+      |> custom Csrf.decoder
 
 orderDecoder : Decoder Order
 orderDecoder =
     decode Order
       |> required "Number" int
+      |> required "DisplayNumber" int
       |> required "Name" string
       |> required "Telephone" string
       |> required "MenuItems" Menu.menuDecoder
       |> required "Items" Menu.orderDecoder
+      |> required "Discounts" (list Menu.discountDecoder)
+      |> required "Charges" (list Menu.chargeDecoder)
+      |> required "Total" int
+      |> required "Allergens" (list string)
       |> custom (field "CreatedAt" string |> andThen dateDecoder)
       |> custom statusDecoder
+      |> required "PaymentStatus" string
+      |> required "Refunded" int
+      |> required "NormalisedTelephone" string
+      |> required "Suspicious" (list string)
+      |> required "Blocked" Decode.bool
+
+refundUpdateDecoder : Decoder RefundUpdate
+refundUpdateDecoder =
+    decode RefundUpdate
+      |> required "Number" int
+      |> required "PaymentStatus" string
+      |> required "Refunded" int
 
 
 type Event
   = ResetEvent
   | NewOrderEvent Order
   | StatusUpdateEvent StatusUpdate
+  | RefundEvent RefundUpdate
 
 decodeEvent : String -> Result String Event
 decodeEvent eventStr =
@@ -121,6 +170,8 @@ decodeEvent eventStr =
                 Ok (StatusUpdateEvent update)
               Err err ->
                 Err err
+          "refund" ->
+            Result.map RefundEvent (decodeValue refundUpdateDecoder event.data)
           _ ->
             Err ("Unsupported event: " ++ event.event)
     Err err ->
@@ -152,6 +203,22 @@ updateOrderStatus orders update =
     sortOrders (List.map updater orders)
 
 
+updateOrderRefund : RefundUpdate -> Order -> Order
+updateOrderRefund update order =
+  if order.number == update.number then
+    { order | paymentStatus = update.paymentStatus, refunded = update.refunded }
+  else
+    order
+
+
+updateOrderBlocked : String -> Bool -> Order -> Order
+updateOrderBlocked telephone blocked order =
+  if order.normalisedTelephone == telephone then
+    { order | blocked = blocked }
+  else
+    order
+
+
 sortOrders : List Order -> List Order
 sortOrders orders =
   let
@@ -170,10 +237,22 @@ type Msg
   | SelectOrder Order
   | CloseModal
   | SetStatus StatusUpdate
-  | OrderStatusUpdateResponse StatusUpdate (Result Http.Error String)
-  | ResendOrderStatusUpdate StatusUpdate
+  | SendOrderStatusUpdate StatusUpdate String
+  | OrderStatusUpdateResponse StatusUpdate String (Result Http.Error String)
   | ExpectedDelta Int
   | ToggleMute
+  | Reprint Int
+  | ReprintResponse (Result Http.Error String)
+  | UpdateRefundPin String
+  | Refund Int
+  | RefundResponse (Result Http.Error RefundResult)
+  | CloseDay
+  | CloseDayResponse (Result Http.Error String)
+  | BlockNumber Order Bool
+  | BlockNumberResponse (Result Http.Error String)
+
+type RefundResult = RefundOkay
+                  | RefundError String
 
 
 update : Msg -> Model -> (Model, Cmd Msg)
@@ -195,6 +274,12 @@ update msg model =
         Ok (StatusUpdateEvent update) ->
           ({ model | orders = sortOrders (updateOrderStatus model.orders update) }
           , Cmd.none)
+        Ok (RefundEvent update) ->
+          ({ model |
+              orders = List.map (updateOrderRefund update) model.orders,
+              modalOrder = Maybe.map (updateOrderRefund update) model.modalOrder
+           }
+          , Cmd.none)
         Err err ->
           let
             _ = Debug.log "Bad SSEvent: " (err ++ " Event: " ++ (toString value))
@@ -202,7 +287,7 @@ update msg model =
             (model, Cmd.none)
 
     SelectOrder order ->
-      ({ model | modalOrder = Just order }, Cmd.none)
+      ({ model | modalOrder = Just order, refundPin = "", refundError = Nothing }, Cmd.none)
 
     CloseModal ->
       ({ model | modalOrder = Nothing }, Cmd.none)
@@ -212,21 +297,25 @@ update msg model =
           orders = updateOrderStatus model.orders update,
           modalOrder = Nothing
        }
-      , sendOrderStatusUpdate update)
+      , Random.generate (SendOrderStatusUpdate update) Idempotency.keyGenerator)
 
-    OrderStatusUpdateResponse update result ->
+    SendOrderStatusUpdate update key ->
+     (model , sendOrderStatusUpdate model.csrfToken key update)
+
+    OrderStatusUpdateResponse update key result ->
       case (Debug.log "response" result) of
         (Ok _) ->
           ({ model | networkError = False }, Cmd.none)
 
-        (Err err) ->
-          ({ model | networkError = True }
-          , Process.sleep (5 * Time.second)
-              |> Task.perform (\_ -> ResendOrderStatusUpdate update)
-          )
+        -- The order changed under us, the server has sent its current status
+        (Err (Http.BadStatus response)) ->
+          if response.status.code == 409 then
+            ({ model | networkError = False }, Cmd.none)
+          else
+            retryOrderStatusUpdate model update key
 
-    ResendOrderStatusUpdate update ->
-     (model , sendOrderStatusUpdate update)
+        (Err err) ->
+          retryOrderStatusUpdate model update key
 
     ExpectedDelta delta ->
       ({ model | expected = model.expected + delta }, Cmd.none)
@@ -234,18 +323,108 @@ update msg model =
     ToggleMute ->
       ({ model | muted = not model.muted }, Cmd.none)
 
+    Reprint number ->
+      let
+        body = Http.jsonBody (Encode.object [ ("Number", Encode.int number) ])
+      in
+        (model, Http.send ReprintResponse (Csrf.post model.csrfToken "/till/printOrder" body string))
+
+    ReprintResponse (Ok _) ->
+      ({ model | networkError = False }, Cmd.none)
+
+    ReprintResponse (Err _) ->
+      ({ model | networkError = True }, Cmd.none)
+
+    UpdateRefundPin pin ->
+      ({ model | refundPin = pin }, Cmd.none)
+
+    Refund number ->
+      let
+        body = Http.jsonBody
+          <| Encode.object
+              [ ("Number", Encode.int number)
+              , ("Reason", Encode.string "Refunded at till")
+              , ("PIN", Encode.string model.refundPin)
+              ]
+      in
+        ({ model | refundError = Nothing }
+        , Http.send RefundResponse (Csrf.post model.csrfToken "/till/refundOrder" body refundResultDecoder))
+
+    RefundResponse (Ok RefundOkay) ->
+      ({ model | networkError = False, refundPin = "" }, Cmd.none)
+
+    RefundResponse (Ok (RefundError msg)) ->
+      ({ model | networkError = False, refundError = Just msg }, Cmd.none)
+
+    RefundResponse (Err _) ->
+      ({ model | networkError = True }, Cmd.none)
+
+    CloseDay ->
+      if model.confirmCloseDay then
+        ({ model | confirmCloseDay = False }
+        , Http.send CloseDayResponse (Csrf.post model.csrfToken "/till/closeDay" Http.emptyBody (field "URL" string)))
+      else
+        ({ model | confirmCloseDay = True }, Cmd.none)
 
-sendOrderStatusUpdate : StatusUpdate -> Cmd Msg
-sendOrderStatusUpdate update =
+    CloseDayResponse (Ok url) ->
+      (model, Navigation.load url)
+
+    CloseDayResponse (Err _) ->
+      ({ model | networkError = True }, Cmd.none)
+
+    BlockNumber order blocked ->
+      let
+        body = Http.jsonBody
+          <| Encode.object
+              [ ("Number", Encode.int order.number)
+              , ("Blocked", Encode.bool blocked)
+              ]
+        updater = updateOrderBlocked order.normalisedTelephone blocked
+      in
+        ({ model |
+            orders = List.map updater model.orders,
+            modalOrder = Maybe.map updater model.modalOrder
+         }
+        , Http.send BlockNumberResponse (Csrf.post model.csrfToken "/till/blockNumber" body string))
+
+    BlockNumberResponse (Ok _) ->
+      ({ model | networkError = False }, Cmd.none)
+
+    BlockNumberResponse (Err _) ->
+      ({ model | networkError = True }, Cmd.none)
+
+
+refundResultDecoder : Decoder RefundResult
+refundResultDecoder =
+  field "Status" string
+    |> andThen (\str ->
+      case str of
+        "OK" -> succeed RefundOkay
+        "ERR" -> Decode.map RefundError (field "Error" string)
+        _ -> fail ("Bad 'Status': " ++ str)
+    )
+
+
+-- Resent with the same key so an update that did arrive isn't applied twice
+retryOrderStatusUpdate : Model -> StatusUpdate -> String -> (Model, Cmd Msg)
+retryOrderStatusUpdate model update key =
+  ({ model | networkError = True }
+  , Process.sleep (5 * Time.second)
+      |> Task.perform (\_ -> SendOrderStatusUpdate update key)
+  )
+
+
+sendOrderStatusUpdate : Csrf.Token -> String -> StatusUpdate -> Cmd Msg
+sendOrderStatusUpdate csrfToken key update =
   let
     body = Http.jsonBody
       <| Encode.object
           [ ("Number", Encode.int update.number)
           , ("Status", Encode.string (toString update.status))
           ]
-    request = Http.post "/till/updateOrder" body string
+    request = Idempotency.post csrfToken key "/till/updateOrder" body string
   in
-    Http.send (OrderStatusUpdateResponse update) request
+    Http.send (OrderStatusUpdateResponse update key) request
 
 
 -- VIEW
@@ -254,10 +433,10 @@ view : Model -> Html Msg
 view model =
   div []
     [ navbarView model
-    , modalView model.now model.expected model.modalOrder
+    , modalView model
     , div [ class "container section" ]
       [ h2 [] [ text "Orders " ]
-      , ordersView model.now model.expected model.orders
+      , ordersView model.restaurant.currency model.now model.expected model.orders
       ]
     , Sound.bellView
     ]
@@ -282,13 +461,20 @@ navbarView model =
   in
     Layout.navbarView title 1.0
       [ span [] [ text networkError ]
+      , Button.button
+          [ Button.small
+          , if model.confirmCloseDay then Button.danger else Button.secondary
+          , Button.attrs [ class "mx-2" ]
+          , Button.onClick CloseDay
+          ]
+          [ text (if model.confirmCloseDay then "Confirm Close Day" else "Close Day") ]
       , img [ class "mute-button", src muteIcon, onClick ToggleMute ] []
       , span [ class "clock" ] [ text (clock model.now) ]
       ]
 
 
-ordersView : Time.Time -> Int -> List Order -> Html Msg
-ordersView now expected orders =
+ordersView : Currency -> Time.Time -> Int -> List Order -> Html Msg
+ordersView currency now expected orders =
   Table.table
     { options = [ Table.attr (class "table-fixed") ]
     , thead =
@@ -301,17 +487,19 @@ ordersView now expected orders =
           , Table.th [] [ text "" ]
           ]
     , tbody =
-        Table.tbody [] (List.map (ordersLineView now expected) orders)
+        Table.tbody [] (List.map (ordersLineView currency now expected) orders)
     }
 
-ordersLineView : Time.Time -> Int -> Order -> Table.Row Msg
-ordersLineView now expected order =
+ordersLineView : Currency -> Time.Time -> Int -> Order -> Table.Row Msg
+ordersLineView currency now expected order =
   let
-    (totalItems, totalPrice) = Menu.orderTotals order.menu order.order
+    (totalItems, _) = Menu.orderTotals currency order.menu order.order
+    -- The charged total, after any discounts
+    totalPrice = Menu.priceString currency order.total
   in
     Table.tr []
-      [ Table.td [ cellAttr (class "text-center") ] [ text (toString order.number) ]
-      , Table.td [] [ text order.name ]
+      [ Table.td [ cellAttr (class "text-center") ] [ text (toString order.displayNumber) ]
+      , Table.td [] [ text order.name, allergyBadge order, suspiciousBadge order ]
       , Table.td [ cellAttr (class "text-center") ] [ text totalItems ]
       , Table.td [ cellAttr (class "text-right") ] [ text totalPrice ]
       , Table.td [ cellAttr (class "text-center") ] [ text (statusString now order.status) ]
@@ -324,14 +512,16 @@ ordersLineView now expected order =
       ]
 
 
-modalView : Time.Time -> Int -> Maybe Order -> Html Msg
-modalView now expected order =
-  case order of
+modalView : Model -> Html Msg
+modalView model =
+  case model.modalOrder of
     Nothing ->
       text ""
     Just order ->
       let
-        title = "Order #" ++ (toString order.number) ++ " - " ++ order.name ++ " (" ++ order.telephone ++ ")"
+        title = "Order #" ++ (toString order.displayNumber) ++ " - " ++ order.name ++ " (" ++ order.telephone ++ ")"
+        now = model.now
+        expected = model.expected
         due = (toString expected) ++ " min"
       in
         Modal.config CloseModal
@@ -339,7 +529,12 @@ modalView now expected order =
           |> Modal.h5 [] [ text title ]
           |> Modal.body [ class "d-flex flex-row" ]
               [ div [ class "flex-grow-1" ]
-                  [ Menu.invoiceView order.menu order.order ]
+                  [ allergyAlertView order
+                  , suspiciousAlertView order
+                  , Menu.invoiceView model.restaurant.currency order.menu order.order
+                  , Menu.discountsView model.restaurant.currency order.discounts
+                  , Menu.chargesView model.restaurant.currency order.charges
+                  ]
               , div [ class "divider"] []
               , div [ class "text-center" ]
                   [ p [ class "status"]
@@ -357,11 +552,99 @@ modalView now expected order =
                   , statusButton order "Ready" OrderStatus.Ready
                   , statusButton order "Picked Up" OrderStatus.PickedUp
                   , statusButton order "Reject" OrderStatus.Rejected
+                  , if model.hasPrinter then
+                      p [] [ Button.button [ Button.secondary, Button.onClick (Reprint order.number) ] [ text "Print" ] ]
+                    else
+                      text ""
+                  , refundView model order
+                  , blockButton order
                   ]
               ]
           |> Modal.view Modal.shown
 
 
+refundView : Model -> Order -> Html Msg
+refundView model order =
+  let
+    refundedText =
+      if order.refunded > 0 then
+        p [] [ text ("Refunded " ++ (Menu.priceString model.restaurant.currency order.refunded)) ]
+      else
+        text ""
+  in
+    if order.paymentStatus == "Paid" || order.paymentStatus == "PartiallyRefunded" then
+      div [ class "refund" ]
+        [ refundedText
+        , case model.refundError of
+            Just msg -> p [ class "text-danger" ] [ text msg ]
+            Nothing -> text ""
+        , Input.password [ Input.small, Input.placeholder "Refund PIN", Input.value model.refundPin, Input.onInput UpdateRefundPin ]
+        , Button.button
+            [ Button.warning
+            , Button.disabled (String.isEmpty model.refundPin)
+            , Button.onClick (Refund order.number)
+            ]
+            [ text "Refund" ]
+        ]
+    else
+      refundedText
+
+
+allergyBadge : Order -> Html Msg
+allergyBadge order =
+  if List.isEmpty order.allergens then
+    text ""
+  else
+    span [ class "badge badge-danger mx-1" ] [ text "Allergens" ]
+
+
+allergyAlertView : Order -> Html Msg
+allergyAlertView order =
+  if List.isEmpty order.allergens then
+    text ""
+  else
+    div [ class "alert alert-danger allergy-alert" ]
+      [ strong [] [ text "Contains: " ]
+      , text (String.join ", " order.allergens)
+      ]
+
+
+suspiciousBadge : Order -> Html Msg
+suspiciousBadge order =
+  if order.blocked then
+    span [ class "badge badge-dark mx-1" ] [ text "Blocked" ]
+  else if List.isEmpty order.suspicious then
+    text ""
+  else
+    span [ class "badge badge-warning mx-1" ] [ text "Check" ]
+
+
+suspiciousAlertView : Order -> Html Msg
+suspiciousAlertView order =
+  if List.isEmpty order.suspicious then
+    text ""
+  else
+    div [ class "alert alert-warning" ]
+      [ strong [] [ text "Check before cooking: " ]
+      , text (String.join ", " order.suspicious)
+      ]
+
+
+blockButton : Order -> Html Msg
+blockButton order =
+  if String.isEmpty order.normalisedTelephone then
+    text ""
+  else
+    p [ class "mt-3" ]
+      [ Button.button
+          [ if order.blocked then Button.secondary else Button.outlineDanger
+          , Button.small
+          , Button.onClick (BlockNumber order (not order.blocked))
+          ]
+          [ text (if order.blocked then "Unblock Number" else "Block This Number") ]
+      ]
+
+
 mostLikelyButton : Time.Time -> Int -> Order -> Html Msg
 mostLikelyButton now expected order =
   let
@@ -384,6 +667,8 @@ mostLikelyButton now expected order =
         text ""
       OrderStatus.Rejected ->
         text ""
+      OrderStatus.Cancelled _ ->
+        text ""
 
 
 timeButton : Order -> Int -> Html Msg
@@ -467,6 +752,10 @@ statusString now status =
         "Expected: " ++ minutes ++ "m"
     OrderStatus.PickedUp ->
       "Picked Up"
+    OrderStatus.Cancelled "" ->
+      "Cancelled"
+    OrderStatus.Cancelled reason ->
+      "Cancelled: " ++ reason
     _ ->
       toString status
 
@@ -3,7 +3,7 @@ module EditForm exposing (..)
 import Util.Loader as Loader
 import Navigation
 import Json.Decode as Decode exposing (Decoder, Value, decodeValue, field, string, list, dict, bool)
-import Json.Decode.Pipeline exposing (decode, required, optional, hardcoded)
+import Json.Decode.Pipeline exposing (decode, required, optional, hardcoded, custom)
 import Json.Encode as Encode
 import Html exposing (..)
 import Html.Attributes
@@ -12,6 +12,7 @@ import Dict
 import Http
 
 import Util.ErrorDialog as ErrorDialog
+import Util.Csrf as Csrf
 import Util.Form
 
 import Bootstrap.Grid as Grid
@@ -45,6 +46,7 @@ type alias Model =
   , saving : Bool
   , dirty : Bool
   , errorDialog : ErrorDialog.Dialog Msg
+  , csrfToken : Csrf.Token
   }
 
 type Row = StringRow BasicRowData
@@ -78,6 +80,7 @@ decodeModel =
     |> hardcoded False
     |> hardcoded False
     |> hardcoded Nothing
+    |> custom Csrf.decoder
 
 decodeRow : Decoder Row
 decodeRow =
@@ -132,7 +135,7 @@ update msg model =
       ({ model |
          dirty = False }
       , if model.dirty then
-          post model.url "VALIDATE" model.fields
+          post model.csrfToken model.url "VALIDATE" model.fields
         else
           Cmd.none
       )
@@ -143,10 +146,10 @@ update msg model =
     Save ->
       ({ model |
          saving = True }
-      , post model.url "SAVE" model.fields)
+      , post model.csrfToken model.url "SAVE" model.fields)
     Retry action fields ->
       (model
-      , post model.url action fields)
+      , post model.csrfToken model.url action fields)
 
 validationUpdate : String -> Fields -> Result Http.Error PostResponse -> Model -> (Model, Cmd Msg)
 validationUpdate action fields result savingModel =
@@ -192,8 +195,8 @@ updateFieldValue newValue field =
 
 -- HTTP
 
-post : String -> String -> Fields -> Cmd Msg
-post url action fields =
+post : Csrf.Token -> String -> String -> Fields -> Cmd Msg
+post csrfToken url action fields =
   let
     fieldValue = \(id, field) -> (id, Encode.string field.value)
     fieldValues = \fields -> List.map fieldValue (Dict.toList fields)
@@ -204,7 +207,7 @@ post url action fields =
                   ]
   in
     Http.send (Validation action fields) <|
-      Http.post url body decodePostResponse
+      Csrf.post csrfToken url body decodePostResponse
 
 type PostResponse = Errors (Dict.Dict String Errors)
                   | Okay
@@ -2,11 +2,16 @@ module FrontEnd.Main exposing (..)
 
 import Models.Menu as Menu
 import Models.Restaurant as Restaurant
+import Models.Currency as Currency exposing (Currency)
 
 import Util.Loader as Loader
 import Navigation
 import Char
 import Scroll
+import Util.Challenge as Challenge
+import Util.Idempotency as Idempotency
+import Util.Csrf as Csrf
+import Random
 import Window
 import Task
 import Time
@@ -17,15 +22,16 @@ import Util.ErrorDialog as ErrorDialog
 import Views.Layout as Layout
 
 import Json.Decode as Decode exposing (Decoder, Value, succeed, decodeValue, string, int)
-import Json.Decode.Pipeline exposing (decode, required, optional, hardcoded, resolve)
+import Json.Decode.Pipeline exposing (decode, required, optional, hardcoded, resolve, custom)
 import Json.Encode as Encode
 
 import Html exposing (..)
-import Html.Attributes exposing(id, class, src, style, href, placeholder)
+import Html.Attributes exposing(id, class, src, style, href, placeholder, selected)
 
 import Bootstrap.Button as Button
 import Bootstrap.Form as Form
 import Bootstrap.Form.Input as Input
+import Bootstrap.Form.Select as Select
 import Bootstrap.Grid.Col as Col
 import Bootstrap.Alert as Alert
 
@@ -51,6 +57,7 @@ init value location =
     , Cmd.batch
         [ Scroll.scrollHash location
         , Task.perform WindowSize Window.size
+        , newOrderKey
         ]
     )
 
@@ -58,13 +65,26 @@ init value location =
 
 type alias Model =
   { restaurant : Restaurant.Restaurant
+  , logo : Maybe String
   , menuId : Int
   , menu : Menu.Menu
   , googleStaticMapsKey : String
+  , paymentsEnabled : Bool
+  , pricesIncludeTax : Bool
+  , tipOptions : List Int
+  , challenge : Maybe Value
+  , challengeFor : ChallengeUse
 
   , order : Menu.Order
   , confirmName : String
   , confirmPhone : String
+  , card : String
+  , promoCode : String
+  , tip : Tip
+  , tipAmount : String
+  , unpaidOrder : Maybe UnpaidOrder
+  , verification : Maybe Verification
+  , orderKey : String
 
   , scrollPosition : Float
   , menuTop : Float
@@ -73,8 +93,38 @@ type alias Model =
   , page : Page
   , orderStatus : OrderStatus
   , errorDialog : ErrorDialog.Dialog Msg
+  , reorderChanges : List ReorderChange
+  , csrfToken : Csrf.Token
   }
 
+type alias ReorderChange =
+  { name : String
+  , removed : Bool
+  , oldPrice : Menu.Money
+  , newPrice : Menu.Money
+  }
+
+-- An order that has been placed but not yet paid for, retries only repeat the payment
+type alias UnpaidOrder =
+  { number : Int
+  , trackingUrl : String
+  }
+
+-- The restaurant wants the phone number checked with a texted code before the order is placed.
+-- Asking for a code takes a challenge of its own, the server sends one for each request.
+type alias Verification =
+  { code : String
+  , busy : Bool
+  , error : Maybe String
+  , challenge : Maybe Value
+  }
+
+-- What the challenge being solved is for
+type ChallengeUse = ForOrder | ForVerification
+
+-- Percentages are in basis points, as the server sends the options
+type Tip = NoTip | TipPercent Int | TipAmount
+
 type Page = PageOne | PageTwo | PageThree
 type OrderStatus = Deciding (Maybe String) | Ordering
 
@@ -82,11 +132,24 @@ decodeModel : Decoder Model
 decodeModel =
     decode Model
       |> required "Restaurant" Restaurant.decode
+      |> optional "Logo" (Decode.map Just (Decode.field "medium" string)) Nothing
       |> required "MenuID" int
       |> required "Menu" Menu.menuDecoder
       |> required "GoogleStaticMapsKey" string
-      |> hardcoded [] -- [ {id=1, qty=1}, {id=2, qty=2}, {id=3, qty=3}]
+      |> required "PaymentsEnabled" Decode.bool
+      |> required "PricesIncludeTax" Decode.bool
+      |> required "TipOptions" (Decode.list int)
+      |> optional "Challenge" (Decode.nullable Decode.value) Nothing
+      |> hardcoded ForOrder
+      |> custom (Decode.oneOf [ Decode.at ["Reorder", "Items"] Menu.orderDecoder, succeed [] ])
+      |> custom (prefill "Name")
+      |> custom (prefill "Telephone")
+      |> hardcoded ""
       |> hardcoded ""
+      |> hardcoded NoTip
+      |> hardcoded ""
+      |> hardcoded Nothing
+      |> hardcoded Nothing
       |> hardcoded ""
       |> hardcoded 0.0
       |> hardcoded 0.0
@@ -95,12 +158,30 @@ decodeModel =
       |> hardcoded PageOne
       |> hardcoded (Deciding Nothing)
       |> hardcoded Nothing
+      |> custom (Decode.oneOf [ Decode.at ["Reorder", "Changes"] (Decode.list decodeReorderChange), succeed [] ])
+      |> custom Csrf.decoder
+
+
+-- Logged in customers get their details from last time
+prefill : String -> Decoder String
+prefill key =
+  Decode.oneOf [ Decode.at ["Customer", key] string, succeed "" ]
+
+
+decodeReorderChange : Decoder ReorderChange
+decodeReorderChange =
+    decode ReorderChange
+      |> required "Name" string
+      |> required "Removed" Decode.bool
+      |> required "OldPrice" int
+      |> required "NewPrice" int
 
 subscriptions : Model -> Sub Msg
 subscriptions model =
   Sub.batch
   [ Scroll.scrollPosition Scrolled
   , Window.resizes WindowSize
+  , Challenge.challengeSolved ChallengeSolved
   ]
 
 -- UPDATE
@@ -112,10 +193,22 @@ type Msg
   | ScrollMenu
   | WindowSize Window.Size
   | PlaceOrder
+  | ChallengeSolved Value
+  | NewOrderKey String
   | PlaceOrderResponse (Result Http.Error PostResponse)
+  | PayOrder
   | ToggleErrorDetails
   | UpdateConfirmName String
   | UpdateConfirmPhone String
+  | UpdateCard String
+  | UpdatePromoCode String
+  | UpdateTip String
+  | UpdateTipAmount String
+  | SendVerificationCode
+  | UpdateVerificationCode String
+  | CheckVerificationCode
+  | VerificationCodeSent (Result Http.Error VerifyResponse)
+  | VerificationChecked (Result Http.Error VerifyResponse)
 
 update : Msg -> Model -> (Model, Cmd Msg)
 update msg model =
@@ -144,30 +237,81 @@ update msg model =
       ( { model | windowHeight = toFloat windowSize.height }, Cmd.none )
 
     PlaceOrder ->
-      let
-        body = Http.jsonBody (encodeOrder model.confirmName model.confirmPhone model.menuId model.order)
-        request = Http.post "/placeOrder" body decodePostResponse
-      in
-        ({ model |
-            orderStatus = Ordering,
-            errorDialog = Nothing
-          }
-        , Http.send PlaceOrderResponse request)
+      case model.challenge of
+        Just challenge ->
+          ({ model |
+              orderStatus = Ordering,
+              errorDialog = Nothing,
+              challengeFor = ForOrder
+            }
+          , Challenge.solveChallenge challenge)
+
+        Nothing ->
+          sendOrder model Encode.null
+
+    ChallengeSolved answer ->
+      case model.challengeFor of
+        ForOrder -> sendOrder model answer
+        ForVerification -> (model, sendVerificationCode model answer)
+
+    NewOrderKey key ->
+      ({ model | orderKey = key }, Cmd.none)
 
     PlaceOrderResponse response ->
       case response of
-        (Ok Okay) ->
-          (model, Navigation.load ("/status"))
-
-        (Ok (Error msg)) ->
-          ({ model | orderStatus = Deciding (Just msg)}, Cmd.none)
+        (Ok (Okay trackingUrl)) ->
+          (model, Navigation.load trackingUrl)
+
+        (Ok (Pay unpaidOrder)) ->
+          update PayOrder { model | unpaidOrder = Just unpaidOrder }
+
+        (Ok (VerifyPhone challenge)) ->
+          let
+            (newModel, cmd) =
+              update SendVerificationCode
+                { model |
+                    orderStatus = Deciding Nothing,
+                    verification = Just (Verification "" False Nothing challenge)
+                }
+          in
+            (newModel, Cmd.batch [ cmd, newOrderKey ])
+
+        (Ok (Error msg newChallenge)) ->
+          let
+            -- A failed challenge can't be answered again, the server sends a new one
+            challenge =
+              case newChallenge of
+                Just _ -> newChallenge
+                Nothing -> model.challenge
+          in
+            ({ model |
+                orderStatus = Deciding (Just msg),
+                challenge = challenge
+              }
+            , newOrderKey)
 
 
         (Err err) ->
           ({ model |
-              errorDialog = ErrorDialog.dialog "Error" (Just ("Retry", PlaceOrder)) (Just (toString err, ToggleErrorDetails))}
+              errorDialog = ErrorDialog.dialog "Error" (Just ("Retry", PayOrder)) (Just (toString err, ToggleErrorDetails))}
           , Cmd.none)
 
+    PayOrder ->
+      case model.unpaidOrder of
+        Just unpaidOrder ->
+          let
+            body = Http.jsonBody (encodePayment unpaidOrder.number model.card)
+            request = Csrf.post model.csrfToken "/payOrder" body decodePostResponse
+          in
+            ({ model |
+                orderStatus = Ordering,
+                errorDialog = Nothing
+              }
+            , Http.send PlaceOrderResponse request)
+
+        Nothing ->
+          update PlaceOrder model
+
     ToggleErrorDetails ->
       ({ model | errorDialog = ErrorDialog.toggleDetails model.errorDialog }
       , Cmd.none)
@@ -176,7 +320,104 @@ update msg model =
       ({ model | confirmName = name}, Cmd.none)
 
     UpdateConfirmPhone phone ->
-      ({ model | confirmPhone = phone}, Cmd.none)
+      ({ model | confirmPhone = phone, verification = Nothing }, Cmd.none)
+
+    UpdateCard card ->
+      ({ model | card = card}, Cmd.none)
+
+    UpdatePromoCode code ->
+      ({ model | promoCode = code}, Cmd.none)
+
+    UpdateTip choice ->
+      let
+        tip =
+          case choice of
+            "amount" -> TipAmount
+            _ ->
+              case String.toInt choice of
+                Ok percent -> TipPercent percent
+                Err _ -> NoTip
+      in
+        ({ model | tip = tip }, Cmd.none)
+
+    UpdateTipAmount amount ->
+      ({ model | tipAmount = amount}, Cmd.none)
+
+    SendVerificationCode ->
+      let
+        sending = updateVerification (\v -> { v | code = "", busy = True, error = Nothing }) model
+      in
+        case Maybe.andThen .challenge model.verification of
+          Just challenge ->
+            ({ sending | challengeFor = ForVerification }, Challenge.solveChallenge challenge)
+
+          Nothing ->
+            (sending, sendVerificationCode sending Encode.null)
+
+    UpdateVerificationCode code ->
+      (updateVerification (\v -> { v | code = code }) model, Cmd.none)
+
+    CheckVerificationCode ->
+      let
+        code = Maybe.withDefault "" (Maybe.map .code model.verification)
+      in
+        (updateVerification (\v -> { v | busy = True, error = Nothing }) model
+        , postVerify model.csrfToken "/verifyPhone/check"
+            [ ("Telephone", Encode.string model.confirmPhone)
+            , ("Code", Encode.string code)
+            ]
+            VerificationChecked)
+
+    VerificationCodeSent (Ok (VerifyOkay challenge)) ->
+      (updateVerification (\v -> { v | busy = False, challenge = challenge }) model, Cmd.none)
+
+    VerificationChecked (Ok (VerifyOkay _)) ->
+      update PlaceOrder { model | verification = Nothing }
+
+    VerificationCodeSent (Ok (VerifyError msg challenge)) ->
+      (updateVerification (\v -> { v | busy = False, error = Just msg, challenge = challenge }) model, Cmd.none)
+
+    VerificationChecked (Ok (VerifyError msg _)) ->
+      (updateVerification (\v -> { v | busy = False, error = Just msg }) model, Cmd.none)
+
+    VerificationCodeSent (Err _) ->
+      (updateVerification (\v -> { v | busy = False, error = Just "Network error, please try again." }) model, Cmd.none)
+
+    VerificationChecked (Err _) ->
+      (updateVerification (\v -> { v | busy = False, error = Just "Network error, please try again." }) model, Cmd.none)
+
+
+updateVerification : (Verification -> Verification) -> Model -> Model
+updateVerification updater model =
+  { model | verification = Maybe.map updater model.verification }
+
+
+sendVerificationCode : Model -> Value -> Cmd Msg
+sendVerificationCode model challengeAnswer =
+  postVerify model.csrfToken "/verifyPhone/start"
+    [ ("Telephone", Encode.string model.confirmPhone)
+    , ("Challenge", challengeAnswer)
+    ]
+    VerificationCodeSent
+
+
+sendOrder : Model -> Value -> (Model, Cmd Msg)
+sendOrder model challengeAnswer =
+  let
+    body = Http.jsonBody (encodeOrder model.confirmName model.confirmPhone model.promoCode (encodeTip model) challengeAnswer model.menuId model.order)
+    request = Idempotency.post model.csrfToken model.orderKey "/placeOrder" body decodePostResponse
+  in
+    ({ model |
+        orderStatus = Ordering,
+        errorDialog = Nothing
+      }
+    , Http.send PlaceOrderResponse request)
+
+
+-- Once the server has answered, placing the order again is a new request
+newOrderKey : Cmd Msg
+newOrderKey =
+  Random.generate NewOrderKey Idempotency.keyGenerator
 
 
 hashToPage : Navigation.Location -> Page
@@ -187,15 +428,40 @@ hashToPage location =
     _ -> PageOne
 
 
-encodeOrder : String -> String -> Int -> Menu.Order -> Value
-encodeOrder name phone menuId order =
+encodeOrder : String -> String -> String -> Value -> Value -> Int -> Menu.Order -> Value
+encodeOrder name phone promoCode tip challengeAnswer menuId order =
   Encode.object
       [ ("Name", Encode.string name)
       , ("Telephone", Encode.string phone)
+      , ("PromoCode", Encode.string promoCode)
+      , ("Tip", tip)
+      , ("Challenge", challengeAnswer)
       , ("MenuId", Encode.int menuId)
       , ("Items", Encode.list (List.map encodeOrderItem order))
       ]
 
+encodeTip : Model -> Value
+encodeTip model =
+  case model.tip of
+    TipPercent percent ->
+      Encode.object [ ("Percent", Encode.int percent) ]
+    TipAmount ->
+      Encode.object [ ("Amount", Encode.int (tipAmount model |> Maybe.withDefault 0)) ]
+    NoTip ->
+      Encode.object []
+
+
+tipAmount : Model -> Maybe Int
+tipAmount model =
+  Currency.parse model.restaurant.currency model.tipAmount
+
+encodePayment : Int -> String -> Value
+encodePayment number card =
+  Encode.object
+      [ ("Number", Encode.int number)
+      , ("PaymentMethod", Encode.string card)
+      ]
+
 encodeOrderItem : Menu.OrderItem -> Value
 encodeOrderItem item =
     Encode.object
@@ -203,8 +469,10 @@ encodeOrderItem item =
       , ("Qty", Encode.int item.qty)
       ]
 
-type PostResponse = Okay
-                  | Error String
+type PostResponse = Okay String
+                  | Pay UnpaidOrder
+                  | VerifyPhone (Maybe Value)
+                  | Error String (Maybe Value)
 
 
 decodePostResponse : Decoder PostResponse
@@ -212,12 +480,40 @@ decodePostResponse =
   (Decode.field "Status" string)
     |> Decode.andThen (\str ->
       case str of
-        "OK" -> Decode.succeed Okay
-        "ERR" -> Decode.map Error (Decode.field "Error" string)
+        "OK" -> Decode.map Okay (Decode.field "TrackingURL" string)
+        "PAY" -> Decode.map Pay
+                   (Decode.map2 UnpaidOrder (Decode.field "Number" int) (Decode.field "TrackingURL" string))
+        "VERIFY" -> Decode.map VerifyPhone (Decode.maybe (Decode.field "Challenge" Decode.value))
+        "ERR" -> Decode.map2 Error (Decode.field "Error" string) (Decode.maybe (Decode.field "Challenge" Decode.value))
         _ -> Decode.fail ("Bad 'Status': " ++ str)
     )
 
 
+-- Replies to code requests carry the challenge for the next one
+type VerifyResponse = VerifyOkay (Maybe Value)
+                    | VerifyError String (Maybe Value)
+
+
+postVerify : Csrf.Token -> String -> List (String, Value) -> (Result Http.Error VerifyResponse -> Msg) -> Cmd Msg
+postVerify csrfToken url fields toMsg =
+  Csrf.post csrfToken url (Http.jsonBody (Encode.object fields)) decodeVerifyResponse
+    |> Http.send toMsg
+
+
+decodeVerifyResponse : Decoder VerifyResponse
+decodeVerifyResponse =
+  let
+    nextChallenge = Decode.maybe (Decode.field "Challenge" Decode.value)
+  in
+    (Decode.field "Status" string)
+      |> Decode.andThen (\str ->
+        case str of
+          "OK" -> Decode.map VerifyOkay nextChallenge
+          "ERR" -> Decode.map2 VerifyError (Decode.field "Error" string) nextChallenge
+          _ -> Decode.fail ("Bad 'Status': " ++ str)
+      )
+
+
 -- VIEW
 
 view : Model -> Html Msg
@@ -225,7 +521,7 @@ view model =
   div []
     [ ErrorDialog.view model.errorDialog
     , navbarView model
-    , logoView model.restaurant.name
+    , logoView model.restaurant.name model.logo
     , placeOrderView model
     , locationView model
     , aboutView model.restaurant.about
@@ -267,15 +563,16 @@ navbarOpacity model =
     max 0.0 (min 1.0 unboundOpacity)
 
 
-logoView : String -> Html Msg
-logoView name =
+logoView : String -> Maybe String -> Html Msg
+logoView name logo =
   let
     enspace = String.fromChar (Char.fromCode 8194)
+    logoSrc = Maybe.withDefault "/assets/food-e8350f.jpg" logo
   in
     div
       [ class "container logo-box d-flex flex-column justify-content-center" ]
       [ div [ ]
-        [ img [ class "mx-auto d-block", src "/assets/food-e8350f.jpg" ] []
+        [ img [ class "mx-auto d-block", src logoSrc ] []
         , h1 [ class "text-center", style [("margin-top", "1em")] ] [ text name ]
         , p [ class "logo-box-nav"]
             [ a [ href "#menu" ] [ text "Menu"]
@@ -305,7 +602,7 @@ menuView : Model -> Html Msg
 menuView model =
   div [ class "container section menu" ]
     [ h2 [] [ text "Menu" ]
-    , Html.map MenuMsg (Menu.menuView model.menu model.order)
+    , Html.map MenuMsg (Menu.menuView model.restaurant.currency model.menu model.order)
     ]
 
 
@@ -317,16 +614,38 @@ orderView model =
       --[ div [ class "float-right order-now" ]
       --    [ Form.spinnerButton "Order Now" False (model.orderStatus == Ordering) PlaceOrder ]
       [ h2 [] [ text "Review Order" ]
-      , Html.map MenuMsg (Menu.invoiceView model.menu model.order)
+      , reorderChangesView model.restaurant.currency model.reorderChanges
+      , Html.map MenuMsg (Menu.invoiceView model.restaurant.currency model.menu model.order)
       ]
     ]
 
+reorderChangesView : Currency -> List ReorderChange -> Html Msg
+reorderChangesView currency changes =
+  let
+    changeView change =
+      if change.removed then
+        li [] [ text (change.name ++ " is no longer available.") ]
+      else
+        li [] [ text (change.name ++ " was " ++ (Menu.priceString currency change.oldPrice)
+                      ++ ", now " ++ (Menu.priceString currency change.newPrice) ++ ".") ]
+  in
+    if List.isEmpty changes then
+      text ""
+    else
+      Alert.simpleWarning []
+        [ p [] [ text "The menu has changed since your last order:" ]
+        , ul [] (List.map changeView changes)
+        ]
+
+
 confirmView : Model -> Html Msg
 confirmView model =
   let
-    (totalItems, totalPrice) = Menu.orderTotals model.menu model.order
+    (totalItems, totalPrice) = Menu.orderTotals model.restaurant.currency model.menu model.order
     submitDisabled = String.isEmpty (String.trim model.confirmName)
                    || String.isEmpty (String.trim model.confirmPhone)
+                   || (model.paymentsEnabled && String.isEmpty (String.trim model.card))
+                   || (model.tip == TipAmount && tipAmount model == Nothing)
   in
     div []
       [ navbarView model
@@ -341,7 +660,8 @@ confirmView model =
                  , strong [] [ text totalItems ]
                  , text " items and has total of "
                  , strong [] [ text totalPrice ]
-                 , text "."
+                 , text (if model.pricesIncludeTax then "." else " plus tax.")
+                 , text " Any discounts are taken off when you order."
                  ]
           , Form.form []
             [ Form.row []
@@ -354,11 +674,71 @@ confirmView model =
               , Form.col [ Col.sm10 ]
                   [ Input.text [ Input.value model.confirmPhone, Input.onInput UpdateConfirmPhone ] ]
               ]
+            , Form.row []
+              [ Form.colLabel [ Col.sm2 ] [ text "Promo Code" ]
+              , Form.col [ Col.sm10 ]
+                  [ Input.text [ Input.value model.promoCode, Input.onInput UpdatePromoCode ] ]
+              ]
+            , tipView model
+            , if model.paymentsEnabled then
+                Form.row []
+                  [ Form.colLabel [ Col.sm2 ] [ text "Card Number" ]
+                  , Form.col [ Col.sm10 ]
+                      [ Input.text [ Input.value model.card, Input.onInput UpdateCard ] ]
+                  ]
+              else
+                text ""
             ]
-          , p [] [ Form.spinnerButton "Order Now" submitDisabled (model.orderStatus == Ordering) PlaceOrder ]
+          , case model.verification of
+              Just verification ->
+                verificationView model.confirmPhone verification
+              Nothing ->
+                p [] [ Form.spinnerButton "Order Now" submitDisabled (model.orderStatus == Ordering) PayOrder ]
           ]
       ]
 
+verificationView : String -> Verification -> Html Msg
+verificationView phone verification =
+  div [ class "verification" ]
+    [ case verification.error of
+        Just msg -> Alert.simpleDanger [] [ text msg ]
+        Nothing -> text ""
+    , p [] [ text ("We have texted a code to " ++ phone ++ ", enter it below to confirm your number and place your order.") ]
+    , Input.text [ Input.value verification.code, Input.onInput UpdateVerificationCode, Input.placeholder "Code" ]
+    , p []
+        [ Form.spinnerButton "Confirm" (String.isEmpty (String.trim verification.code)) verification.busy CheckVerificationCode
+        , Button.button [ Button.roleLink, Button.onClick SendVerificationCode ] [ text "Send another code" ]
+        ]
+    ]
+
+tipView : Model -> Html Msg
+tipView model =
+  let
+    tipItem choice label isSelected =
+      Select.item [ Html.Attributes.value choice, selected isSelected ] [ text label ]
+    percentItem percent =
+      tipItem (toString percent) ((toString (toFloat percent / 100)) ++ "%") (model.tip == TipPercent percent)
+  in
+    if List.isEmpty model.tipOptions then
+      text ""
+    else
+      Form.row []
+        [ Form.colLabel [ Col.sm2 ] [ text "Tip" ]
+        , Form.col [ Col.sm4 ]
+            [ Select.select [ Select.onChange UpdateTip ]
+                ( [ tipItem "" "No tip" (model.tip == NoTip) ]
+                  ++ (List.map percentItem model.tipOptions)
+                  ++ [ tipItem "amount" "Other amount" (model.tip == TipAmount) ]
+                )
+            ]
+        , Form.col [ Col.sm6 ]
+            [ if model.tip == TipAmount then
+                Input.text [ Input.value model.tipAmount, Input.onInput UpdateTipAmount, Input.placeholder "Amount" ]
+              else
+                text ""
+            ]
+        ]
+
 locationView : Model -> Html Msg
 locationView model =
   let
@@ -414,6 +794,7 @@ text2html str =
 footer : Html Msg
 footer =
   p [ class "footer" ]
-    [ text "Website by "
+    [ a [ href "/account" ] [ text "Your orders" ]
+    , text " · Website by "
     , a [ href "#" ] [ text "feedme.nz" ]
     ]
@@ -2,18 +2,24 @@ module FrontEnd.Status exposing (..)
 
 import Util.Loader as Loader
 import Html exposing (..)
-import Html.Attributes exposing(class)
+import Html.Attributes exposing(class, href)
+import Http
 import Navigation
-import Json.Decode as Decode exposing (Value, Decoder, decodeValue)
+import Json.Decode as Decode exposing (Value, Decoder, decodeValue, field, string, andThen)
+import Json.Encode as Encode
 import Views.Layout as Layout
 import Models.Restaurant as Restaurant
+import Models.Currency exposing (Currency)
 import Models.Menu as Menu
 import Models.OrderStatus as OrderStatus
 import Json.Decode.Pipeline exposing (decode, required, hardcoded, custom)
-import Util.Form exposing (spinner)
+import Util.Form exposing (spinner, spinnerButton)
 import Util.SSE as SSE
+import Util.Csrf as Csrf
 import Time
 import Task
+import Bootstrap.Form.Input as Input
+import Bootstrap.Alert as Alert
 
 main =
   Loader.programWithFlags2
@@ -26,32 +32,97 @@ main =
 
 init : Value -> Navigation.Location -> (Result String Model, Cmd Msg)
 init value location =
-    ( decodeValue decodeModel value
-    , Cmd.batch
-        [ Task.perform Tick Time.now
-        ,SSE.createEventSource "/status/stream"
-        ]
-    )
+  case decodeValue decodeModel value of
+    Ok model ->
+      ( Ok model
+      , Cmd.batch
+          [ Task.perform Tick Time.now
+          , SSE.createEventSource model.streamUrl
+          ]
+      )
+    Err err ->
+      (Err err, Cmd.none)
 
 -- MODEL
 
 type alias Model =
   { restaurant : Restaurant.Restaurant
   , menu : Menu.Menu
+  , number : Int
+  , displayNumber : Int
   , order : Menu.Order
+  , discounts : List Menu.Discount
+  , charges : List Menu.Charge
+  , exclusiveTax : Menu.Money
+  , total : Menu.Money
   , now : Time.Time
   , status : OrderStatus.OrderStatus
+  , cancelUntil : Maybe Time.Time
+  , paymentPending : Bool
+  , refunds : List Refund
+  , cancelReason : String
+  , cancelling : Bool
+  , cancelError : Maybe String
+  , streamUrl : String
+  , recentOrders : List OrderSummary
+  , csrfToken : Csrf.Token
+  }
+
+type alias Refund =
+  { amount : Menu.Money
+  , reason : String
+  }
+
+type alias OrderSummary =
+  { number : Int
+  , displayNumber : Int
+  , total : Menu.Money
+  , status : OrderStatus.OrderStatus
+  , trackingUrl : String
   }
 
 
+
 decodeModel : Decoder Model
 decodeModel =
     decode Model
       |> required "Restaurant" Restaurant.decode
       |> required "Menu" Menu.menuDecoder
+      |> required "Number" Decode.int
+      |> required "DisplayNumber" Decode.int
       |> required "Order" Menu.orderDecoder
+      |> required "Discounts" (Decode.list Menu.discountDecoder)
+      |> required "Charges" (Decode.list Menu.chargeDecoder)
+      |> required "ExclusiveTax" Decode.int
+      |> required "Total" Decode.int
       |> hardcoded 0
       |> custom OrderStatus.statusDecoder
+      |> required "CancelUntil" (Decode.nullable (string |> andThen OrderStatus.dateDecoder))
+      |> required "PaymentPending" Decode.bool
+      |> required "Refunds" (Decode.list refundDecoder)
+      |> hardcoded ""
+      |> hardcoded False
+      |> hardcoded Nothing
+      |> required "StreamURL" string
+      |> required "RecentOrders" (Decode.list orderSummaryDecoder)
+      |> custom Csrf.decoder
+
+
+refundDecoder : Decoder Refund
+refundDecoder =
+    decode Refund
+      |> required "Amount" Decode.int
+      |> required "Reason" string
+
+
+orderSummaryDecoder : Decoder OrderSummary
+orderSummaryDecoder =
+    decode OrderSummary
+      |> required "Number" Decode.int
+      |> required "DisplayNumber" Decode.int
+      |> required "Total" Decode.int
+      |> custom OrderStatus.statusDecoder
+      |> required "TrackingURL" string
 
 
 subscriptions : Model -> Sub Msg
@@ -67,6 +138,9 @@ type Msg
   = NewLocation Navigation.Location
   | Tick Time.Time
   | SSEvent String
+  | UpdateCancelReason String
+  | CancelOrder
+  | CancelOrderResponse (Result Http.Error CancelResponse)
 
 type Event
   = StatusUpdateEvent OrderStatus.StatusUpdate
@@ -91,6 +165,46 @@ update msg model =
           in
             (model, Cmd.none)
 
+    UpdateCancelReason reason ->
+      ({ model | cancelReason = reason }, Cmd.none)
+
+    CancelOrder ->
+      let
+        body = Http.jsonBody
+          <| Encode.object
+              [ ("Number", Encode.int model.number)
+              , ("Reason", Encode.string model.cancelReason)
+              ]
+        request = Csrf.post model.csrfToken "/cancelOrder" body decodeCancelResponse
+      in
+        ({ model | cancelling = True, cancelError = Nothing }
+        , Http.send CancelOrderResponse request)
+
+    CancelOrderResponse (Ok Cancelled) ->
+      -- the status update arrives over the event stream
+      ({ model | cancelling = False }, Cmd.none)
+
+    CancelOrderResponse (Ok (CancelError msg)) ->
+      ({ model | cancelling = False, cancelError = Just msg }, Cmd.none)
+
+    CancelOrderResponse (Err err) ->
+      ({ model | cancelling = False, cancelError = Just "Could not cancel your order, please try again." }, Cmd.none)
+
+
+type CancelResponse = Cancelled
+                    | CancelError String
+
+
+decodeCancelResponse : Decoder CancelResponse
+decodeCancelResponse =
+  (field "Status" string)
+    |> andThen (\str ->
+      case str of
+        "OK" -> Decode.succeed Cancelled
+        "ERR" -> Decode.map CancelError (field "Error" string)
+        _ -> Decode.fail ("Bad 'Status': " ++ str)
+    )
+
 
 decodeEvent : String -> Result String Event
 decodeEvent eventStr =
@@ -120,8 +234,12 @@ view model =
     [ Layout.navbarView model.restaurant.name 1.0 []
     , div [ class "container section status" ]
       [ h2 [] [ text "Order Status" ]
-      , p [] [ text "Your order has been received." ]
+      , if model.paymentPending then
+          Alert.simpleWarning [] [ text "Your order is awaiting payment, it will be sent to the kitchen once payment is received." ]
+        else
+          p [] [ text ("Your order #" ++ (toString model.displayNumber) ++ " has been received.") ]
       , statusView model.now model.status
+      , cancelView model
       {-, p [] [ text "Your order has been received."]
       , p []
           [ text "Estimated ready time: "
@@ -130,7 +248,12 @@ view model =
           , spinner
           ]
       -}
-      , Menu.invoiceView model.menu model.order
+      , Menu.invoiceView model.restaurant.currency model.menu model.order
+      , Menu.discountsView model.restaurant.currency model.discounts
+      , Menu.chargesView model.restaurant.currency model.charges
+      , taxView model
+      , refundsView model.restaurant.currency model.refunds
+      , recentOrdersView model
       ]
 
     ]
@@ -169,3 +292,99 @@ statusView now status =
     OrderStatus.Rejected ->
       p []
         [ text "Sorry, your order has been rejected. Please telephone the shop for more details." ]
+
+    OrderStatus.Cancelled _ ->
+      p []
+        [ text "Your order has been cancelled." ]
+
+
+recentOrdersView : Model -> Html Msg
+recentOrdersView model =
+  let
+    others = List.filter (\summary -> summary.number /= model.number) model.recentOrders
+    summaryView summary =
+      li []
+        [ a [ href summary.trackingUrl ]
+            [ text ("Order #" ++ (toString summary.displayNumber) ++ " – " ++ (Menu.priceString model.restaurant.currency summary.total)) ]
+        , text (" " ++ (statusLabel summary.status))
+        ]
+  in
+    if List.isEmpty others then
+      text ""
+    else
+      div [ class "recent-orders" ]
+        [ h3 [] [ text "Your Recent Orders" ]
+        , ul [] (List.map summaryView others)
+        ]
+
+
+statusLabel : OrderStatus.OrderStatus -> String
+statusLabel status =
+  case status of
+    OrderStatus.New _ -> "Received"
+    OrderStatus.Expected _ -> "Being prepared"
+    OrderStatus.Ready -> "Ready"
+    OrderStatus.PickedUp -> "Picked up"
+    OrderStatus.Rejected -> "Rejected"
+    OrderStatus.Cancelled _ -> "Cancelled"
+
+
+cancelView : Model -> Html Msg
+cancelView model =
+  let
+    cancellable =
+      case (model.status, model.cancelUntil) of
+        (OrderStatus.New _, Just cancelUntil) -> model.now < cancelUntil
+        _ -> False
+  in
+    if cancellable || model.cancelError /= Nothing then
+      div [ class "cancel-order" ]
+        [ case model.cancelError of
+            Just msg -> Alert.simpleDanger [] [ text msg ]
+            Nothing -> text ""
+        , if cancellable then
+            div []
+              [ Input.text
+                  [ Input.placeholder "Reason for cancelling (optional)"
+                  , Input.value model.cancelReason
+                  , Input.onInput UpdateCancelReason
+                  ]
+              , p [] [ spinnerButton "Cancel Order" False model.cancelling CancelOrder ]
+              ]
+          else
+            text ""
+        ]
+    else
+      text ""
+
+
+taxView : Model -> Html Msg
+taxView model =
+  if model.exclusiveTax > 0 then
+    p [ class "text-right" ]
+      [ text ("Plus tax " ++ (Menu.priceString model.restaurant.currency model.exclusiveTax) ++ ", total ")
+      , strong [] [ text (Menu.priceString model.restaurant.currency model.total) ]
+      ]
+  else if not (List.isEmpty model.discounts && List.isEmpty model.charges) then
+    p [ class "text-right" ]
+      [ text "Total "
+      , strong [] [ text (Menu.priceString model.restaurant.currency model.total) ]
+      ]
+  else
+    text ""
+
+
+refundsView : Currency -> List Refund -> Html Msg
+refundsView currency refunds =
+  let
+    refundView refund =
+      li [] [ text ((Menu.priceString currency refund.amount) ++ " refunded" ++
+                    (if String.isEmpty refund.reason then "" else " - " ++ refund.reason)) ]
+  in
+    if List.isEmpty refunds then
+      text ""
+    else
+      div []
+        [ h3 [] [ text "Refunds" ]
+        , ul [] (List.map refundView refunds)
+        ]
@@ -22,7 +22,9 @@ import Bootstrap.Button as Button
 
 import Util.Form
 import Util.ErrorDialog as ErrorDialog
+import Util.Csrf as Csrf
 import Models.Menu as Menu
+import Models.Currency as Currency exposing (Currency)
 
 main =
   Loader.programWithFlags
@@ -39,31 +41,35 @@ type alias Model =
   , savedUrl : String
   , json : String
   , error : String
+  , currency : Currency
   , menu : Maybe Menu.Menu
   , order : Menu.Order
   , saving : Bool
   , errorDialog : ErrorDialog.Dialog Msg
+  , csrfToken : Csrf.Token
   }
 
 
 decodeModel : Decoder Model
 decodeModel =
   let
-    toDecoder : String -> String -> String -> String -> Decoder Model
-    toDecoder url cancelUrl savedUrl json =
+    toDecoder : String -> String -> String -> String -> Currency -> Csrf.Token -> Decoder Model
+    toDecoder url cancelUrl savedUrl json currency csrfToken =
       let
         (error, menu) =
           case Menu.decode json of
             Ok menu -> ("", Just menu)
             Err err -> (err, Nothing)
       in
-        succeed (Model url cancelUrl savedUrl json error menu [] False Nothing)
+        succeed (Model url cancelUrl savedUrl json error currency menu [] False Nothing csrfToken)
   in
     decode toDecoder
       |> required "Url" string
       |> required "CancelUrl" string
       |> required "SavedUrl" string
       |> required "Json" string
+      |> required "Currency" Currency.decode
+      |> required "CSRFToken" string
       |> resolve
 
 
@@ -99,7 +105,7 @@ update msg model =
     Save ->
       let
         body = Http.stringBody "application/json" model.json
-        request = Http.post model.url body decodePostResponse
+        request = Csrf.post model.csrfToken model.url body decodePostResponse
       in
         ({ model | saving = True }
         , Http.send SaveResponse request)
@@ -148,7 +154,7 @@ view model =
                   Alert.simpleDanger [] [ text model.error ]]
           ]
       , Grid.col [ Col.md ]
-          [ Html.map MenuMsg (Menu.maybeMenuView model.menu model.order)
+          [ Html.map MenuMsg (Menu.maybeMenuView model.currency model.menu model.order)
           ]
       ]
     ]
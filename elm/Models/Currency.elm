@@ -0,0 +1,65 @@
+module Models.Currency exposing (..)
+
+import Char
+import Json.Decode as Decode exposing (Decoder, string, int)
+import Json.Decode.Pipeline as Pipeline exposing (required)
+
+-- Amounts are integers in the currency's minor unit, as the server stores them
+
+type alias Currency =
+  { code : String
+  , symbol : String
+  , minorUnits : Int
+  }
+
+decode : Decoder Currency
+decode =
+  Pipeline.decode Currency
+    |> required "Code" string
+    |> required "Symbol" string
+    |> required "MinorUnits" int
+
+
+format : Currency -> Int -> String
+format currency amount =
+  let
+    sign = if amount < 0 then "-" else ""
+  in
+    sign ++ currency.symbol ++ (formatPlain currency (abs amount))
+
+
+formatPlain : Currency -> Int -> String
+formatPlain currency amount =
+  let
+    scale = 10 ^ currency.minorUnits
+    major = toString ((abs amount) // scale)
+    minor = String.padLeft currency.minorUnits '0' (toString (rem (abs amount) scale))
+    sign = if amount < 0 then "-" else ""
+  in
+    if currency.minorUnits == 0 then
+      sign ++ major
+    else
+      sign ++ major ++ "." ++ minor
+
+
+-- Parses an amount such as 12.50 into minor units, rejecting more decimal places than the currency has
+parse : Currency -> String -> Maybe Int
+parse currency value =
+  let
+    trimmed = String.trim value
+    digits = String.filter Char.isDigit
+    valid parts = List.all (\part -> part == digits part) parts
+  in
+    case String.split "." trimmed of
+      [ major ] ->
+        if major /= "" && valid [ major ] then
+          Result.toMaybe (String.toInt major) |> Maybe.map (\n -> n * 10 ^ currency.minorUnits)
+        else
+          Nothing
+      [ major, minor ] ->
+        if valid [ major, minor ] && String.length minor <= currency.minorUnits && (major ++ minor) /= "" then
+          Result.toMaybe (String.toInt ((if major == "" then "0" else major) ++ String.padRight currency.minorUnits '0' minor))
+        else
+          Nothing
+      _ ->
+        Nothing
@@ -1,12 +1,14 @@
 module Models.Menu exposing (..)
 
 import Json.Decode as Decode
+import Json.Decode.Pipeline as Pipeline exposing (required, optional)
 import Html exposing (..)
 import Html.Attributes exposing (style, class, src, id, href)
 import Html.Events exposing (onClick)
 import Bootstrap.Button as Button
 import Bootstrap.Table as Table
 import Bootstrap.Utilities.Spacing as Spacing
+import Models.Currency as Currency exposing (Currency)
 
 -- types
 
@@ -22,6 +24,10 @@ type alias MenuItem =
   , name : String
   , desc : String
   , price : Money
+  , dietary : List String
+  , allergens : List String
+  , spiceLevel : Int
+  , image : Maybe String
   }
 
 type alias Order = List OrderItem
@@ -31,6 +37,19 @@ type alias OrderItem =
   , qty : Int
   }
 
+-- Taken off an order by a promotion
+type alias Discount =
+  { name : String
+  , code : String
+  , amount : Money
+  }
+
+-- A tip or surcharge, added to an order on top of the items
+type alias Charge =
+  { name : String
+  , amount : Money
+  }
+
 type alias Invoice = List InvoiceLine
 
 type alias InvoiceLine =
@@ -64,11 +83,15 @@ menuDecoder = Decode.list itemDecoder
 
 
 itemDecoder: Decode.Decoder MenuItem
-itemDecoder = Decode.map4 MenuItem
-                (Decode.field "Id" Decode.int)
-                (Decode.field "Name" Decode.string)
-                (Decode.field "Desc" Decode.string)
-                (Decode.field "Price" Decode.int)
+itemDecoder = Pipeline.decode MenuItem
+                |> required "Id" Decode.int
+                |> required "Name" Decode.string
+                |> required "Desc" Decode.string
+                |> required "Price" Decode.int
+                |> optional "Dietary" (Decode.list Decode.string) []
+                |> optional "Allergens" (Decode.list Decode.string) []
+                |> optional "SpiceLevel" Decode.int 0
+                |> optional "Image" (Decode.map Just (Decode.field "small" Decode.string)) Nothing
 
 
 orderDecoder: Decode.Decoder Order
@@ -81,30 +104,43 @@ orderItemDecoder = Decode.map2 OrderItem
                 (Decode.field "Qty" Decode.int)
 
 
+discountDecoder: Decode.Decoder Discount
+discountDecoder = Pipeline.decode Discount
+                |> required "Name" Decode.string
+                |> optional "Code" Decode.string ""
+                |> required "Amount" Decode.int
+
+
+chargeDecoder: Decode.Decoder Charge
+chargeDecoder = Pipeline.decode Charge
+                |> required "Name" Decode.string
+                |> required "Amount" Decode.int
+
+
 -- views
 
 
-maybeMenuView : Maybe Menu -> Order -> Html Msg
-maybeMenuView menu_ order =
+maybeMenuView : Currency -> Maybe Menu -> Order -> Html Msg
+maybeMenuView currency menu_ order =
   case menu_ of
     Just menu ->
-      menuView menu order
+      menuView currency menu order
     Nothing ->
       text "No menu"
 
 
-menuView : Menu -> Order -> Html Msg
-menuView menu order =
+menuView : Currency -> Menu -> Order -> Html Msg
+menuView currency menu order =
   if menu == [] then
     text "Empty menu"
   else
-    div [] [ div [] (List.map (itemView order) menu) ]
+    div [] [ div [] (List.map (itemView currency order) menu) ]
 
 
-itemView : Order -> MenuItem -> Html Msg
-itemView order item =
+itemView : Currency -> Order -> MenuItem -> Html Msg
+itemView currency order item =
   let
-    heading = String.concat [item.name, " – ", priceString item.price]
+    heading = String.concat [item.name, " – ", priceString currency item.price]
     qty = itemQty item.id order
     qtyHtml =
       if qty > 0 then
@@ -115,7 +151,9 @@ itemView order item =
     div
       []
       [ h3 [] [ text heading ]
+      , imageView item.image
       , p [] [ text item.desc ]
+      , tagsView item
       , p [] [
               qtyHtml
              , Button.button [ Button.primary, Button.onClick (Add { id=item.id, qty=1 })] [ text "+" ]
@@ -123,6 +161,44 @@ itemView order item =
              ]
       ]
 
+imageView : Maybe String -> Html msg
+imageView image =
+  case image of
+    Just url ->
+      img [ class "menu-image", src url ] []
+    Nothing ->
+      text ""
+
+
+tagsView : MenuItem -> Html msg
+tagsView item =
+  let
+    dietary = List.map (tagBadge "badge-success" << dietaryLabel) item.dietary
+    allergens = List.map (tagBadge "badge-warning" << (++) "Contains ") item.allergens
+    spice =
+      if item.spiceLevel > 0 then
+        [ tagBadge "badge-danger" (String.repeat item.spiceLevel "🌶") ]
+      else
+        []
+  in
+    if List.isEmpty (dietary ++ allergens ++ spice) then
+      text ""
+    else
+      p [ class "menu-tags" ] (dietary ++ allergens ++ spice)
+
+
+tagBadge : String -> String -> Html msg
+tagBadge badgeClass label =
+  span [ class ("badge mx-1 " ++ badgeClass) ] [ text label ]
+
+
+dietaryLabel : String -> String
+dietaryLabel tag =
+  case tag of
+    "GlutenFree" -> "Gluten Free"
+    _ -> tag
+
+
 itemQty : Int -> Order -> Int
 itemQty id order =
   case order of
@@ -134,36 +210,27 @@ itemQty id order =
         itemQty id xs
 
 
-priceString : Money -> String
-priceString price =
-  let
-    dollarsStr = toString (price // 100)
-    cents = rem (abs price) 100
-    centsStr =
-      if cents < 10 then
-        "0" ++ (toString cents)
-      else
-        toString cents
-  in
-  "$" ++ dollarsStr ++ "." ++ centsStr
+priceString : Currency -> Money -> String
+priceString =
+  Currency.format
 
 
-orderTotals : Menu -> Order -> (String, String)
-orderTotals menu order =
+orderTotals : Currency -> Menu -> Order -> (String, String)
+orderTotals currency menu order =
   let
     invoice = orderInvoice menu order
     totalItems = List.sum (List.map .qty invoice)
     totalPrice = List.sum (List.map .total invoice)
   in
-    (toString totalItems, priceString totalPrice)
+    (toString totalItems, priceString currency totalPrice)
 
 
-invoiceView : Menu -> Order -> Html msg
-invoiceView menu order =
+invoiceView : Currency -> Menu -> Order -> Html msg
+invoiceView currency menu order =
   let
     invoice = orderInvoice menu order
     total = List.sum (List.map .total invoice)
-    lines = (List.map invoiceLineView invoice) ++ [invoiceTotalLine total]
+    lines = (List.map (invoiceLineView currency) invoice) ++ [invoiceTotalLine currency total]
   in
   Table.simpleTable
     ( Table.simpleThead
@@ -174,22 +241,48 @@ invoiceView menu order =
     , Table.tbody [] lines
     )
 
-invoiceLineView : InvoiceLine -> Table.Row msg
-invoiceLineView line =
+invoiceLineView : Currency -> InvoiceLine -> Table.Row msg
+invoiceLineView currency line =
   Table.tr []
     [ Table.td [] [ text (toString line.qty) ]
     , Table.td [] [ text line.desc ]
-    , Table.td [ tdAlignRight ] [ text (priceString line.total) ]
+    , Table.td [ tdAlignRight ] [ text (priceString currency line.total) ]
     ]
 
-invoiceTotalLine : Money -> Table.Row msg
-invoiceTotalLine total =
+invoiceTotalLine : Currency -> Money -> Table.Row msg
+invoiceTotalLine currency total =
   Table.tr []
     [ Table.td [] []
     , Table.td [] []
-    , Table.td [ tdAlignRight ] [ text (priceString total) ]
+    , Table.td [ tdAlignRight ] [ text (priceString currency total) ]
     ]
 
+discountsView : Currency -> List Discount -> Html msg
+discountsView currency discounts =
+  let
+    discountView discount =
+      li []
+        [ text (discount.name
+                ++ (if String.isEmpty discount.code then "" else " (" ++ discount.code ++ ")")
+                ++ ": -" ++ (priceString currency discount.amount))
+        ]
+  in
+    if List.isEmpty discounts then
+      text ""
+    else
+      ul [ class "list-unstyled text-right" ] (List.map discountView discounts)
+
+chargesView : Currency -> List Charge -> Html msg
+chargesView currency charges =
+  let
+    chargeView charge =
+      li [] [ text (charge.name ++ ": " ++ (priceString currency charge.amount)) ]
+  in
+    if List.isEmpty charges then
+      text ""
+    else
+      ul [ class "list-unstyled text-right" ] (List.map chargeView charges)
+
 orderInvoice : Menu -> Order -> Invoice
 orderInvoice menu order =
   List.map (orderItemInvoiceLine menu) order
@@ -208,7 +301,7 @@ orderItemInvoiceLine menu orderItem =
 menuItemForId : List MenuItem -> Int -> MenuItem
 menuItemForId items id =
   case items of
-    [] -> MenuItem -1 "Error" "Error" -1
+    [] -> MenuItem -1 "Error" "Error" -1 [] [] 0 Nothing
     (x::xs) ->
       if x.id == id then
         x
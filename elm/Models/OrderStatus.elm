@@ -17,6 +17,7 @@ type OrderStatus
   | Expected Time.Time
   | PickedUp
   | Rejected
+  | Cancelled String
 
 statusUpdateDecoder : Decoder StatusUpdate
 statusUpdateDecoder =
@@ -52,6 +53,9 @@ statusDecoder =
             succeed PickedUp
           "Rejected" ->
             succeed Rejected
+          "Cancelled" ->
+            Decode.oneOf [ field "CancelReason" string, succeed "" ]
+              |> Decode.map Cancelled
           _ ->
             fail ("Bad Status: " ++ str)
   in
@@ -67,6 +71,7 @@ comparison a b =
         Expected _ -> LT
         PickedUp -> LT
         Rejected -> LT
+        Cancelled _ -> LT
     Expected aExpected ->
       case b of
         New _ -> GT
@@ -74,6 +79,7 @@ comparison a b =
         Expected bExpected -> compare aExpected bExpected
         PickedUp -> LT
         Rejected -> LT
+        Cancelled _ -> LT
     Ready ->
       case b of
         New _ -> GT
@@ -81,6 +87,7 @@ comparison a b =
         Expected _ -> LT
         PickedUp -> LT
         Rejected -> LT
+        Cancelled _ -> LT
     PickedUp ->
       case b of
         New _ -> GT
@@ -88,6 +95,7 @@ comparison a b =
         Expected _ -> GT
         PickedUp -> EQ
         Rejected -> LT
+        Cancelled _ -> LT
     Rejected ->
       case b of
         New _ -> GT
@@ -95,3 +103,8 @@ comparison a b =
         Expected _ -> GT
         PickedUp -> GT
         Rejected -> EQ
+        Cancelled _ -> LT
+    Cancelled _ ->
+      case b of
+        Cancelled _ -> EQ
+        _ -> GT
@@ -2,6 +2,7 @@ module Models.Restaurant exposing (..)
 
 import Json.Decode as Decode exposing (Decoder, Value, succeed, decodeValue, string, int)
 import Json.Decode.Pipeline as Pipeline exposing (required, optional, hardcoded, resolve)
+import Models.Currency as Currency exposing (Currency)
 
 type alias Restaurant =
   { slug : String
@@ -13,6 +14,7 @@ type alias Restaurant =
   , mapLocation : String
   , mapZoom : String
   , about : String
+  , currency : Currency
   }
 
 decode : Decoder Restaurant
@@ -27,3 +29,4 @@ decode =
       |> required "MapLocation" string
       |> required "MapZoom" string
       |> required "About" string
+      |> required "CurrencyFormat" Currency.decode
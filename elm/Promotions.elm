@@ -0,0 +1,119 @@
+module Promotions exposing (main)
+
+import Util.Loader as Loader
+import Navigation
+import Json.Decode as Decode exposing (Decoder, Value, string, list, int, bool)
+import Json.Decode.Pipeline exposing (decode, required)
+import Html exposing (..)
+import Html.Attributes exposing (href, class)
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table exposing (cellAttr)
+import Bootstrap.Button as Button
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { url : String
+  , promotions : List Promotion
+  }
+
+type alias Promotion =
+  { id : Int
+  , name : String
+  , code : String
+  , kind : String
+  , value : String
+  , startsOn : String
+  , endsOn : String
+  , enabled : Bool
+  , uses : Int
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> required "Url" string
+    |> required "Promotions" (list decodePromotion)
+
+decodePromotion : Decoder Promotion
+decodePromotion =
+  decode Promotion
+    |> required "ID" int
+    |> required "Name" string
+    |> required "Code" string
+    |> required "Kind" string
+    |> required "Value" string
+    |> required "StartsOn" string
+    |> required "EndsOn" string
+    |> required "Enabled" bool
+    |> required "Uses" int
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text "Promotions" ]
+    , p []
+      [ Button.linkButton
+        [ Button.primary, Button.attrs [ href (model.url ++ "/new") ] ]
+        [ text "New" ]
+      ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Name" ]
+            , Table.th [] [ text "Code" ]
+            , Table.th [] [ text "Discount" ]
+            , Table.th [] [ text "Dates" ]
+            , Table.th [] [ text "Status" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Uses" ]
+            ]
+        , Table.tbody [] (List.map (promotionView model.url) model.promotions)
+        )
+    ]
+
+
+promotionView : String -> Promotion -> Table.Row Msg
+promotionView url promotion =
+  let
+    discount =
+      case promotion.kind of
+        "percent" -> promotion.value ++ "% off"
+        "amount" -> promotion.value ++ " off"
+        _ -> "Free item " ++ promotion.value
+    dates =
+      if promotion.startsOn == "" && promotion.endsOn == "" then
+        "Always"
+      else
+        promotion.startsOn ++ " to " ++ promotion.endsOn
+  in
+    Table.tr []
+      [ Table.td [] [ a [ href (url ++ "/" ++ (toString promotion.id)) ] [ text promotion.name ] ]
+      , Table.td [] [ text (if promotion.code == "" then "Automatic" else promotion.code) ]
+      , Table.td [] [ text discount ]
+      , Table.td [] [ text dates ]
+      , Table.td [] [ text (if promotion.enabled then "Enabled" else "Disabled") ]
+      , Table.td [ cellAttr (class "text-right") ] [ text (toString promotion.uses) ]
+      ]
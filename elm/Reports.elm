@@ -0,0 +1,219 @@
+module Reports exposing (main)
+
+import Util.Loader as Loader
+import Navigation
+import Http
+import Json.Decode as Decode exposing (Decoder, Value, string, list, int, float)
+import Json.Decode.Pipeline exposing (decode, required, requiredAt)
+import Html exposing (..)
+import Html.Attributes exposing (href, class, value, selected)
+import Models.Menu as Menu
+import Models.Currency as Currency exposing (Currency)
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table exposing (cellAttr)
+import Bootstrap.Button as Button
+import Bootstrap.Form.Input as Input
+import Bootstrap.Form.Select as Select
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { restaurantName : String
+  , url : String
+  , timeZone : String
+  , currency : Currency
+  , from : String
+  , to : String
+  , period : String
+  , rows : List Row
+  , total : Row
+  , topItems : List TopItem
+  }
+
+type alias Row =
+  { period : String
+  , orders : Int
+  , sales : Menu.Money
+  , tips : Menu.Money
+  , surcharges : Menu.Money
+  , gst : Menu.Money
+  , refunds : Menu.Money
+  , netSales : Menu.Money
+  , averageOrder : Menu.Money
+  , rejected : Int
+  , rejectedRate : Float
+  }
+
+type alias TopItem =
+  { name : String
+  , qty : Int
+  , sales : Menu.Money
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> requiredAt ["Restaurant", "Name"] string
+    |> required "Url" string
+    |> requiredAt ["Report", "TimeZone"] string
+    |> requiredAt ["Report", "Currency"] Currency.decode
+    |> requiredAt ["Report", "Filter", "From"] string
+    |> requiredAt ["Report", "Filter", "To"] string
+    |> requiredAt ["Report", "Filter", "Period"] string
+    |> requiredAt ["Report", "Rows"] (list decodeRow)
+    |> requiredAt ["Report", "Total"] decodeRow
+    |> requiredAt ["Report", "TopItems"] (list decodeTopItem)
+
+decodeRow : Decoder Row
+decodeRow =
+  decode Row
+    |> required "Period" string
+    |> required "Orders" int
+    |> required "Sales" int
+    |> required "Tips" int
+    |> required "Surcharges" int
+    |> required "GST" int
+    |> required "Refunds" int
+    |> required "NetSales" int
+    |> required "AverageOrder" int
+    |> required "Rejected" int
+    |> required "RejectedRate" float
+
+decodeTopItem : Decoder TopItem
+decodeTopItem =
+  decode TopItem
+    |> required "Name" string
+    |> required "Qty" int
+    |> required "Sales" int
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+  | UpdateFrom String
+  | UpdateTo String
+  | UpdatePeriod String
+  | Apply
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+    UpdateFrom from ->
+      ({ model | from = from }, Cmd.none)
+
+    UpdateTo to ->
+      ({ model | to = to }, Cmd.none)
+
+    UpdatePeriod period ->
+      ({ model | period = period }, Cmd.none)
+
+    Apply ->
+      (model, Navigation.load (reportUrl model ""))
+
+
+reportUrl : Model -> String -> String
+reportUrl model format =
+  model.url
+    ++ "?from=" ++ (Http.encodeUri model.from)
+    ++ "&to=" ++ (Http.encodeUri model.to)
+    ++ "&period=" ++ (Http.encodeUri model.period)
+    ++ (if String.isEmpty format then "" else "&format=" ++ format)
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text (model.restaurantName ++ " Sales") ]
+    , filterView model
+    , p [] [ text ("Dates are in " ++ model.timeZone ++ ", amounts in " ++ model.currency.code ++ ". Sales are item revenue after discounts, tips and surcharges are shown separately. Rejected and cancelled orders are excluded.") ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Period" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Orders" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Sales" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Tips" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Surcharges" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "GST" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Refunds" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Net Sales" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Average Order" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Rejected" ]
+            ]
+        , Table.tbody [] (List.map (rowView model.currency) (model.rows ++ [ model.total ]))
+        )
+    , h2 [] [ text "Top Selling Items" ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Item" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Qty" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Sales" ]
+            ]
+        , Table.tbody [] (List.map (topItemView model.currency) model.topItems)
+        )
+    ]
+
+
+filterView : Model -> Html Msg
+filterView model =
+  let
+    periodItem period label =
+      Select.item [ value period, selected (period == model.period) ] [ text label ]
+  in
+    div [ class "form-inline mb-3" ]
+      [ Input.date [ Input.value model.from, Input.onInput UpdateFrom ]
+      , span [ class "mx-2" ] [ text "to" ]
+      , Input.date [ Input.value model.to, Input.onInput UpdateTo ]
+      , Select.select [ Select.onChange UpdatePeriod, Select.attrs [ class "mx-2" ] ]
+          [ periodItem "day" "Daily"
+          , periodItem "week" "Weekly"
+          , periodItem "month" "Monthly"
+          ]
+      , Button.button [ Button.primary, Button.onClick Apply ] [ text "Show" ]
+      , Button.linkButton
+          [ Button.secondary, Button.attrs [ class "mx-2", href (reportUrl model "csv") ] ]
+          [ text "Download CSV" ]
+      ]
+
+
+rowView : Currency -> Row -> Table.Row Msg
+rowView currency row =
+  let
+    rejected = (toString row.rejected) ++ " (" ++ (toString (round (row.rejectedRate * 100))) ++ "%)"
+    money amount = Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString currency amount) ]
+  in
+    Table.tr []
+      [ Table.td [] [ text row.period ]
+      , Table.td [ cellAttr (class "text-right") ] [ text (toString row.orders) ]
+      , money row.sales
+      , money row.tips
+      , money row.surcharges
+      , money row.gst
+      , money row.refunds
+      , money row.netSales
+      , money row.averageOrder
+      , Table.td [ cellAttr (class "text-right") ] [ text rejected ]
+      ]
+
+
+topItemView : Currency -> TopItem -> Table.Row Msg
+topItemView currency item =
+  Table.tr []
+    [ Table.td [] [ text item.name ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (toString item.qty) ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString currency item.sales) ]
+    ]
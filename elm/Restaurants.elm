@@ -1,15 +1,20 @@
 module Restaurants exposing (main)
 
 import Util.Loader as Loader
-import Json.Decode as Decode exposing (Decoder, Value, decodeValue, field, string, list, int)
+import Navigation
+import Http
+import Json.Decode as Decode exposing (Decoder, Value, decodeValue, field, string, list, int, bool, andThen)
+import Json.Decode.Pipeline exposing (decode, required, hardcoded, custom)
 import Html exposing (..)
 import Html.Attributes exposing (href, class, style)
 import Html.Events exposing (onClick)
+import Util.Csrf as Csrf
 
 
 import Bootstrap.Grid as Grid
 import Bootstrap.Table as Table
 import Bootstrap.Button as Button
+import Bootstrap.Alert as Alert
 
 
 main =
@@ -21,35 +26,79 @@ main =
 
 -- MODEL
 
-type alias Model = List Restaurant
+type alias Model =
+  { restaurants : List Restaurant
+  , verifying : Maybe Int
+  , error : Maybe String
+  , csrfToken : Csrf.Token
+  }
 
 type alias Restaurant =
   { id : Int
   , slug : String
   , name : String
   , url : String
+  , domain : String
+  , domainVerified : Bool
+  , domainRecord : String
+  , domainToken : String
   }
 
 decodeModel : Decoder Model
-decodeModel = list decodeRestaurant
+decodeModel =
+  decode Model
+    |> required "Restaurants" (list decodeRestaurant)
+    |> hardcoded Nothing
+    |> hardcoded Nothing
+    |> custom Csrf.decoder
 
 decodeRestaurant : Decoder Restaurant
-decodeRestaurant = Decode.map4 Restaurant
-    (field "ID" int )
-    (field "Slug" string)
-    (field "Name" string)
-    (field "URL" string)
+decodeRestaurant =
+  decode Restaurant
+    |> required "ID" int
+    |> required "Slug" string
+    |> required "Name" string
+    |> required "URL" string
+    |> required "Domain" string
+    |> required "DomainVerified" bool
+    |> required "DomainRecord" string
+    |> required "DomainToken" string
 
 -- UPDATE
 
 type Msg
-  = Dup Restaurant
+  = VerifyDomain Int
+  | VerifyDomainResponse (Result Http.Error (Maybe String))
 
 update : Msg -> Model -> (Model, Cmd Msg)
 update msg model =
   case msg of
-    Dup restaurant ->
-      (model ++ [restaurant], Cmd.none)
+    VerifyDomain id ->
+      let
+        url = "restaurants/" ++ (toString id) ++ "/domain/verify"
+      in
+        ({ model | verifying = Just id, error = Nothing }
+        , Http.send VerifyDomainResponse (Csrf.post model.csrfToken url Http.emptyBody decodeVerifyResponse))
+
+    VerifyDomainResponse (Ok Nothing) ->
+      (model, Navigation.reload)
+
+    VerifyDomainResponse (Ok (Just msg)) ->
+      ({ model | verifying = Nothing, error = Just msg }, Cmd.none)
+
+    VerifyDomainResponse (Err err) ->
+      ({ model | verifying = Nothing, error = Just "Network error, please try again." }, Cmd.none)
+
+
+decodeVerifyResponse : Decoder (Maybe String)
+decodeVerifyResponse =
+  field "Status" string
+    |> andThen (\str ->
+      case str of
+        "OK" -> Decode.succeed Nothing
+        "ERR" -> Decode.map Just (field "Error" string)
+        _ -> Decode.fail ("Bad 'Status': " ++ str)
+    )
 
 -- VIEW
 
@@ -62,6 +111,9 @@ view model =
         [ Button.primary, Button.attrs [ href "restaurants/new" ] ]
         [ text "New" ]
       ]
+    , case model.error of
+        Just msg -> Alert.simpleDanger [] [ text msg ]
+        Nothing -> text ""
     , tableView model
     ]
 
@@ -72,23 +124,58 @@ tableView model =
     ( Table.simpleThead
         [ Table.th [] [ text "Slug" ]
         , Table.th [] [ text "Name" ]
+        , Table.th [] [ text "Domain" ]
         , Table.th [] [ ]
         ]
     , Table.tbody []
-      (List.map rowView model)
+      (List.map (rowView model.verifying) model.restaurants)
     )
 
-rowView : Restaurant -> Table.Row Msg
-rowView restaurant =
+rowView : Maybe Int -> Restaurant -> Table.Row Msg
+rowView verifying restaurant =
   let
     detailsLink =  "restaurants/" ++ (toString restaurant.id)
     menuLink = detailsLink ++ "/menu"
+    notificationsLink = detailsLink ++ "/notifications"
+    webhooksLink = detailsLink ++ "/webhooks"
+    reportsLink = detailsLink ++ "/reports"
+    taxLink = detailsLink ++ "/tax"
+    promotionsLink = detailsLink ++ "/promotions"
+    surchargesLink = detailsLink ++ "/surcharges"
   in
     Table.tr []
       [ Table.td [] [ text restaurant.slug ]
       , Table.td [] [ a [ href restaurant.url ] [ text restaurant.name ]]
+      , Table.td [] [ domainView verifying restaurant ]
       , Table.td []
         [ a [ href detailsLink ] [ text "Details" ]
         , a [ href menuLink, style [("margin-left", "1em")] ] [ text "Menu" ]
+        , a [ href notificationsLink, style [("margin-left", "1em")] ] [ text "Notifications" ]
+        , a [ href webhooksLink, style [("margin-left", "1em")] ] [ text "Webhooks" ]
+        , a [ href taxLink, style [("margin-left", "1em")] ] [ text "Tax" ]
+        , a [ href promotionsLink, style [("margin-left", "1em")] ] [ text "Promotions" ]
+        , a [ href surchargesLink, style [("margin-left", "1em")] ] [ text "Surcharges" ]
+        , a [ href reportsLink, style [("margin-left", "1em")] ] [ text "Reports" ]
         ]
       ]
+
+
+domainView : Maybe Int -> Restaurant -> Html Msg
+domainView verifying restaurant =
+  if restaurant.domain == "" then
+    text ""
+  else if restaurant.domainVerified then
+    text restaurant.domain
+  else
+    div []
+      [ text restaurant.domain
+      , small [ class "d-block text-muted" ]
+          [ text ("Add a TXT record for " ++ restaurant.domainRecord ++ " containing " ++ restaurant.domainToken) ]
+      , Button.button
+          [ Button.small
+          , Button.primary
+          , Button.disabled (verifying == Just restaurant.id)
+          , Button.onClick (VerifyDomain restaurant.id)
+          ]
+          [ text "Verify" ]
+      ]
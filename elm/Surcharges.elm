@@ -0,0 +1,108 @@
+module Surcharges exposing (main)
+
+import Util.Loader as Loader
+import Navigation
+import Json.Decode as Decode exposing (Decoder, Value, string, list, int)
+import Json.Decode.Pipeline exposing (decode, required)
+import Html exposing (..)
+import Html.Attributes exposing (href, class)
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table
+import Bootstrap.Button as Button
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { url : String
+  , surcharges : List Surcharge
+  }
+
+type alias Surcharge =
+  { id : Int
+  , name : String
+  , kind : String
+  , value : String
+  , dates : String
+  , cardOnly : String
+  , enabled : String
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> required "Url" string
+    |> required "Surcharges" (list decodeSurcharge)
+
+decodeSurcharge : Decoder Surcharge
+decodeSurcharge =
+  decode Surcharge
+    |> required "ID" int
+    |> required "Name" string
+    |> required "Kind" string
+    |> required "Value" string
+    |> required "Dates" string
+    |> required "CardOnly" string
+    |> required "Enabled" string
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text "Surcharges" ]
+    , p []
+      [ Button.linkButton
+        [ Button.primary, Button.attrs [ href (model.url ++ "/new") ] ]
+        [ text "New" ]
+      ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Name" ]
+            , Table.th [] [ text "Charge" ]
+            , Table.th [] [ text "Dates" ]
+            , Table.th [] [ text "Applies To" ]
+            , Table.th [] [ text "Status" ]
+            ]
+        , Table.tbody [] (List.map (surchargeView model.url) model.surcharges)
+        )
+    ]
+
+
+surchargeView : String -> Surcharge -> Table.Row Msg
+surchargeView url surcharge =
+  let
+    charge =
+      if surcharge.kind == "percent" then
+        surcharge.value ++ "%"
+      else
+        surcharge.value
+  in
+    Table.tr []
+      [ Table.td [] [ a [ href (url ++ "/" ++ (toString surcharge.id)) ] [ text surcharge.name ] ]
+      , Table.td [] [ text charge ]
+      , Table.td [] [ text (if surcharge.dates == "" then "Every day" else surcharge.dates) ]
+      , Table.td [] [ text (if surcharge.cardOnly == "yes" then "Card payments" else "All orders") ]
+      , Table.td [] [ text (if surcharge.enabled == "yes" then "Enabled" else "Disabled") ]
+      ]
@@ -0,0 +1,10 @@
+port module Util.Challenge exposing (..)
+
+import Json.Decode exposing (Value)
+
+-- The challenge is passed through from the server untouched, the page's
+-- script works out the answer and sends back the Token and Answer to post
+-- with the order.
+
+port solveChallenge : Value -> Cmd msg
+port challengeSolved : (Value -> msg) -> Sub msg
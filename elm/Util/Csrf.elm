@@ -0,0 +1,32 @@
+module Util.Csrf exposing (Token, decoder, header, post)
+
+import Http
+import Json.Decode as Decode exposing (Decoder)
+
+-- The server puts the session's token in every page's flags, requests that
+-- change anything must send it back in the X-CSRF-Token header.
+
+type alias Token = String
+
+
+decoder : Decoder Token
+decoder =
+  Decode.field "CSRFToken" Decode.string
+
+
+header : Token -> Http.Header
+header token =
+  Http.header "X-CSRF-Token" token
+
+
+post : Token -> String -> Http.Body -> Decoder a -> Http.Request a
+post token url body decoder =
+  Http.request
+    { method = "POST"
+    , headers = [ header token ]
+    , url = url
+    , body = body
+    , expect = Http.expectJson decoder
+    , timeout = Nothing
+    , withCredentials = False
+    }
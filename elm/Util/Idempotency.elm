@@ -0,0 +1,28 @@
+module Util.Idempotency exposing (keyGenerator, post)
+
+import Http
+import Json.Decode exposing (Decoder)
+import Random
+import Util.Csrf as Csrf
+
+-- A new key is made for each request the user asks for, retries after a
+-- network error reuse it so the server replays the first response rather
+-- than doing the work twice.
+
+keyGenerator : Random.Generator String
+keyGenerator =
+  Random.list 4 (Random.int 0 Random.maxInt)
+    |> Random.map (List.map toString >> String.join "-")
+
+
+post : Csrf.Token -> String -> String -> Http.Body -> Decoder a -> Http.Request a
+post csrfToken key url body decoder =
+  Http.request
+    { method = "POST"
+    , headers = [ Csrf.header csrfToken, Http.header "Idempotency-Key" key ]
+    , url = url
+    , body = body
+    , expect = Http.expectJson decoder
+    , timeout = Nothing
+    , withCredentials = False
+    }
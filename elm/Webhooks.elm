@@ -0,0 +1,173 @@
+module Webhooks exposing (main)
+
+import Util.Loader as Loader
+import Navigation
+import Http
+import Json.Decode as Decode exposing (Decoder, Value, string, list, int, nullable)
+import Json.Decode.Pipeline exposing (decode, required, hardcoded, custom)
+import Html exposing (..)
+import Html.Attributes exposing (href, class)
+import Util.Csrf as Csrf
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table
+import Bootstrap.Button as Button
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { url : String
+  , subscriptions : List Subscription
+  , deliveries : List Delivery
+  , redelivering : List Int
+  , csrfToken : Csrf.Token
+  }
+
+type alias Subscription =
+  { id : Int
+  , url : String
+  , events : String
+  }
+
+type alias Delivery =
+  { id : Int
+  , url : String
+  , event : String
+  , attempts : Int
+  , lastStatus : Int
+  , lastError : String
+  , deliveredAt : Maybe String
+  , createdAt : String
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> required "Url" string
+    |> required "Subscriptions" (list decodeSubscription)
+    |> required "Deliveries" (list decodeDelivery)
+    |> hardcoded []
+    |> custom Csrf.decoder
+
+decodeSubscription : Decoder Subscription
+decodeSubscription =
+  decode Subscription
+    |> required "ID" int
+    |> required "URL" string
+    |> required "Events" string
+
+decodeDelivery : Decoder Delivery
+decodeDelivery =
+  decode Delivery
+    |> required "ID" int
+    |> required "URL" string
+    |> required "Event" string
+    |> required "Attempts" int
+    |> required "LastStatus" int
+    |> required "LastError" string
+    |> required "DeliveredAt" (nullable string)
+    |> required "CreatedAt" string
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+  | Redeliver Int
+  | RedeliverResponse (Result Http.Error String)
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+    Redeliver id ->
+      let
+        url = model.url ++ "/deliveries/" ++ (toString id) ++ "/redeliver"
+      in
+        ({ model | redelivering = id :: model.redelivering }
+        , Http.send RedeliverResponse (Csrf.post model.csrfToken url Http.emptyBody string))
+
+    RedeliverResponse _ ->
+      -- show the new delivery in the log
+      (model, Navigation.reload)
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text "Webhooks" ]
+    , p []
+      [ Button.linkButton
+        [ Button.primary, Button.attrs [ href (model.url ++ "/new") ] ]
+        [ text "New" ]
+      ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "URL" ]
+            , Table.th [] [ text "Events" ]
+            ]
+        , Table.tbody [] (List.map (subscriptionView model.url) model.subscriptions)
+        )
+    , h2 [] [ text "Recent Deliveries" ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Created" ]
+            , Table.th [] [ text "URL" ]
+            , Table.th [] [ text "Event" ]
+            , Table.th [] [ text "Attempts" ]
+            , Table.th [] [ text "Result" ]
+            , Table.th [] []
+            ]
+        , Table.tbody [] (List.map (deliveryView model.redelivering) model.deliveries)
+        )
+    ]
+
+
+subscriptionView : String -> Subscription -> Table.Row Msg
+subscriptionView url subscription =
+  Table.tr []
+    [ Table.td [] [ a [ href (url ++ "/" ++ (toString subscription.id)) ] [ text subscription.url ] ]
+    , Table.td [] [ text (if subscription.events == "" then "Disabled" else subscription.events) ]
+    ]
+
+
+deliveryView : List Int -> Delivery -> Table.Row Msg
+deliveryView redelivering delivery =
+  let
+    result =
+      case delivery.deliveredAt of
+        Just _ -> "Delivered (" ++ (toString delivery.lastStatus) ++ ")"
+        Nothing ->
+          if delivery.attempts == 0 then
+            "Pending"
+          else
+            delivery.lastError
+  in
+    Table.tr []
+      [ Table.td [] [ text delivery.createdAt ]
+      , Table.td [] [ text delivery.url ]
+      , Table.td [] [ text delivery.event ]
+      , Table.td [] [ text (toString delivery.attempts) ]
+      , Table.td [] [ text result ]
+      , Table.td []
+          [ Button.button
+              [ Button.small
+              , Button.primary
+              , Button.disabled (List.member delivery.id redelivering)
+              , Button.onClick (Redeliver delivery.id)
+              ]
+              [ text "Redeliver" ]
+          ]
+      ]
@@ -0,0 +1,216 @@
+module ZReports exposing (main)
+
+import Util.Loader as Loader
+import Navigation
+import Json.Decode as Decode exposing (Decoder, Value, string, list, int, nullable, dict)
+import Json.Decode.Pipeline exposing (decode, required, requiredAt)
+import Html exposing (..)
+import Html.Attributes exposing (href, class)
+import Dict exposing (Dict)
+import Models.Menu as Menu
+import Models.Currency as Currency exposing (Currency)
+
+import Bootstrap.Grid as Grid
+import Bootstrap.Table as Table exposing (cellAttr)
+
+
+main =
+  Loader.programWithFlags2
+    NewLocation
+    { init = \flags location -> (Decode.decodeValue decodeModel flags, Cmd.none)
+    , view = view
+    , update = update
+    , subscriptions = always Sub.none
+    }
+
+-- MODEL
+
+type alias Model =
+  { restaurantName : String
+  , timeZone : String
+  , reports : List Summary
+  , report : Maybe Report
+  }
+
+type alias Summary =
+  { id : Int
+  , number : Int
+  , from : Maybe String
+  , to : String
+  , orders : Int
+  , sales : Menu.Money
+  , gst : Menu.Money
+  , currency : Currency
+  }
+
+type alias Report =
+  { number : Int
+  , from : Maybe String
+  , to : String
+  , currency : Currency
+  , orders : Int
+  , sales : Menu.Money
+  , tips : Menu.Money
+  , surcharges : Menu.Money
+  , gst : Menu.Money
+  , refunds : Menu.Money
+  , statuses : Dict String Int
+  , lines : List Line
+  }
+
+type alias Line =
+  { displayNumber : Int
+  , name : String
+  , total : Menu.Money
+  , gst : Menu.Money
+  , refunded : Menu.Money
+  , status : String
+  , paymentStatus : String
+  , createdAt : String
+  }
+
+decodeModel : Decoder Model
+decodeModel =
+  decode Model
+    |> requiredAt ["Restaurant", "Name"] string
+    |> required "TimeZone" string
+    |> required "Reports" (list decodeSummary)
+    |> required "Report" (nullable decodeReport)
+
+decodeSummary : Decoder Summary
+decodeSummary =
+  decode Summary
+    |> required "ID" int
+    |> required "Number" int
+    |> required "From" (nullable string)
+    |> required "To" string
+    |> required "Orders" int
+    |> required "Sales" int
+    |> required "GST" int
+    |> required "Currency" Currency.decode
+
+decodeReport : Decoder Report
+decodeReport =
+  decode Report
+    |> required "Number" int
+    |> required "From" (nullable string)
+    |> required "To" string
+    |> requiredAt ["Data", "Currency"] Currency.decode
+    |> requiredAt ["Data", "Orders"] int
+    |> requiredAt ["Data", "Sales"] int
+    |> requiredAt ["Data", "Tips"] int
+    |> requiredAt ["Data", "Surcharges"] int
+    |> requiredAt ["Data", "GST"] int
+    |> requiredAt ["Data", "Refunds"] int
+    |> requiredAt ["Data", "Statuses"] (dict int)
+    |> requiredAt ["Data", "Lines"] (list decodeLine)
+
+decodeLine : Decoder Line
+decodeLine =
+  decode Line
+    |> required "DisplayNumber" int
+    |> required "Name" string
+    |> required "Total" int
+    |> required "GST" int
+    |> required "Refunded" int
+    |> required "Status" string
+    |> required "PaymentStatus" string
+    |> required "CreatedAt" string
+
+-- UPDATE
+
+type Msg
+  = NewLocation Navigation.Location
+
+update : Msg -> Model -> (Model, Cmd Msg)
+update msg model =
+  case msg of
+    NewLocation location ->
+      (model, Cmd.none)
+
+-- VIEW
+
+view : Model -> Html Msg
+view model =
+  Grid.container []
+    [ h1 [] [ text (model.restaurantName ++ " Z Reports") ]
+    , p [] [ text ("Times are in " ++ model.timeZone ++ ".") ]
+    , case model.report of
+        Just report -> reportView report
+        Nothing -> text ""
+    , h2 [] [ text "All Z Reports" ]
+    , Table.simpleTable
+        ( Table.simpleThead
+            [ Table.th [] [ text "Z" ]
+            , Table.th [] [ text "Closed" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Orders" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "Sales" ]
+            , Table.th [ cellAttr (class "text-right") ] [ text "GST" ]
+            ]
+        , Table.tbody [] (List.map summaryView model.reports)
+        )
+    ]
+
+
+summaryView : Summary -> Table.Row Msg
+summaryView summary =
+  Table.tr []
+    [ Table.td [] [ a [ href ("/reports/z/" ++ (toString summary.id)) ] [ text (toString summary.number) ] ]
+    , Table.td [] [ text summary.to ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (toString summary.orders) ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString summary.currency summary.sales) ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString summary.currency summary.gst) ]
+    ]
+
+
+reportView : Report -> Html Msg
+reportView report =
+  let
+    statusView (status, count) =
+      li [] [ text (status ++ ": " ++ (toString count)) ]
+  in
+    div []
+      [ h2 [] [ text ("Z Report " ++ (toString report.number)) ]
+      , p [] [ text ((Maybe.withDefault "First order" report.from) ++ " to " ++ report.to) ]
+      , p []
+          [ text ("Orders: " ++ (toString report.orders))
+          , br [] []
+          , text ("Sales: " ++ (Menu.priceString report.currency report.sales))
+          , br [] []
+          , text ("Tips: " ++ (Menu.priceString report.currency report.tips))
+          , br [] []
+          , text ("Surcharges: " ++ (Menu.priceString report.currency report.surcharges))
+          , br [] []
+          , text ("GST: " ++ (Menu.priceString report.currency report.gst))
+          , br [] []
+          , text ("Refunds: " ++ (Menu.priceString report.currency report.refunds))
+          ]
+      , ul [] (List.map statusView (Dict.toList report.statuses))
+      , Table.simpleTable
+          ( Table.simpleThead
+              [ Table.th [] [ text "#" ]
+              , Table.th [] [ text "Name" ]
+              , Table.th [] [ text "Placed" ]
+              , Table.th [] [ text "Status" ]
+              , Table.th [] [ text "Payment" ]
+              , Table.th [ cellAttr (class "text-right") ] [ text "Total" ]
+              , Table.th [ cellAttr (class "text-right") ] [ text "GST" ]
+              , Table.th [ cellAttr (class "text-right") ] [ text "Refunded" ]
+              ]
+          , Table.tbody [] (List.map (lineView report.currency) report.lines)
+          )
+      ]
+
+
+lineView : Currency -> Line -> Table.Row Msg
+lineView currency line =
+  Table.tr []
+    [ Table.td [] [ text (toString line.displayNumber) ]
+    , Table.td [] [ text line.name ]
+    , Table.td [] [ text line.createdAt ]
+    , Table.td [] [ text line.status ]
+    , Table.td [] [ text line.paymentStatus ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString currency line.total) ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString currency line.gst) ]
+    , Table.td [ cellAttr (class "text-right") ] [ text (Menu.priceString currency line.refunded) ]
+    ]
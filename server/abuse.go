@@ -0,0 +1,217 @@
+package main
+
+// Bogus orders waste the kitchen's time, so orders are limited per session,
+// IP address and phone number, can require a challenge to show they came
+// from a browser, and are refused from numbers the restaurant has blocked.
+// Orders that get through but look unusual are flagged on the till.
+
+import (
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+  "feedme/server/challenge"
+  "feedme/server/templates"
+  "github.com/jinzhu/gorm"
+)
+
+// A phone number the restaurant won't take online orders from
+type BlockedNumber struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+
+  // Normalised with normaliseLogin
+  Telephone string `gorm:"not null"`
+
+  Reason string
+  CreatedAt time.Time
+}
+
+// What the browser sends back for the challenge it was given
+type ChallengeResponse struct {
+  Token string
+  Answer string
+}
+
+// Reasons an order looks suspicious, shown on the till
+type SuspicionFlags []string
+
+const challengeMaxAge = 2 * time.Hour
+
+const blockedMessage = "Sorry, we are unable to take your order online, please telephone the shop."
+const orderLimitMessage = "You have placed a lot of orders recently, please telephone the shop or try again later."
+const challengeMessage = "We couldn't check that this order came from your browser, please try again."
+
+func initChallenge() {
+  switch Config.ChallengeProvider {
+  case "":
+  case challenge.ProofOfWork:
+    challenge.Init(challenge.NewProofOfWork(Config.ChallengeSecret, Config.ChallengeDifficulty, challengeMaxAge))
+  case challenge.Captcha:
+    challenge.Init(challenge.NewCaptcha(Config.CaptchaSiteKey, Config.ChallengeSecret, Config.CaptchaScriptURL, Config.CaptchaVerifyURL))
+  default:
+    panic("Unknown challenge provider: " + Config.ChallengeProvider)
+  }
+}
+
+// A fresh challenge for the page flags, nil when challenges are off
+func issueChallenge() *challenge.Challenge {
+  if !challenge.Enabled() {
+    return nil
+  }
+
+  c, err := challenge.Get().Issue()
+  checkError(err)
+  return c
+}
+
+func verifyChallenge(req *http.Request, response ChallengeResponse) bool {
+  if !challenge.Enabled() {
+    return true
+  }
+
+  err := challenge.Get().Verify(response.Token, response.Answer, clientIP(req))
+  if err != nil {
+    log.Printf("Challenge failed from %s: %s", clientIP(req), err)
+    return false
+  }
+  return true
+}
+
+func isBlockedNumber(tx *gorm.DB, restaurantID uint, telephone string) bool {
+  var count int
+  checkError(tx.Model(&BlockedNumber{}).
+    Where("restaurant_id=? AND telephone=?", restaurantID, telephone).
+    Count(&count).Error)
+  return count > 0
+}
+
+// Counts orders across all restaurants, someone placing bogus orders is unlikely to stop at one
+func recentOrderCount(tx *gorm.DB, column string, value string, since time.Time) int {
+  var count int
+  checkError(tx.Table("orders").
+    Where(column + "=? AND created_at>?", value, since).
+    Count(&count).Error)
+  return count
+}
+
+// Returns a message for the customer when they have hit one of the limits
+func orderLimitError(tx *gorm.DB, order *OrderWithSessionID) string {
+  since := time.Now().Add(-time.Duration(Config.OrderLimitWindowMinutes) * time.Minute)
+
+  limits := []struct {
+    Column string
+    Value string
+    Max int
+  }{
+    {"session_id", order.SessionID, Config.MaxOrdersPerSession},
+    {"client_ip", order.ClientIP, Config.MaxOrdersPerIP},
+    {"normalised_telephone", order.NormalisedTelephone, Config.MaxOrdersPerPhone},
+  }
+
+  for _, limit := range limits {
+    if limit.Value != "" && recentOrderCount(tx, limit.Column, limit.Value, since) >= limit.Max {
+      log.Printf("Order limit reached for %s %s", limit.Column, limit.Value)
+      return orderLimitMessage
+    }
+  }
+
+  return ""
+}
+
+// Looks for things that make an order worth a call before cooking it
+func suspicionFlags(tx *gorm.DB, restaurant *Restaurant, order *OrderWithSessionID) SuspicionFlags {
+  flags := SuspicionFlags{}
+
+  if !validLogin(order.NormalisedTelephone) {
+    flags = append(flags, "Telephone number looks invalid")
+  }
+
+  var previous, rejected int
+  checkError(tx.Table("orders").
+    Where("restaurant_id=? AND normalised_telephone=? AND payment_status<>?", restaurant.ID, order.NormalisedTelephone, PaymentPending).
+    Count(&previous).Error)
+  checkError(tx.Table("orders").
+    Where("restaurant_id=? AND normalised_telephone=? AND status='Rejected'", restaurant.ID, order.NormalisedTelephone).
+    Count(&rejected).Error)
+
+  if previous == 0 {
+    flags = append(flags, "First order from this number")
+  }
+  if rejected > 0 {
+    flags = append(flags, fmt.Sprintf("%d rejected orders from this number", rejected))
+  }
+
+  // Several numbers from one address suggests someone making them up
+  since := time.Now().Add(-time.Duration(Config.OrderLimitWindowMinutes) * time.Minute)
+  var numbers int
+  checkError(tx.Table("orders").
+    Where("client_ip=? AND normalised_telephone<>? AND created_at>?", order.ClientIP, order.NormalisedTelephone, since).
+    Select("COUNT(DISTINCT normalised_telephone)").
+    Row().Scan(&numbers))
+  if order.ClientIP != "" && numbers > 0 {
+    flags = append(flags, "Other numbers recently ordered from the same address")
+  }
+
+  items := 0
+  for _, item := range order.Items {
+    items += item.Qty
+  }
+  if items > Config.LargeOrderItems {
+    flags = append(flags, fmt.Sprintf("Large order of %d items", items))
+  }
+
+  return flags
+}
+
+func (f *SuspicionFlags) Scan(src interface{}) error {
+  switch src.(type) {
+  case string:
+    return json.Unmarshal([]byte(src.(string)), f)
+  case []byte:
+    return json.Unmarshal(src.([]byte), f)
+  default:
+    return errors.New("Incompatible type for SuspicionFlags")
+  }
+}
+
+func (f SuspicionFlags) Value() (driver.Value, error) {
+  data, err := json.Marshal(f)
+  return string(data), err
+}
+
+
+// Blocks the number an order came from, so the restaurant can deal with
+// bogus orders without having to copy phone numbers around
+func postBlockNumber(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  block := struct {
+    Number int
+    Blocked bool
+  }{}
+  checkError(json.NewDecoder(req.Body).Decode(&block))
+
+  var order OrderWithSessionID
+  checkError(tx.Table("orders").Where("restaurant_id=? AND number=?", restaurant.ID, block.Number).First(&order).Error)
+
+  if order.NormalisedTelephone == "" {
+    panic(templates.BadRequest("The order has no telephone number"))
+  }
+
+  if block.Blocked {
+    if !isBlockedNumber(tx, restaurant.ID, order.NormalisedTelephone) {
+      checkError(tx.Create(&BlockedNumber{
+        RestaurantID: restaurant.ID,
+        Telephone: order.NormalisedTelephone,
+        Reason: fmt.Sprintf("Order #%d", order.DisplayNumber),
+      }).Error)
+    }
+  } else {
+    checkError(tx.Where("restaurant_id=? AND telephone=?", restaurant.ID, order.NormalisedTelephone).Delete(BlockedNumber{}).Error)
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  fmt.Fprintln(w, "\"OK\"")
+}
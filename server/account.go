@@ -0,0 +1,97 @@
+package main
+
+import (
+  "net/http"
+  "encoding/json"
+  "feedme/server/templates"
+  "feedme/server/notify"
+  "github.com/jinzhu/gorm"
+)
+
+type AccountResult struct {
+  Status string
+  Error string
+}
+
+func getAccount(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  customer := fetchSessionCustomer(tx, session)
+  orders := []CustomerOrder{}
+
+  if customer != nil {
+    orders = fetchCustomerOrders(tx, customer.ID, port(req))
+  }
+
+  flags := struct {
+    Customer *Customer
+    Orders []CustomerOrder
+  }{
+    customer,
+    orders,
+  }
+
+  templates.ElmApp(w, req, "Account", flags)
+}
+
+func postLoginStart(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  var start struct {
+    Login string
+  }
+  checkError(json.NewDecoder(req.Body).Decode(&start))
+
+  login := normaliseLogin(start.Login)
+  if !validLogin(login) {
+    json.NewEncoder(w).Encode(AccountResult{Status: "ERR", Error: "Please enter an email address or mobile phone number."})
+    return
+  }
+
+  if msg := codeLimitError(tx, CodeLogin, login, session.ID, clientIP(req)); msg != "" {
+    json.NewEncoder(w).Encode(AccountResult{Status: "ERR", Error: msg})
+    return
+  }
+
+  code := createLoginCode(tx, CodeLogin, login, session.ID, clientIP(req))
+
+  err := notify.Send(notify.Message{
+    To: login,
+    Subject: "Your Feedme login code",
+    Body: "Your Feedme login code is " + code,
+  })
+  if err != nil {
+    json.NewEncoder(w).Encode(AccountResult{Status: "ERR", Error: "Sorry, we could not send you a code, please try again."})
+    return
+  }
+
+  json.NewEncoder(w).Encode(AccountResult{Status: "OK"})
+}
+
+func postLoginVerify(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  var verify struct {
+    Login string
+    Code string
+  }
+  checkError(json.NewDecoder(req.Body).Decode(&verify))
+
+  login := normaliseLogin(verify.Login)
+  if msg := verifyLoginCode(tx, CodeLogin, login, verify.Code); msg != "" {
+    json.NewEncoder(w).Encode(AccountResult{Status: "ERR", Error: msg})
+    return
+  }
+
+  loginSession(w, tx, session, findOrCreateCustomer(tx, login))
+
+  json.NewEncoder(w).Encode(AccountResult{Status: "OK"})
+}
+
+func postLogout(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  logoutSession(w, tx, session)
+  json.NewEncoder(w).Encode(AccountResult{Status: "OK"})
+}
+
+// Logs the customer out on every other device too
+func postLogoutAll(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  if session.CustomerID != nil {
+    revokeCustomerSessions(tx, *session.CustomerID, session)
+    logoutSession(w, tx, session)
+  }
+  json.NewEncoder(w).Encode(AccountResult{Status: "OK"})
+}
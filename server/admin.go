@@ -5,26 +5,52 @@ import (
   "feedme/server/templates"
   "github.com/jinzhu/gorm"
   ef "feedme/server/editform"
+  "feedme/server/images"
   "encoding/json"
   "fmt"
   "io/ioutil"
+  "strings"
+  "time"
+  "feedme/server/currency"
 )
 
 
-func getRestaurants(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string) {
+func getRestaurants(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
   var summaries []struct {
     ID int
     Slug string
     Name string
     URL string
+
+    // The TXT record to add, until the domain is verified
+    Domain string
+    DomainVerified bool
+    DomainRecord string
+    DomainToken string
   }
-  checkError(tx.Table("restaurants").Find(&summaries).Error)
+  checkError(tx.Table("restaurants").
+    Select("restaurants.id, restaurants.slug, restaurants.name, restaurant_domains.domain, restaurant_domains.verified_at IS NOT NULL AS domain_verified, restaurant_domains.token AS domain_token").
+    Joins("LEFT JOIN restaurant_domains ON restaurant_domains.restaurant_id = restaurants.id").
+    Order("restaurants.id").
+    Scan(&summaries).Error)
 
   for i := range summaries {
-    summaries[i].URL = "http://" + summaries[i].Slug + "." + Config.DomainName + port(req) + "/"
+    summaries[i].URL = restaurantURL(summaries[i].Slug, port(req))
+    if summaries[i].Domain != "" {
+      summaries[i].DomainRecord = domainVerificationName(summaries[i].Domain)
+    }
+    if summaries[i].DomainVerified {
+      summaries[i].DomainToken = ""
+    }
   }
 
-  templates.ElmApp(w, req, "Restaurants", summaries)
+  flags := struct {
+    Restaurants interface{}
+  }{
+    summaries,
+  }
+
+  templates.ElmApp(w, req, "Restaurants", flags)
 }
 
 
@@ -35,7 +61,7 @@ func NewEditRestaurantForm() ef.Form {
 }
 
 func (f *EditRestaurantForm) New() interface{} {
-  return new(Restaurant)
+  return &Restaurant{TimeZone: "Pacific/Auckland", OrderNumberReset: "never", Currency: currency.Default, VerifyPhone: "no"}
 }
 
 func (f *EditRestaurantForm) Layout(fi *ef.Instance) ef.Layout {
@@ -45,7 +71,8 @@ func (f *EditRestaurantForm) Layout(fi *ef.Instance) ef.Layout {
       "/admin/restaurants",
       ef.Group("",
         ef.Text("Slug", "Slug"),
-        ef.Text("Name", "Name")),
+        ef.Text("Name", "Name"),
+        ef.Text("CustomDomain", "Custom Domain")),
       ef.Group("",
         ef.Text("Address1", "Address"),
         ef.Text("Address2", ""),
@@ -56,12 +83,22 @@ func (f *EditRestaurantForm) Layout(fi *ef.Instance) ef.Layout {
         ef.Text("MapLocation", "Map Location"),
         ef.Text("MapZoom", "Map Zoom")),
       ef.Group("",
-        ef.TextArea("About", "About")))
+        ef.TextArea("About", "About")),
+      ef.Group("",
+        ef.Text("TimeZone", "Time Zone"),
+        ef.Text("OrderNumberReset", "Reset Order Numbers"),
+        ef.Text("Currency", "Currency"),
+        ef.Text("TipOptions", "Tip Percentages"),
+        ef.Text("VerifyPhone", "Verify Phone Numbers")),
+      ef.Group("",
+        ef.Text("PrinterAddress", "Kitchen Printer"),
+        ef.Text("RefundPIN", "Till Refund PIN")))
 }
 
 func (f *EditRestaurantForm) Validate(fi *ef.Instance) {
-  fi.Validate("Slug", "Slug", ef.Trim, ef.Required)
+  fi.Validate("Slug", "Slug", ef.Trim, ef.Lowercase, ef.Required, ef.DNSLabel, validSlug, fi.Unique("restaurants", "slug"))
   fi.Validate("Name", "Name", ef.Trim, ef.Required)
+  fi.Validate("CustomDomain", "Custom Domain", ef.Trim, validCustomDomain, fi.Unique("restaurants", "custom_domain"))
   fi.Validate("Address1", "Address", ef.Trim, ef.Required)
   fi.Validate("Address2", "Address", ef.Trim)
   fi.Validate("Town", "Town/City", ef.Trim, ef.Required)
@@ -69,9 +106,89 @@ func (f *EditRestaurantForm) Validate(fi *ef.Instance) {
   fi.Validate("MapLocation", "Map Location", ef.Trim)
   fi.Validate("MapZoom", "Map Zoom", ef.Trim)
   fi.Validate("About", "About", ef.Trim)
+  fi.Validate("TimeZone", "Time Zone", ef.Trim, ef.Required, validTimeZone)
+  fi.Validate("OrderNumberReset", "Reset Order Numbers", ef.Trim, validOrderNumberReset)
+  fi.Validate("Currency", "Currency", ef.Trim, ef.Required, validCurrency, currencyFixedOnceOrdered(fi))
+  fi.Validate("TipOptions", "Tip Percentages", ef.Trim, validTipOptions)
+  fi.Validate("VerifyPhone", "Verify Phone Numbers", ef.Trim, validYesNo)
+  fi.Validate("PrinterAddress", "Kitchen Printer", ef.Trim)
+  fi.Validate("RefundPIN", "Till Refund PIN", ef.Trim)
+}
+
+// Subdomains used for other things, or that would look like they were ours rather than a restaurant's
+var reservedSlugs = map[string]bool{
+  "www": true,
+  "admin": true,
+  "api": true,
+  "app": true,
+  "account": true,
+  "assets": true,
+  "uploads": true,
+  "static": true,
+  "mail": true,
+  "smtp": true,
+  "ftp": true,
+  "status": true,
+  "support": true,
+  "help": true,
+  "blog": true,
+  "payments": true,
+  "feedme": true,
+}
+
+func validSlug(value string) (string, string) {
+  if reservedSlugs[value] {
+    return value, "%s " + value + " is reserved, please choose another."
+  }
+  return value, ""
 }
 
-func editMenu(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string) {
+func validTimeZone(value string) (string, string) {
+  if _, err := time.LoadLocation(value); err != nil {
+    return value, "%s must be a time zone name such as Pacific/Auckland."
+  }
+  return value, ""
+}
+
+func validOrderNumberReset(value string) (string, string) {
+  if value != "daily" && value != "never" {
+    return value, "%s must be daily or never."
+  }
+  return value, ""
+}
+
+func validCurrency(value string) (string, string) {
+  c, err := currency.Lookup(value)
+  if err != nil {
+    return value, "%s must be a currency code, one of " + strings.Join(currency.Codes(), ", ") + "."
+  }
+  return c.Code, ""
+}
+
+// Reports and Z reports add up orders' amounts, which are in the minor units
+// of the currency at the time, so the currency stays put once there are orders
+func currencyFixedOnceOrdered(fi *ef.Instance) ef.Validator {
+  return func(value string) (string, string) {
+    if fi.Id == 0 {
+      return value, ""
+    }
+
+    var current string
+    checkError(fi.Tx.Table("restaurants").Where("id=?", fi.Id).Select("currency").Row().Scan(&current))
+    if value == current {
+      return value, ""
+    }
+
+    var count int
+    checkError(fi.Tx.Table("orders").Where("restaurant_id=?", fi.Id).Count(&count).Error)
+    if count > 0 {
+      return value, "%s can't be changed once the restaurant has taken orders."
+    }
+    return value, ""
+  }
+}
+
+func editMenu(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
   restaurantID := ef.GetId(req)
 
   switch req.Method {
@@ -95,16 +212,21 @@ func editMenu(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID s
     menuJson, err := json.MarshalIndent(items, "", "  ")
     checkError(err)
 
+    var restaurant Restaurant
+    checkError(tx.First(&restaurant, restaurantID).Error)
+
     data := struct {
         Url string
         CancelUrl string
         SavedUrl string
         Json string
+        Currency currency.Currency
     }{
         fmt.Sprintf("/admin/restaurants/%d/menu", restaurantID),
         "/admin/restaurants",
         "/admin/restaurants",
         string(menuJson),
+        restaurant.CurrencyFormat,
     }
 
     templates.ElmApp(w, req, "MenuEditor", data)
@@ -117,9 +239,47 @@ func editMenu(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID s
 
     checkError(json.Unmarshal(body, &menu.Items))
 
+    if err := menu.Items.Validate(); err != nil {
+      panic(templates.BadRequest(err.Error()))
+    }
+
+    rules := fetchTaxRules(tx, restaurantID)
+    for _, item := range menu.Items {
+      if _, err := rules.rateFor(item.TaxCategory); err != nil {
+        panic(templates.BadRequest(fmt.Sprintf("Menu item %d: %s", item.Id, err)))
+      }
+    }
+
     checkError(tx.Create(&menu).Error)
 
     fmt.Fprint(w, "\"OK\"")
   }
 }
 
+
+
+func postRestaurantLogo(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+  img := uploadImage(w, req)
+
+  checkError(tx.Save(&RestaurantLogo{restaurantID, img}).Error)
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(img)
+}
+
+// Menu item photos are referenced from the menu JSON, so just return the URLs for pasting into the menu
+func postMenuImage(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  img := uploadImage(w, req)
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(img)
+}
+
+func uploadImage(w http.ResponseWriter, req *http.Request) images.Image {
+  img, err := images.Upload(w, req, "image", Config.MaxUploadBytes)
+  if err != nil {
+    panic(templates.BadRequest(err.Error()))
+  }
+  return img
+}
@@ -0,0 +1,65 @@
+package challenge
+
+// Invisible captchas (reCAPTCHA, hCaptcha, Turnstile) all verify the same way:
+// the response from the widget is posted with the secret to the provider's
+// siteverify URL, which answers with {"success": true|false}.
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/url"
+  "time"
+)
+
+type CaptchaVerifier struct {
+  SiteKey string
+  Secret string
+  ScriptURL string
+  VerifyURL string
+
+  client *http.Client
+}
+
+func NewCaptcha(siteKey, secret, scriptURL, verifyURL string) *CaptchaVerifier {
+  return &CaptchaVerifier{
+    SiteKey: siteKey,
+    Secret: secret,
+    ScriptURL: scriptURL,
+    VerifyURL: verifyURL,
+    client: &http.Client{Timeout: 10 * time.Second},
+  }
+}
+
+func (v *CaptchaVerifier) Issue() (*Challenge, error) {
+  return &Challenge{Kind: Captcha, SiteKey: v.SiteKey, ScriptURL: v.ScriptURL}, nil
+}
+
+// The widget's response is the answer, there is no token of our own
+func (v *CaptchaVerifier) Verify(token string, answer string, remoteIP string) error {
+  if answer == "" {
+    return ErrFailed
+  }
+
+  resp, err := v.client.PostForm(v.VerifyURL, url.Values{
+    "secret": {v.Secret},
+    "response": {answer},
+    "remoteip": {remoteIP},
+  })
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  result := struct {
+    Success bool `json:"success"`
+  }{}
+  err = json.NewDecoder(resp.Body).Decode(&result)
+  if err != nil {
+    return err
+  }
+
+  if !result.Success {
+    return ErrFailed
+  }
+  return nil
+}
@@ -0,0 +1,52 @@
+package challenge
+
+// Placing an order can require the browser to pass a challenge, either an
+// invisible captcha checked with its provider or a proof-of-work puzzle that
+// is verified locally. The challenge is issued with the page and the answer
+// comes back with the order.
+
+import (
+  "errors"
+)
+
+const (
+  ProofOfWork = "pow"
+  Captcha = "captcha"
+)
+
+var ErrFailed = errors.New("Challenge failed")
+var ErrExpired = errors.New("Challenge has expired")
+
+// Sent to the browser in the page flags
+type Challenge struct {
+  Kind string
+
+  // Proof-of-work: the puzzle and how many leading zero bits the answer needs
+  Token string `json:",omitempty"`
+  Difficulty int `json:",omitempty"`
+
+  // Captcha: the provider's public key and script
+  SiteKey string `json:",omitempty"`
+  ScriptURL string `json:",omitempty"`
+}
+
+type Verifier interface {
+  Issue() (*Challenge, error)
+
+  // The token is from Issue, the answer is whatever the browser worked out
+  Verify(token string, answer string, remoteIP string) error
+}
+
+var verifier Verifier
+
+func Init(v Verifier) {
+  verifier = v
+}
+
+func Enabled() bool {
+  return verifier != nil
+}
+
+func Get() Verifier {
+  return verifier
+}
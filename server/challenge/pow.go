@@ -0,0 +1,125 @@
+package challenge
+
+// The proof-of-work token is a timestamp and a random nonce signed with a
+// server secret, so nothing is stored until it is answered. The browser looks
+// for an answer where sha256(token + ":" + answer) starts with Difficulty zero
+// bits. Answered tokens are remembered until they expire so each one can only
+// be used for a single order.
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+type ProofOfWorkVerifier struct {
+  Secret string
+  Difficulty int
+  MaxAge time.Duration
+
+  mutex sync.Mutex
+  used map[string]time.Time
+}
+
+func NewProofOfWork(secret string, difficulty int, maxAge time.Duration) *ProofOfWorkVerifier {
+  if secret == "" {
+    secret = randomHex(32)
+  }
+
+  return &ProofOfWorkVerifier{
+    Secret: secret,
+    Difficulty: difficulty,
+    MaxAge: maxAge,
+    used: make(map[string]time.Time),
+  }
+}
+
+func (v *ProofOfWorkVerifier) Issue() (*Challenge, error) {
+  payload := strconv.FormatInt(time.Now().Unix(), 10) + "." + randomHex(12)
+  return &Challenge{
+    Kind: ProofOfWork,
+    Token: payload + "." + v.sign(payload),
+    Difficulty: v.Difficulty,
+  }, nil
+}
+
+func (v *ProofOfWorkVerifier) Verify(token string, answer string, remoteIP string) error {
+  parts := strings.Split(token, ".")
+  if len(parts) != 3 {
+    return ErrFailed
+  }
+
+  payload := parts[0] + "." + parts[1]
+  if !hmac.Equal([]byte(v.sign(payload)), []byte(parts[2])) {
+    return ErrFailed
+  }
+
+  issued, err := strconv.ParseInt(parts[0], 10, 64)
+  if err != nil {
+    return ErrFailed
+  }
+  issuedAt := time.Unix(issued, 0)
+  if time.Since(issuedAt) > v.MaxAge {
+    return ErrExpired
+  }
+
+  sum := sha256.Sum256([]byte(token + ":" + answer))
+  if leadingZeroBits(sum[:]) < v.Difficulty {
+    return ErrFailed
+  }
+
+  v.mutex.Lock()
+  defer v.mutex.Unlock()
+
+  v.forgetExpired()
+  if _, ok := v.used[token]; ok {
+    return ErrFailed
+  }
+  v.used[token] = issuedAt
+
+  return nil
+}
+
+func (v *ProofOfWorkVerifier) sign(payload string) string {
+  mac := hmac.New(sha256.New, []byte(v.Secret))
+  mac.Write([]byte(payload))
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Expired tokens fail anyway so there is no need to remember them
+func (v *ProofOfWorkVerifier) forgetExpired() {
+  for token, issuedAt := range v.used {
+    if time.Since(issuedAt) > v.MaxAge {
+      delete(v.used, token)
+    }
+  }
+}
+
+func leadingZeroBits(sum []byte) int {
+  bits := 0
+  for _, b := range sum {
+    if b == 0 {
+      bits += 8
+      continue
+    }
+    for mask := byte(0x80); b & mask == 0; mask >>= 1 {
+      bits++
+    }
+    break
+  }
+  return bits
+}
+
+func randomHex(n int) string {
+  b := make([]byte, n)
+  _, err := rand.Read(b)
+  if err != nil {
+    panic(err)
+  }
+  return hex.EncodeToString(b)
+}
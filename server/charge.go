@@ -0,0 +1,314 @@
+package main
+
+import (
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "feedme/server/currency"
+  "feedme/server/templates"
+  ef "feedme/server/editform"
+  "github.com/gorilla/mux"
+  "github.com/jinzhu/gorm"
+)
+
+// A surcharge as entered in the admin, e.g. a public holiday surcharge or a
+// card fee. Amounts are in the restaurant's currency, e.g. "1.50".
+type Surcharge struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+
+  Name string
+
+  // percent of the items after discounts, or a fixed amount
+  Kind string
+  Value string
+
+  // Comma separated dates in the restaurant's time zone, empty for every day
+  Dates string
+
+  // Only charged on orders paid online
+  CardOnly string
+
+  // Taxed at the standard rate when empty
+  TaxCategory string
+
+  Enabled string
+
+  CreatedAt time.Time
+  UpdatedAt time.Time
+}
+
+const (
+  ChargeSurcharge = "surcharge"
+  ChargeTip = "tip"
+)
+
+// A surcharge parsed for pricing an order. Percent is in basis points.
+type SurchargeRule struct {
+  Name string
+  Percent int
+  Amount Money
+  Category string
+}
+
+// What the customer chose to tip, either a percentage of the items in basis points or an amount
+type TipChoice struct {
+  Percent int
+  Amount Money
+}
+
+// A tip or surcharge on an order. They are kept apart from the items so
+// reports can show item revenue on its own.
+type ChargeLine struct {
+  Type string
+  Name string
+  Category string `json:",omitempty"`
+  Rate int
+  Amount Money
+  Tax Money
+}
+
+type ChargeLines []ChargeLine
+
+func (s *Surcharge) Rule(c currency.Currency) (SurchargeRule, error) {
+  rule := SurchargeRule{Name: s.Name, Category: s.TaxCategory}
+
+  var err error
+  switch s.Kind {
+  case DiscountPercent:
+    rule.Percent, err = parseTaxRate(s.Value)
+  case DiscountAmount:
+    var amount int64
+    amount, err = c.Parse(s.Value)
+    rule.Amount = Money(amount)
+  default:
+    err = errors.New("Unknown surcharge kind: " + s.Kind)
+  }
+
+  return rule, err
+}
+
+func fetchSurchargeRules(tx *gorm.DB, restaurant *Restaurant, cardPayment bool) []SurchargeRule {
+  var surcharges []Surcharge
+  checkError(tx.Where("restaurant_id=? AND enabled='yes'", restaurant.ID).Order("id asc").Find(&surcharges).Error)
+
+  today := time.Now().In(restaurant.Location()).Format(reportDateFormat)
+  rules := []SurchargeRule{}
+
+  for _, surcharge := range surcharges {
+    if surcharge.CardOnly == "yes" && !cardPayment {
+      continue
+    }
+    if surcharge.Dates != "" && !contains(splitList(surcharge.Dates), today) {
+      continue
+    }
+
+    rule, err := surcharge.Rule(restaurant.CurrencyFormat)
+    if err != nil {
+      log.Printf("Surcharge %d is misconfigured: %s", surcharge.ID, err)
+      continue
+    }
+    rules = append(rules, rule)
+  }
+
+  return rules
+}
+
+func splitList(value string) []string {
+  items := []string{}
+  for _, item := range strings.Split(value, ",") {
+    if item = strings.TrimSpace(item); item != "" {
+      items = append(items, item)
+    }
+  }
+  return items
+}
+
+// The tip percentages offered to customers in basis points, no options means tips are off
+func (r *Restaurant) tipOptions() []int {
+  options := []int{}
+  for _, option := range splitList(r.TipOptions) {
+    if percent, err := parseTaxRate(option); err == nil {
+      options = append(options, percent)
+    }
+  }
+  return options
+}
+
+// Checks the customer's tip against what the restaurant offers, any amount may be tipped
+func (r *Restaurant) validTip(tip TipChoice) bool {
+  if tip.Percent == 0 && tip.Amount == 0 {
+    return true
+  }
+
+  options := r.tipOptions()
+  if len(options) == 0 || tip.Percent < 0 || tip.Amount < 0 || (tip.Percent > 0 && tip.Amount > 0) {
+    return false
+  }
+  if tip.Amount > 0 {
+    return true
+  }
+
+  for _, option := range options {
+    if option == tip.Percent {
+      return true
+    }
+  }
+  return false
+}
+
+func (rules TaxRules) chargeLine(chargeType, name, category string, amount Money, taxed bool) ChargeLine {
+  line := ChargeLine{Type: chargeType, Name: name, Category: category, Amount: amount}
+  if !taxed {
+    return line
+  }
+
+  // The category may have been removed from the tax settings since the surcharge was set up
+  rate, err := rules.rateFor(category)
+  if err != nil {
+    log.Printf("%s: %s, using the standard rate", name, err)
+    rate = rules.Rate
+  }
+
+  line.Rate = rate
+  // Tips are what the customer chose to pay so any tax is included in them
+  if chargeType == ChargeTip && !rules.Inclusive {
+    line.Tax = TaxRules{Inclusive: true, Rounding: rules.Rounding}.taxOn(amount, rate)
+  } else {
+    line.Tax = rules.taxOn(amount, rate)
+  }
+  return line
+}
+
+// Tips and surcharges on the order, with any tax added on top of surcharges
+// when prices are tax exclusive
+func (o *Order) chargeTotals() (tips, surcharges Money) {
+  for _, line := range o.Charges {
+    switch line.Type {
+    case ChargeTip:
+      tips += line.Amount
+    case ChargeSurcharge:
+      surcharges += line.Amount
+      if o.Tax != nil && !o.Tax.Rules.Inclusive {
+        surcharges += line.Tax
+      }
+    }
+  }
+  return tips, surcharges
+}
+
+func (l *ChargeLines) Scan(src interface{}) error {
+  switch src.(type) {
+  case string:
+    return json.Unmarshal([]byte(src.(string)), l)
+  case []byte:
+    return json.Unmarshal(src.([]byte), l)
+  default:
+    return errors.New("Incompatible type for ChargeLines")
+  }
+}
+
+func (l ChargeLines) Value() (driver.Value, error) {
+  data, err := json.Marshal(l)
+  return string(data), err
+}
+
+
+func getSurcharges(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+
+  surcharges := []Surcharge{}
+  checkError(tx.Where("restaurant_id=?", restaurantID).Order("id").Find(&surcharges).Error)
+
+  flags := struct {
+    Url string
+    Surcharges []Surcharge
+  }{
+    fmt.Sprintf("/admin/restaurants/%d/surcharges", restaurantID),
+    surcharges,
+  }
+
+  templates.ElmApp(w, req, "Surcharges", flags)
+}
+
+
+// Edits surcharges at /admin/restaurants/{restaurantID}/surcharges/{id}
+type EditSurchargeForm struct {}
+
+func NewEditSurchargeForm() ef.Form {
+  return new(EditSurchargeForm)
+}
+
+func (f *EditSurchargeForm) New() interface{} {
+  return &Surcharge{Kind: DiscountPercent, CardOnly: "no", Enabled: "yes"}
+}
+
+func surchargesUrl(req *http.Request) string {
+  return "/admin/restaurants/" + mux.Vars(req)["restaurantID"] + "/surcharges"
+}
+
+func (f *EditSurchargeForm) Layout(fi *ef.Instance) ef.Layout {
+  return ef.NewLayout(
+      "Surcharge",
+      surchargesUrl(fi.Request),
+      surchargesUrl(fi.Request),
+      ef.Group("",
+        ef.Text("Name", "Name"),
+        ef.Text("Enabled", "Enabled")),
+      ef.Group("Kind is percent or amount, percentages are of the items after discounts",
+        ef.Text("Kind", "Kind"),
+        ef.Text("Value", "Value")),
+      ef.Group("Dates are YYYY-MM-DD separated by commas, leave empty to charge every day",
+        ef.Text("Dates", "Dates"),
+        ef.Text("CardOnly", "Card Payments Only"),
+        ef.Text("TaxCategory", "Tax Category")))
+}
+
+func (f *EditSurchargeForm) Validate(fi *ef.Instance) {
+  restaurantID, err := strconv.Atoi(mux.Vars(fi.Request)["restaurantID"])
+  if err != nil {
+    panic(templates.BadRequest("Expecting integer restaurant id"))
+  }
+  fi.Data.(*Surcharge).RestaurantID = uint(restaurantID)
+
+  fi.Validate("Name", "Name", ef.Trim, ef.Required)
+  fi.Validate("Enabled", "Enabled", ef.Trim, validYesNo)
+  fi.Validate("Kind", "Kind", ef.Trim, validSurchargeKind)
+  fi.Validate("Value", "Value", ef.Trim, ef.Required, validDiscountValue(fi.Submission["Kind"]))
+  fi.Validate("Dates", "Dates", ef.Trim, validDates)
+  fi.Validate("CardOnly", "Card Payments Only", ef.Trim, validYesNo)
+  fi.Validate("TaxCategory", "Tax Category", ef.Trim)
+}
+
+func validSurchargeKind(value string) (string, string) {
+  if value != DiscountPercent && value != DiscountAmount {
+    return value, "%s must be percent or amount."
+  }
+  return value, ""
+}
+
+func validDates(value string) (string, string) {
+  dates := splitList(value)
+  for _, date := range dates {
+    if _, err := time.Parse(reportDateFormat, date); err != nil {
+      return value, "%s must be dates as YYYY-MM-DD separated by commas."
+    }
+  }
+  return strings.Join(dates, ","), ""
+}
+
+func validTipOptions(value string) (string, string) {
+  options := splitList(value)
+  for _, option := range options {
+    if _, err := parseTaxRate(option); err != nil {
+      return value, "%s must be percentages separated by commas, e.g. 10,15,20."
+    }
+  }
+  return strings.Join(options, ","), ""
+}
@@ -3,13 +3,72 @@ package main
 import (
   "encoding/json"
   "io/ioutil"
+  "feedme/server/notify"
 )
 
 var Config struct {
   Debug bool
   GoogleStaticMapsKey string
   DomainName string
+  UploadsDir string
+  MaxUploadBytes int64
+  CancelWindowMinutes int
+  EmailNotifier notify.Config
+  SMSNotifier notify.Config
+  PaymentProvider string
+  PaymentWebhookSecret string
 
+  // Only trust X-Forwarded-For when running behind a proxy that sets it
+  TrustProxyHeaders bool
+
+  // "" for none, "pow" for proof-of-work or "captcha"
+  ChallengeProvider string
+  ChallengeSecret string
+  ChallengeDifficulty int
+  CaptchaSiteKey string
+  CaptchaScriptURL string
+  CaptchaVerifyURL string
+
+  // Orders allowed in the window from one session, IP address or phone number
+  OrderLimitWindowMinutes int
+  MaxOrdersPerSession int
+  MaxOrdersPerIP int
+  MaxOrdersPerPhone int
+
+  // Orders with more items than this are flagged on the till
+  LargeOrderItems int
+
+  // How long responses are kept for requests with an Idempotency-Key
+  IdempotencyRetentionHours int
+
+  // Signs session cookies and CSRF tokens, a random secret is used when
+  // empty which logs everyone out on restart
+  SessionSecret string
+
+  // Sessions expire after this many days without a visit
+  SessionIdleDays int
+
+  // Secure cookies are only sent over HTTPS, SameSite is "lax", "strict" or "none"
+  SecureCookies bool
+  CookieSameSite string
+
+  // Only report Content-Security-Policy violations instead of blocking them,
+  // always the case in debug mode
+  CSPReportOnly bool
+
+  // Serve HTTPS when a certificate is configured, normally a wildcard for
+  // DomainName and *.DomainName. TLSCertificates are extra certificates, such
+  // as for restaurants' own domains. Plain HTTP requests to HTTPPort are
+  // redirected to HTTPS unless NoHTTPRedirect is set.
+  TLSCertFile string
+  TLSKeyFile string
+  TLSCertificates []TLSCertificate
+  HTTPSPort string
+  HTTPPort string
+  NoHTTPRedirect bool
+
+  // TXT records to use instead of DNS when verifying custom domains, for development
+  FakeTXTRecords map[string][]string
 }
 
 func loadConfig() {
@@ -21,4 +80,60 @@ func loadConfig() {
   if err != nil {
     panic(err)
   }
+
+  if Config.UploadsDir == "" {
+    Config.UploadsDir = "uploads"
+  }
+
+  if Config.MaxUploadBytes == 0 {
+    Config.MaxUploadBytes = 5 * 1024 * 1024
+  }
+
+  if Config.CancelWindowMinutes == 0 {
+    Config.CancelWindowMinutes = 5
+  }
+
+  if Config.ChallengeDifficulty == 0 {
+    Config.ChallengeDifficulty = 16
+  }
+
+  if Config.OrderLimitWindowMinutes == 0 {
+    Config.OrderLimitWindowMinutes = 60
+  }
+
+  if Config.MaxOrdersPerSession == 0 {
+    Config.MaxOrdersPerSession = 5
+  }
+
+  if Config.MaxOrdersPerIP == 0 {
+    Config.MaxOrdersPerIP = 10
+  }
+
+  if Config.MaxOrdersPerPhone == 0 {
+    Config.MaxOrdersPerPhone = 5
+  }
+
+  if Config.LargeOrderItems == 0 {
+    Config.LargeOrderItems = 30
+  }
+
+  if Config.IdempotencyRetentionHours == 0 {
+    Config.IdempotencyRetentionHours = 24
+  }
+
+  if Config.SessionIdleDays == 0 {
+    Config.SessionIdleDays = 30
+  }
+
+  if Config.HTTPSPort == "" {
+    Config.HTTPSPort = "443"
+  }
+
+  if Config.HTTPPort == "" {
+    Config.HTTPPort = "80"
+  }
+
+  if Config.CookieSameSite == "" {
+    Config.CookieSameSite = "lax"
+  }
 }
@@ -0,0 +1,149 @@
+package currency
+
+// Amounts are stored as integers in the currency's minor unit (cents for NZD,
+// yen for JPY, fils for KWD), the number of minor units per major unit comes
+// from ISO 4217.
+
+import (
+  "errors"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+const Default = "NZD"
+
+type Currency struct {
+  Code string
+  Symbol string
+
+  // Digits after the decimal point
+  MinorUnits int
+}
+
+var ErrUnknownCurrency = errors.New("Unknown currency code")
+
+var currencies = map[string]Currency{
+  "AUD": {"AUD", "$", 2},
+  "BHD": {"BHD", "BD", 3},
+  "CAD": {"CAD", "$", 2},
+  "CHF": {"CHF", "CHF ", 2},
+  "CNY": {"CNY", "¥", 2},
+  "EUR": {"EUR", "€", 2},
+  "FJD": {"FJD", "$", 2},
+  "GBP": {"GBP", "£", 2},
+  "HKD": {"HKD", "$", 2},
+  "IDR": {"IDR", "Rp", 2},
+  "INR": {"INR", "₹", 2},
+  "JPY": {"JPY", "¥", 0},
+  "KRW": {"KRW", "₩", 0},
+  "KWD": {"KWD", "KD", 3},
+  "MYR": {"MYR", "RM", 2},
+  "NZD": {"NZD", "$", 2},
+  "OMR": {"OMR", "RO", 3},
+  "PHP": {"PHP", "₱", 2},
+  "SGD": {"SGD", "$", 2},
+  "THB": {"THB", "฿", 2},
+  "TOP": {"TOP", "T$", 2},
+  "USD": {"USD", "$", 2},
+  "VND": {"VND", "₫", 0},
+  "WST": {"WST", "WS$", 2},
+  "XPF": {"XPF", "F", 0},
+}
+
+func Lookup(code string) (Currency, error) {
+  c, ok := currencies[strings.ToUpper(code)]
+  if !ok {
+    return Currency{}, ErrUnknownCurrency
+  }
+  return c, nil
+}
+
+// For stored codes, which were validated when saved, falls back to the default
+func Get(code string) Currency {
+  c, err := Lookup(code)
+  if err != nil {
+    return currencies[Default]
+  }
+  return c
+}
+
+func Codes() []string {
+  codes := []string{}
+  for code := range currencies {
+    codes = append(codes, code)
+  }
+  sort.Strings(codes)
+  return codes
+}
+
+// The amount with the symbol, e.g. $12.50 or ¥1250
+func (c Currency) Format(amount int64) string {
+  if amount < 0 {
+    return "-" + c.Symbol + c.FormatPlain(-amount)
+  }
+  return c.Symbol + c.FormatPlain(amount)
+}
+
+// The amount as a decimal number without a symbol, for exports
+func (c Currency) FormatPlain(amount int64) string {
+  sign := ""
+  if amount < 0 {
+    sign = "-"
+    amount = -amount
+  }
+
+  if c.MinorUnits == 0 {
+    return sign + strconv.FormatInt(amount, 10)
+  }
+
+  scale := c.scale()
+  return fmt.Sprintf("%s%d.%0*d", sign, amount / scale, c.MinorUnits, amount % scale)
+}
+
+// Parses a decimal amount, optionally with the symbol, into minor units.
+// More decimal places than the currency has is an error rather than rounded.
+func (c Currency) Parse(value string) (int64, error) {
+  s := strings.TrimSpace(value)
+
+  negative := strings.HasPrefix(s, "-")
+  s = strings.TrimPrefix(s, "-")
+  s = strings.TrimSpace(strings.TrimPrefix(s, strings.TrimSpace(c.Symbol)))
+  s = strings.Replace(s, ",", "", -1)
+
+  major, minor := s, ""
+  if i := strings.Index(s, "."); i >= 0 {
+    major, minor = s[:i], s[i+1:]
+  }
+
+  if len(minor) > c.MinorUnits {
+    return 0, fmt.Errorf("%s amounts have at most %d decimal places: %s", c.Code, c.MinorUnits, value)
+  }
+  if major == "" && minor == "" || strings.ContainsAny(major + minor, "+-") {
+    return 0, errors.New("Expecting an amount, received: " + value)
+  }
+
+  minor += strings.Repeat("0", c.MinorUnits - len(minor))
+  if major == "" {
+    major = "0"
+  }
+
+  amount, err := strconv.ParseInt(major + minor, 10, 64)
+  if err != nil {
+    return 0, errors.New("Expecting an amount, received: " + value)
+  }
+
+  if negative {
+    amount = -amount
+  }
+  return amount, nil
+}
+
+func (c Currency) scale() int64 {
+  scale := int64(1)
+  for i := 0; i < c.MinorUnits; i++ {
+    scale *= 10
+  }
+  return scale
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+  "net/http"
+  "crypto/rand"
+  "crypto/sha256"
+  "fmt"
+  "log"
+  "math/big"
+  "strings"
+  "time"
+  "unicode"
+  "feedme/server/currency"
+  "github.com/jinzhu/gorm"
+)
+
+const loginCodeExpiry = 10 * time.Minute
+const loginCodeMaxAttempts = 5
+
+// Codes go out by email or text, and each new one resets the guesses, so
+// requests for them are limited per login, session and IP address
+const (
+  codesPerLoginPerHour = 5
+  codesPerSessionPerHour = 10
+  codesPerIPPerHour = 30
+)
+
+const codeLimitMessage = "We have sent a lot of codes recently, please try again later."
+
+// What a code proves, a login code can't be used to verify a phone number or the other way around
+const (
+  CodeLogin = "login"
+  CodePhone = "phone"
+)
+
+type Customer struct {
+  ID uint
+
+  // Email or phone number, whichever the customer logged in with
+  Login string `gorm:"not null"`
+
+  Name string
+  Telephone string
+
+  CreatedAt time.Time
+  UpdatedAt time.Time
+}
+
+type LoginCode struct {
+  ID uint
+  Login string
+  Purpose string
+  CodeHash string
+  Attempts int
+  ExpiresAt time.Time
+  UsedAt *time.Time
+  CreatedAt time.Time
+
+  // Who asked for the code, for the limits
+  SessionID string
+  ClientIP string
+}
+
+// Emails are case insensitive and phone numbers are entered with all sorts of punctuation
+func normaliseLogin(login string) string {
+  login = strings.TrimSpace(login)
+
+  if strings.Contains(login, "@") {
+    return strings.ToLower(login)
+  }
+
+  var digits strings.Builder
+  for i, r := range login {
+    if unicode.IsDigit(r) || (i == 0 && r == '+') {
+      digits.WriteRune(r)
+    }
+  }
+  return digits.String()
+}
+
+func validLogin(login string) bool {
+  if strings.Contains(login, "@") {
+    at := strings.Index(login, "@")
+    return at > 0 && strings.Contains(login[at:], ".")
+  }
+
+  return len(strings.TrimPrefix(login, "+")) >= 7
+}
+
+func randomLoginCode() string {
+  n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+  checkError(err)
+  return fmt.Sprintf("%06d", n.Int64())
+}
+
+func hashLoginCode(login, code string) string {
+  return fmt.Sprintf("%x", sha256.Sum256([]byte(login + ":" + code)))
+}
+
+// Returns a message for the customer when they have asked for too many codes
+func codeLimitError(tx *gorm.DB, purpose, login, sessionID, clientIP string) string {
+  since := time.Now().Add(-time.Hour)
+
+  limits := []struct {
+    Column string
+    Value string
+    Max int
+  }{
+    {"login", login, codesPerLoginPerHour},
+    {"session_id", sessionID, codesPerSessionPerHour},
+    {"client_ip", clientIP, codesPerIPPerHour},
+  }
+
+  for _, limit := range limits {
+    if limit.Value == "" {
+      continue
+    }
+
+    var count int
+    checkError(tx.Model(&LoginCode{}).
+      Where(limit.Column + "=? AND purpose=? AND created_at>?", limit.Value, purpose, since).
+      Count(&count).Error)
+    if count >= limit.Max {
+      log.Printf("Code limit reached for %s %s", limit.Column, limit.Value)
+      return codeLimitMessage
+    }
+  }
+
+  return ""
+}
+
+func createLoginCode(tx *gorm.DB, purpose, login, sessionID, clientIP string) string {
+  code := randomLoginCode()
+
+  // Only the latest code is valid
+  checkError(tx.Table("login_codes").Where("login=? AND purpose=? AND used_at IS NULL", login, purpose).Update("used_at", time.Now()).Error)
+
+  checkError(tx.Create(&LoginCode{
+    Login: login,
+    Purpose: purpose,
+    CodeHash: hashLoginCode(login, code),
+    ExpiresAt: time.Now().Add(loginCodeExpiry),
+    SessionID: sessionID,
+    ClientIP: clientIP,
+  }).Error)
+
+  return code
+}
+
+func verifyLoginCode(tx *gorm.DB, purpose, login, code string) string {
+  var loginCode LoginCode
+
+  err := tx.Set("gorm:query_option", "FOR UPDATE").
+          Where("login=? AND purpose=? AND used_at IS NULL", login, purpose).
+          Order("id desc").
+          First(&loginCode).Error
+
+  if gorm.IsRecordNotFoundError(err) {
+    return "Please request a new code."
+  }
+  checkError(err)
+
+  if time.Now().After(loginCode.ExpiresAt) || loginCode.Attempts >= loginCodeMaxAttempts {
+    return "That code has expired, please request a new one."
+  }
+
+  if loginCode.CodeHash != hashLoginCode(login, strings.TrimSpace(code)) {
+    checkError(tx.Model(&loginCode).Update("attempts", loginCode.Attempts + 1).Error)
+    return "That code is not correct."
+  }
+
+  checkError(tx.Model(&loginCode).Update("used_at", time.Now()).Error)
+  return ""
+}
+
+func findOrCreateCustomer(tx *gorm.DB, login string) *Customer {
+  var customer Customer
+  checkError(tx.Where(Customer{Login: login}).FirstOrCreate(&customer).Error)
+  return &customer
+}
+
+// Logging in starts a new session, the orders and verified phones of the
+// old one move to it so the customer can still follow them
+func loginSession(w http.ResponseWriter, tx *gorm.DB, session *Session, customer *Customer) {
+  oldID := session.ID
+  rotateSession(w, tx, session)
+
+  session.CustomerID = &customer.ID
+  session.save(tx)
+
+  checkError(tx.Table("orders").Where("session_id=?", oldID).Update("session_id", session.ID).Error)
+  checkError(tx.Table("verified_phones").Where("session_id=?", oldID).Update("session_id", session.ID).Error)
+}
+
+func logoutSession(w http.ResponseWriter, tx *gorm.DB, session *Session) {
+  rotateSession(w, tx, session)
+}
+
+// Returns nil when the session is not logged in
+func fetchSessionCustomer(tx *gorm.DB, session *Session) *Customer {
+  if session.CustomerID == nil {
+    return nil
+  }
+
+  var customer Customer
+  checkError(tx.First(&customer, *session.CustomerID).Error)
+  return &customer
+}
+
+// Remember the details from the latest order to prefill the next one
+func (c *Customer) rememberDetails(tx *gorm.DB, name, telephone string) {
+  checkError(tx.Model(c).Updates(map[string]interface{}{"name": name, "telephone": telephone}).Error)
+}
+
+
+type CustomerOrder struct {
+  RestaurantName string
+  Number uint
+  Total Money
+  Currency currency.Currency
+  Status string
+  StatusDate *time.Time
+  CreatedAt time.Time
+  TrackingURL string
+  ReorderURL string
+}
+
+func fetchCustomerOrders(tx *gorm.DB, customerID uint, urlPort string) []CustomerOrder {
+  var rows []struct {
+    Order
+    RestaurantName string
+    RestaurantSlug string
+  }
+
+  checkError(tx.Table("orders").
+    Select("orders.*, restaurants.name AS restaurant_name, restaurants.slug AS restaurant_slug").
+    Joins("JOIN restaurants ON restaurants.id = orders.restaurant_id").
+    Where("orders.customer_id=?", customerID).
+    Order("orders.created_at desc").
+    Limit(100).
+    Find(&rows).Error)
+
+  orders := []CustomerOrder{}
+  for _, row := range rows {
+    restaurantURL := restaurantURL(row.RestaurantSlug, urlPort)
+    orders = append(orders, CustomerOrder{
+      RestaurantName: row.RestaurantName,
+      Number: row.DisplayNumber,
+      Total: row.Total,
+      Currency: currency.Get(row.Currency),
+      Status: row.Status,
+      StatusDate: row.StatusDate,
+      CreatedAt: row.CreatedAt,
+      TrackingURL: restaurantURL + row.TrackingURL()[1:],
+      ReorderURL: restaurantURL + "?reorder=" + row.TrackingToken,
+    })
+  }
+
+  return orders
+}
+
+
+type ReorderChange struct {
+  Id int
+  Name string
+  Removed bool
+  OldPrice Money
+  NewPrice Money
+}
+
+type Reorder struct {
+  Items OrderItems
+  Changes []ReorderChange
+}
+
+// Rebuilds a previous order against the current menu, items that are gone are
+// dropped and price changes are flagged so the customer is not surprised.
+func rebuildOrder(order *Order, menu *Menu) Reorder {
+  reorder := Reorder{OrderItems{}, []ReorderChange{}}
+
+  for _, item := range order.Items {
+    oldItem := order.Menu.Items.itemById(item.Id)
+    if oldItem == nil {
+      continue
+    }
+
+    // Ids may have been reused for something else entirely
+    newItem := menu.Items.itemById(item.Id)
+    if newItem == nil || newItem.Name != oldItem.Name {
+      reorder.Changes = append(reorder.Changes, ReorderChange{item.Id, oldItem.Name, true, oldItem.Price, 0})
+      continue
+    }
+
+    if newItem.Price != oldItem.Price {
+      reorder.Changes = append(reorder.Changes, ReorderChange{item.Id, newItem.Name, false, oldItem.Price, newItem.Price})
+    }
+
+    reorder.Items = append(reorder.Items, item)
+  }
+
+  return reorder
+}
@@ -9,9 +9,14 @@ import (
 )
 
 func initDB() *gorm.DB {
+  return openDB("dbname=feedme sslmode=disable")
+}
+
+// Connects and brings the schema up to date
+func openDB(source string) *gorm.DB {
   var err error
 
-  db, err := gorm.Open("postgres", "dbname=feedme sslmode=disable")
+  db, err := gorm.Open("postgres", source)
   checkError(err)
   db.LogMode(true)
 
@@ -114,6 +119,625 @@ func initDB() *gorm.DB {
         return tx.Exec("ALTER TABLE orders ADD COLUMN status_date timestamp with time zone").Error
       },
     },
+    {
+      ID: "3",
+      Migrate: func(tx *gorm.DB) error {
+        type RestaurantLogo struct {
+          RestaurantID uint `gorm:"primary_key"`
+          Image string `gorm:"type:text"`
+        }
+
+        err := tx.AutoMigrate(&RestaurantLogo{}).Error
+        if err != nil { return err }
+
+        return tx.Model(&RestaurantLogo{}).AddForeignKey("restaurant_id", "restaurants(id)", "RESTRICT", "RESTRICT").Error
+      },
+    },
+    {
+      ID: "4",
+      Migrate: func(tx *gorm.DB) error {
+        // Adding a value to an enum can't be done in the migration's transaction
+        // before PostgreSQL 12, and can't be used until commit after, so the
+        // enum becomes text with a check constraint
+        err := tx.Exec("ALTER TABLE orders ALTER COLUMN status TYPE text").Error
+        if err != nil { return err }
+
+        err = tx.Exec("DROP TYPE orderstatus").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (status IN ('New', 'Ready', 'Expected', 'PickedUp', 'Rejected', 'Cancelled'))").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE orders ADD COLUMN cancel_reason text not null default ''").Error
+      },
+    },
+    {
+      ID: "5",
+      Migrate: func(tx *gorm.DB) error {
+        err := tx.Exec("ALTER TABLE orders ADD COLUMN tracking_token text").Error
+        if err != nil { return err }
+
+        // Existing orders only need to be unique, they were never handed out
+        err = tx.Exec("UPDATE orders SET tracking_token = md5(random()::text || restaurant_id || '-' || number)").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ALTER COLUMN tracking_token SET NOT NULL").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE UNIQUE INDEX orders_tracking_token_index ON orders (tracking_token)").Error
+      },
+    },
+    {
+      ID: "6",
+      Migrate: func(tx *gorm.DB) error {
+        type Customer struct {
+          ID uint
+          Login string `gorm:"not null;unique_index"`
+          Name string
+          Telephone string
+          CreatedAt time.Time
+          UpdatedAt time.Time
+        }
+
+        type SessionCustomer struct {
+          SessionID string `gorm:"primary_key"`
+          CustomerID uint `gorm:"not null"`
+        }
+
+        type LoginCode struct {
+          ID uint
+          Login string `gorm:"not null;index"`
+          CodeHash string `gorm:"not null"`
+          Attempts int `gorm:"not null"`
+          ExpiresAt time.Time `gorm:"not null"`
+          UsedAt *time.Time
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&Customer{}).Error
+        if err != nil { return err }
+
+        err = tx.AutoMigrate(&SessionCustomer{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&SessionCustomer{}).AddForeignKey("customer_id", "customers(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.AutoMigrate(&LoginCode{}).Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN customer_id integer REFERENCES customers(id) ON DELETE RESTRICT").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX orders_customer_id_created_at_index ON orders (customer_id, created_at)").Error
+      },
+    },
+    {
+      ID: "7",
+      Migrate: func(tx *gorm.DB) error {
+        type RestaurantNotifications struct {
+          ID uint `gorm:"primary_key"`
+          ExpectedSubject string
+          ExpectedBody string
+          ReadySubject string
+          ReadyBody string
+          RejectedSubject string
+          RejectedBody string
+        }
+
+        type OutboxMessage struct {
+          ID uint
+          To string `gorm:"not null"`
+          Subject string
+          Body string
+          Attempts int `gorm:"not null"`
+          NextAttemptAt time.Time `gorm:"not null"`
+          SentAt *time.Time
+          LastError string
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&RestaurantNotifications{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&RestaurantNotifications{}).AddForeignKey("id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        var restaurantIDs []uint
+        err = tx.Table("restaurants").Pluck("id", &restaurantIDs).Error
+        if err != nil { return err }
+
+        for _, id := range restaurantIDs {
+          defaults := defaultRestaurantNotifications(id)
+          err = tx.Create(&RestaurantNotifications{
+            defaults.ID,
+            defaults.ExpectedSubject, defaults.ExpectedBody,
+            defaults.ReadySubject, defaults.ReadyBody,
+            defaults.RejectedSubject, defaults.RejectedBody,
+          }).Error
+          if err != nil { return err }
+        }
+
+        err = tx.Table("notification_outbox").AutoMigrate(&OutboxMessage{}).Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX notification_outbox_pending_index ON notification_outbox (next_attempt_at) WHERE sent_at IS NULL").Error
+      },
+    },
+    {
+      ID: "8",
+      Migrate: func(tx *gorm.DB) error {
+        type Subscription struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          URL string `gorm:"not null"`
+          Secret string `gorm:"not null"`
+          Events string
+          CreatedAt time.Time
+          UpdatedAt time.Time
+        }
+
+        type Delivery struct {
+          ID uint
+          SubscriptionID uint `gorm:"not null"`
+          Event string `gorm:"not null"`
+          Payload string `gorm:"type:text;not null"`
+          Attempts int `gorm:"not null"`
+          NextAttemptAt time.Time `gorm:"not null"`
+          DeliveredAt *time.Time
+          LastStatus int
+          LastError string
+          CreatedAt time.Time
+        }
+
+        err := tx.Table("webhook_subscriptions").AutoMigrate(&Subscription{}).Error
+        if err != nil { return err }
+
+        err = tx.Table("webhook_subscriptions").AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Table("webhook_deliveries").AutoMigrate(&Delivery{}).Error
+        if err != nil { return err }
+
+        err = tx.Table("webhook_deliveries").AddForeignKey("subscription_id", "webhook_subscriptions(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX webhook_deliveries_pending_index ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL").Error
+      },
+    },
+    {
+      ID: "9",
+      Migrate: func(tx *gorm.DB) error {
+        type Job struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          OrderNumber uint `gorm:"not null"`
+          Printer string `gorm:"not null"`
+          Data []byte `gorm:"not null"`
+          Attempts int `gorm:"not null"`
+          NextAttemptAt time.Time `gorm:"not null"`
+          PrintedAt *time.Time
+          LastError string
+          CreatedAt time.Time
+        }
+
+        err := tx.Exec("ALTER TABLE restaurants ADD COLUMN printer_address text not null default ''").Error
+        if err != nil { return err }
+
+        err = tx.Table("print_jobs").AutoMigrate(&Job{}).Error
+        if err != nil { return err }
+
+        err = tx.Table("print_jobs").AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX print_jobs_pending_index ON print_jobs (next_attempt_at) WHERE printed_at IS NULL").Error
+      },
+    },
+    {
+      ID: "10",
+      Migrate: func(tx *gorm.DB) error {
+        err := tx.Exec("ALTER TABLE orders ADD COLUMN payment_status text not null default 'NotRequired'").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN payment_intent_id text").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX orders_payment_intent_id_index ON orders (payment_intent_id)").Error
+      },
+    },
+    {
+      ID: "11",
+      Migrate: func(tx *gorm.DB) error {
+        type Refund struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          OrderNumber uint `gorm:"not null"`
+          Lines string `gorm:"type:text"`
+          Amount int `gorm:"not null"`
+          Reason string `gorm:"not null"`
+          ProviderRefundID string `gorm:"not null"`
+          CreatedAt time.Time
+        }
+
+        err := tx.Exec("ALTER TABLE restaurants ADD COLUMN refund_pin text not null default ''").Error
+        if err != nil { return err }
+
+        err = tx.AutoMigrate(&Refund{}).Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE refunds ADD FOREIGN KEY (restaurant_id, order_number) REFERENCES orders (restaurant_id, number) ON DELETE CASCADE").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX refunds_order_index ON refunds (restaurant_id, order_number)").Error
+      },
+    },
+    {
+      ID: "12",
+      Migrate: func(tx *gorm.DB) error {
+        return tx.Exec("ALTER TABLE restaurants ADD COLUMN time_zone text not null default 'Pacific/Auckland'").Error
+      },
+    },
+    {
+      ID: "13",
+      Migrate: func(tx *gorm.DB) error {
+        type ZReport struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          Number uint `gorm:"not null"`
+          From *time.Time
+          To time.Time `gorm:"not null"`
+          Data string `gorm:"type:text"`
+          CreatedAt time.Time
+        }
+
+        statements := []string{
+          "ALTER TABLE orders ADD COLUMN id bigserial UNIQUE",
+          "ALTER TABLE orders ADD COLUMN display_number integer",
+          "UPDATE orders SET display_number = number",
+          "ALTER TABLE orders ALTER COLUMN display_number SET NOT NULL",
+          "ALTER TABLE restaurants ADD COLUMN order_number_reset text not null default 'never'",
+          "ALTER TABLE restaurant_order_numbers ADD COLUMN last_display_number integer not null default 0",
+          "ALTER TABLE restaurant_order_numbers ADD COLUMN display_date text not null default ''",
+          "UPDATE restaurant_order_numbers SET last_display_number = last_order_number",
+        }
+        for _, statement := range statements {
+          if err := tx.Exec(statement).Error; err != nil { return err }
+        }
+
+        err := tx.AutoMigrate(&ZReport{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&ZReport{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE UNIQUE INDEX z_reports_number_index ON z_reports (restaurant_id, number)").Error
+      },
+    },
+    {
+      ID: "14",
+      Migrate: func(tx *gorm.DB) error {
+        type RestaurantTaxSettings struct {
+          ID uint `gorm:"primary_key"`
+          Rate string
+          Prices string
+          Rounding string
+          Categories string
+        }
+
+        err := tx.Exec("ALTER TABLE orders ADD COLUMN tax text").Error
+        if err != nil { return err }
+
+        err = tx.AutoMigrate(&RestaurantTaxSettings{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&RestaurantTaxSettings{}).AddForeignKey("id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        // Existing restaurants carry on with 15% GST included in their prices
+        return tx.Exec("INSERT INTO restaurant_tax_settings (id, rate, prices, rounding, categories) SELECT id, '15', 'inclusive', 'half-up', '' FROM restaurants").Error
+      },
+    },
+    {
+      ID: "15",
+      Migrate: func(tx *gorm.DB) error {
+        // Everything so far has been in New Zealand dollars
+        err := tx.Exec("ALTER TABLE restaurants ADD COLUMN currency text NOT NULL DEFAULT 'NZD'").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE orders ADD COLUMN currency text NOT NULL DEFAULT 'NZD'").Error
+      },
+    },
+    {
+      ID: "16",
+      Migrate: func(tx *gorm.DB) error {
+        type Promotion struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          Name string
+          Code string
+          Kind string
+          Value string
+          Items string
+          MinSpend string
+          StartsOn string
+          EndsOn string
+          FirstOrderOnly string
+          UsesPerCustomer string
+          MaxUses string
+          Enabled string
+          CreatedAt time.Time
+          UpdatedAt time.Time
+        }
+
+        type PromotionUse struct {
+          ID uint
+          PromotionID uint `gorm:"not null"`
+          RestaurantID uint `gorm:"not null"`
+          OrderNumber uint `gorm:"not null"`
+          CustomerID *uint
+          SessionID string `gorm:"not null"`
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&Promotion{}, &PromotionUse{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&Promotion{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Model(&PromotionUse{}).AddForeignKey("promotion_id", "promotions(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE promotion_uses ADD FOREIGN KEY (restaurant_id, order_number) REFERENCES orders (restaurant_id, number) ON DELETE CASCADE").Error
+        if err != nil { return err }
+
+        err = tx.Exec("CREATE INDEX promotion_uses_promotion_index ON promotion_uses (promotion_id)").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN promo_code text NOT NULL DEFAULT ''").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE orders ADD COLUMN discounts text NOT NULL DEFAULT '[]'").Error
+      },
+    },
+    {
+      ID: "17",
+      Migrate: func(tx *gorm.DB) error {
+        type Surcharge struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          Name string
+          Kind string
+          Value string
+          Dates string
+          CardOnly string
+          TaxCategory string
+          Enabled string
+          CreatedAt time.Time
+          UpdatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&Surcharge{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&Surcharge{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE restaurants ADD COLUMN tip_options text NOT NULL DEFAULT ''").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE restaurant_tax_settings ADD COLUMN tips text NOT NULL DEFAULT 'untaxed'").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE orders ADD COLUMN charges text NOT NULL DEFAULT '[]'").Error
+      },
+    },
+    {
+      ID: "18",
+      Migrate: func(tx *gorm.DB) error {
+        type BlockedNumber struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          Telephone string `gorm:"not null"`
+          Reason string
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&BlockedNumber{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&BlockedNumber{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Model(&BlockedNumber{}).AddUniqueIndex("blocked_numbers_restaurant_id_telephone_index", "restaurant_id", "telephone").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN client_ip text NOT NULL DEFAULT ''").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN normalised_telephone text NOT NULL DEFAULT ''").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE orders ADD COLUMN suspicious text NOT NULL DEFAULT '[]'").Error
+        if err != nil { return err }
+
+        // Close enough to normaliseLogin for earlier orders, phone numbers rarely have a + other than at the start
+        err = tx.Exec("UPDATE orders SET normalised_telephone = regexp_replace(telephone, '[^0-9+]', '', 'g')").Error
+        if err != nil { return err }
+
+        err = tx.Exec("CREATE INDEX orders_client_ip_created_at_index ON orders (client_ip, created_at)").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX orders_normalised_telephone_created_at_index ON orders (normalised_telephone, created_at)").Error
+      },
+    },
+    {
+      ID: "19",
+      Migrate: func(tx *gorm.DB) error {
+        type VerifiedPhone struct {
+          ID uint
+          SessionID string `gorm:"not null"`
+          Telephone string `gorm:"not null"`
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&VerifiedPhone{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&VerifiedPhone{}).AddUniqueIndex("verified_phones_session_id_telephone_index", "session_id", "telephone").Error
+        if err != nil { return err }
+
+        err = tx.Exec("ALTER TABLE login_codes ADD COLUMN purpose text NOT NULL DEFAULT 'login'").Error
+        if err != nil { return err }
+
+        err = tx.Exec("CREATE INDEX login_codes_login_purpose_created_at_index ON login_codes (login, purpose, created_at)").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE restaurants ADD COLUMN verify_phone text NOT NULL DEFAULT 'no'").Error
+      },
+    },
+    {
+      ID: "20",
+      Migrate: func(tx *gorm.DB) error {
+        type IdempotencyKey struct {
+          ID uint
+          SessionID string `gorm:"not null"`
+          Key string `gorm:"not null"`
+          RequestHash string `gorm:"not null"`
+          StatusCode int
+          ContentType string
+          Body string
+          CompletedAt *time.Time
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&IdempotencyKey{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&IdempotencyKey{}).AddUniqueIndex("idempotency_keys_session_id_key_index", "session_id", "key").Error
+        if err != nil { return err }
+
+        return tx.Model(&IdempotencyKey{}).AddIndex("idempotency_keys_created_at_index", "created_at").Error
+      },
+    },
+    {
+      ID: "21",
+      Migrate: func(tx *gorm.DB) error {
+        type Session struct {
+          ID string `gorm:"primary_key"`
+          CustomerID *uint
+          CreatedAt time.Time
+          LastSeenAt time.Time
+          ExpiresAt time.Time
+          RevokedAt *time.Time
+        }
+
+        err := tx.AutoMigrate(&Session{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&Session{}).AddForeignKey("customer_id", "customers(id)", "SET NULL", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Model(&Session{}).AddIndex("sessions_customer_id_index", "customer_id").Error
+        if err != nil { return err }
+
+        err = tx.Model(&Session{}).AddIndex("sessions_expires_at_index", "expires_at").Error
+        if err != nil { return err }
+
+        // Everyone starts a new session, the signed cookies that come with
+        // sessions can't be matched to the old bare IDs. Customers log in again
+        // to see their orders.
+        return tx.DropTable("session_customers").Error
+      },
+    },
+    {
+      ID: "22",
+      Migrate: func(tx *gorm.DB) error {
+        type RestaurantDomain struct {
+          RestaurantID uint `gorm:"primary_key"`
+          Domain string `gorm:"not null"`
+          Token string `gorm:"not null"`
+          VerifiedAt *time.Time
+        }
+
+        err := tx.AutoMigrate(&RestaurantDomain{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&RestaurantDomain{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        err = tx.Model(&RestaurantDomain{}).AddUniqueIndex("restaurant_domains_domain_index", "domain").Error
+        if err != nil { return err }
+
+        return tx.Exec("ALTER TABLE restaurants ADD COLUMN custom_domain text NOT NULL DEFAULT ''").Error
+      },
+    },
+    {
+      ID: "23",
+      Migrate: func(tx *gorm.DB) error {
+        type Restaurant struct {
+          ID uint
+          Slug string
+        }
+
+        // Fails if there are already duplicates, which need renaming by hand
+        return tx.Model(&Restaurant{}).AddUniqueIndex("restaurants_slug_index", "slug").Error
+      },
+    },
+    {
+      ID: "24",
+      Migrate: func(tx *gorm.DB) error {
+        return tx.Exec("ALTER TABLE refunds ADD COLUMN status text NOT NULL DEFAULT 'succeeded'").Error
+      },
+    },
+    {
+      ID: "25",
+      Migrate: func(tx *gorm.DB) error {
+        err := tx.Exec("ALTER TABLE orders ADD COLUMN z_report_id integer REFERENCES z_reports (id) ON DELETE SET NULL").Error
+        if err != nil { return err }
+
+        // Orders already closed out belong to the report whose period they were placed in
+        err = tx.Exec(`UPDATE orders SET z_report_id = z_reports.id FROM z_reports
+                       WHERE z_reports.restaurant_id = orders.restaurant_id
+                       AND orders.created_at <= z_reports."to"
+                       AND (z_reports."from" IS NULL OR orders.created_at > z_reports."from")
+                       AND orders.payment_status <> 'PaymentPending'`).Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX orders_unreported_index ON orders (restaurant_id) WHERE z_report_id IS NULL").Error
+      },
+    },
+    {
+      ID: "26",
+      Migrate: func(tx *gorm.DB) error {
+        err := tx.Exec("ALTER TABLE login_codes ADD COLUMN session_id text, ADD COLUMN client_ip text").Error
+        if err != nil { return err }
+
+        err = tx.Exec("CREATE INDEX login_codes_session_id_created_at_index ON login_codes (session_id, created_at)").Error
+        if err != nil { return err }
+
+        return tx.Exec("CREATE INDEX login_codes_client_ip_created_at_index ON login_codes (client_ip, created_at)").Error
+      },
+    },
+    {
+      ID: "27",
+      Migrate: func(tx *gorm.DB) error {
+        type RefundPINFailure struct {
+          ID uint
+          RestaurantID uint `gorm:"not null"`
+          ClientIP string
+          CreatedAt time.Time
+        }
+
+        err := tx.AutoMigrate(&RefundPINFailure{}).Error
+        if err != nil { return err }
+
+        err = tx.Model(&RefundPINFailure{}).AddForeignKey("restaurant_id", "restaurants(id)", "CASCADE", "RESTRICT").Error
+        if err != nil { return err }
+
+        return tx.Model(&RefundPINFailure{}).AddIndex("refund_pin_failures_restaurant_id_created_at_index", "restaurant_id", "created_at").Error
+      },
+    },
   })
 
   checkError(m.Migrate())
@@ -0,0 +1,542 @@
+package main
+
+import (
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "feedme/server/currency"
+  "feedme/server/templates"
+  ef "feedme/server/editform"
+  "github.com/gorilla/mux"
+  "github.com/jinzhu/gorm"
+)
+
+// A promotion as entered in the admin. Promotions without a code apply
+// automatically to every eligible order, the others only when the customer
+// enters the code. Amounts are in the restaurant's currency, e.g. "5.00".
+type Promotion struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+
+  Name string
+  Code string
+
+  // percent, amount or free-item, Value is the percentage, the amount or the
+  // menu item id of the free item respectively
+  Kind string
+  Value string
+
+  // Comma separated menu item ids the discount is limited to, empty for the whole order
+  Items string
+  MinSpend string
+
+  // Inclusive dates in the restaurant's time zone, either may be empty
+  StartsOn string
+  EndsOn string
+
+  FirstOrderOnly string
+  UsesPerCustomer string
+  MaxUses string
+
+  Enabled string
+
+  CreatedAt time.Time
+  UpdatedAt time.Time
+}
+
+const (
+  DiscountPercent = "percent"
+  DiscountAmount = "amount"
+  DiscountFreeItem = "free-item"
+)
+
+var DiscountKinds = []string{DiscountPercent, DiscountAmount, DiscountFreeItem}
+
+// Recorded for each order a promotion is applied to, for usage limits
+type PromotionUse struct {
+  ID uint
+  PromotionID uint `gorm:"not null"`
+  RestaurantID uint `gorm:"not null"`
+  OrderNumber uint `gorm:"not null"`
+  CustomerID *uint
+  SessionID string `gorm:"not null"`
+  CreatedAt time.Time
+}
+
+// A promotion parsed for pricing an order. Percent is in basis points.
+type Discount struct {
+  PromotionID uint
+  Name string
+  Code string
+  Kind string
+  Percent int
+  Amount Money
+  ItemIds []int
+  MinSpend Money
+}
+
+// The discount given by one promotion, stored on the order
+type DiscountLine struct {
+  PromotionID uint
+  Name string
+  Code string `json:",omitempty"`
+  Amount Money
+}
+
+type DiscountLines []DiscountLine
+
+func (p *Promotion) Discount(c currency.Currency) (Discount, error) {
+  d := Discount{PromotionID: p.ID, Name: p.Name, Code: p.Code, Kind: p.Kind}
+
+  var err error
+  switch p.Kind {
+  case DiscountPercent:
+    d.Percent, err = parseTaxRate(p.Value)
+  case DiscountAmount:
+    var amount int64
+    amount, err = c.Parse(p.Value)
+    d.Amount = Money(amount)
+  case DiscountFreeItem:
+    var id int
+    id, err = strconv.Atoi(p.Value)
+    d.ItemIds = []int{id}
+  default:
+    err = errors.New("Unknown discount kind: " + p.Kind)
+  }
+  if err != nil {
+    return d, err
+  }
+
+  if p.Kind != DiscountFreeItem {
+    d.ItemIds, err = parseItemIds(p.Items)
+    if err != nil {
+      return d, err
+    }
+  }
+
+  if p.MinSpend != "" {
+    minSpend, err := c.Parse(p.MinSpend)
+    if err != nil {
+      return d, err
+    }
+    d.MinSpend = Money(minSpend)
+  }
+
+  return d, nil
+}
+
+func parseItemIds(value string) ([]int, error) {
+  ids := []int{}
+  for _, field := range strings.Split(value, ",") {
+    field = strings.TrimSpace(field)
+    if field == "" {
+      continue
+    }
+    id, err := strconv.Atoi(field)
+    if err != nil {
+      return nil, errors.New("Expecting comma separated menu item ids, received: " + value)
+    }
+    ids = append(ids, id)
+  }
+  return ids, nil
+}
+
+func parseLimit(value string) int {
+  limit, _ := strconv.Atoi(value)
+  return limit
+}
+
+// The promotions the order may use: the automatic ones and the one matching
+// its promo code. Spend and item conditions depend on the order's items so
+// they are left to Recalc. Returns an error message for the customer when the
+// promo code cannot be used.
+func fetchDiscounts(tx *gorm.DB, restaurant *Restaurant, order *OrderWithSessionID) ([]Discount, string) {
+  code := strings.TrimSpace(order.PromoCode)
+
+  // Locking the promotions keeps usage limits exact when orders arrive together
+  var promotions []Promotion
+  checkError(tx.Set("gorm:query_option", "FOR UPDATE").
+    Where("restaurant_id=? AND enabled='yes' AND (code='' OR upper(code)=upper(?))", restaurant.ID, code).
+    Order("id asc").
+    Find(&promotions).Error)
+
+  today := time.Now().In(restaurant.Location()).Format(reportDateFormat)
+  discounts := []Discount{}
+  codeError := "That promo code is not valid."
+
+  for _, promotion := range promotions {
+    message := promotion.unavailable(tx, restaurant.ID, order, today)
+    if message != "" {
+      if promotion.Code != "" {
+        codeError = message
+      }
+      continue
+    }
+
+    discount, err := promotion.Discount(restaurant.CurrencyFormat)
+    if err != nil {
+      log.Printf("Promotion %d is misconfigured: %s", promotion.ID, err)
+      continue
+    }
+
+    discounts = append(discounts, discount)
+    if promotion.Code != "" {
+      codeError = ""
+    }
+  }
+
+  if code == "" {
+    codeError = ""
+  }
+  return discounts, codeError
+}
+
+// Why the order cannot use the promotion, or "" if it can
+func (p *Promotion) unavailable(tx *gorm.DB, restaurantID uint, order *OrderWithSessionID, today string) string {
+  if (p.StartsOn != "" && today < p.StartsOn) || (p.EndsOn != "" && today > p.EndsOn) {
+    return "That promo code has expired."
+  }
+
+  // Customers who are logged in are recognised across browsers
+  whose := tx.Where("orders.session_id=?", order.SessionID)
+  if order.CustomerID != nil {
+    whose = tx.Where("orders.customer_id=?", *order.CustomerID)
+  }
+
+  if p.FirstOrderOnly == "yes" {
+    var previous int
+    checkError(whose.Table("orders").
+      Where("orders.restaurant_id=? AND orders.status NOT IN (?)", restaurantID, []string{"Rejected", "Cancelled"}).
+      Count(&previous).Error)
+    if previous > 0 {
+      return "That promo code is only for first orders."
+    }
+  }
+
+  uses := func(query *gorm.DB) int {
+    var count int
+    checkError(query.Table("promotion_uses").
+      Joins("JOIN orders ON orders.restaurant_id = promotion_uses.restaurant_id AND orders.number = promotion_uses.order_number").
+      Where("promotion_uses.promotion_id=? AND orders.status NOT IN (?)", p.ID, []string{"Rejected", "Cancelled"}).
+      Count(&count).Error)
+    return count
+  }
+
+  if limit := parseLimit(p.MaxUses); limit > 0 && uses(tx) >= limit {
+    return "That promo code has been used up."
+  }
+
+  if limit := parseLimit(p.UsesPerCustomer); limit > 0 && uses(whose) >= limit {
+    return "You have already used that promo code."
+  }
+
+  return ""
+}
+
+func recordPromotionUses(tx *gorm.DB, order *OrderWithSessionID) {
+  for _, line := range order.Discounts {
+    checkError(tx.Create(&PromotionUse{
+      PromotionID: line.PromotionID,
+      RestaurantID: order.RestaurantID,
+      OrderNumber: order.Number,
+      CustomerID: order.CustomerID,
+      SessionID: order.SessionID,
+    }).Error)
+  }
+}
+
+// Works out the discount on the lines before tax and spreads it over the
+// eligible lines in proportion to what is left of each, so tax and refunds
+// are calculated on what the customer actually paid for each line.
+func (d *Discount) apply(lines []TaxLine, subtotal Money) Money {
+  if subtotal < d.MinSpend {
+    return 0
+  }
+
+  eligible := []int{}
+  var remaining Money
+  for i, line := range lines {
+    if len(d.ItemIds) == 0 || containsInt(d.ItemIds, line.Id) {
+      eligible = append(eligible, i)
+      remaining += line.Amount - line.Discount
+    }
+  }
+  if remaining <= 0 {
+    return 0
+  }
+
+  var amount Money
+  switch d.Kind {
+  case DiscountPercent:
+    amount = Money(roundDiv(int64(remaining) * int64(d.Percent), 10000, "half-up"))
+  case DiscountAmount:
+    amount = d.Amount
+  case DiscountFreeItem:
+    // One of the item, at its menu price
+    line := lines[eligible[0]]
+    amount = line.Amount / Money(line.Qty)
+  }
+  if amount > remaining {
+    amount = remaining
+  }
+
+  allocated := Money(0)
+  for n, i := range eligible {
+    left := lines[i].Amount - lines[i].Discount
+    share := Money(math.Floor(float64(amount) * float64(left) / float64(remaining)))
+    if n == len(eligible) - 1 {
+      share = amount - allocated
+    }
+    lines[i].Discount += share
+    allocated += share
+  }
+
+  return amount
+}
+
+func (l DiscountLines) hasCode(code string) bool {
+  for _, line := range l {
+    if line.Code != "" && strings.EqualFold(line.Code, strings.TrimSpace(code)) {
+      return true
+    }
+  }
+  return false
+}
+
+func containsInt(list []int, n int) bool {
+  for _, item := range list {
+    if item == n {
+      return true
+    }
+  }
+  return false
+}
+
+// The discount to take off a refund of qty of an item, across every line it is on
+func (o *Order) lineDiscount(itemId, qty int) Money {
+  if o.Tax == nil {
+    return 0
+  }
+
+  var discount Money
+  orderedQty := 0
+  for _, line := range o.Tax.Lines {
+    if line.Id == itemId {
+      discount += line.Discount
+      orderedQty += line.Qty
+    }
+  }
+
+  if orderedQty == 0 {
+    return 0
+  }
+  return discount * Money(qty) / Money(orderedQty)
+}
+
+func (l *DiscountLines) Scan(src interface{}) error {
+  switch src.(type) {
+  case string:
+    return json.Unmarshal([]byte(src.(string)), l)
+  case []byte:
+    return json.Unmarshal(src.([]byte), l)
+  default:
+    return errors.New("Incompatible type for DiscountLines")
+  }
+}
+
+func (l DiscountLines) Value() (driver.Value, error) {
+  data, err := json.Marshal(l)
+  return string(data), err
+}
+
+
+func getPromotions(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+
+  var promotions []Promotion
+  checkError(tx.Where("restaurant_id=?", restaurantID).Order("id").Find(&promotions).Error)
+
+  var uses []struct {
+    PromotionID uint
+    Count int
+  }
+  checkError(tx.Table("promotion_uses").
+    Select("promotion_id, count(*) AS count").
+    Where("restaurant_id=?", restaurantID).
+    Group("promotion_id").
+    Scan(&uses).Error)
+
+  type promotionSummary struct {
+    ID uint
+    Name string
+    Code string
+    Kind string
+    Value string
+    StartsOn string
+    EndsOn string
+    Enabled bool
+    Uses int
+  }
+
+  flags := struct {
+    Url string
+    Promotions []promotionSummary
+  }{
+    fmt.Sprintf("/admin/restaurants/%d/promotions", restaurantID),
+    []promotionSummary{},
+  }
+
+  for _, p := range promotions {
+    summary := promotionSummary{p.ID, p.Name, p.Code, p.Kind, p.Value, p.StartsOn, p.EndsOn, p.Enabled == "yes", 0}
+    for _, use := range uses {
+      if use.PromotionID == p.ID {
+        summary.Uses = use.Count
+      }
+    }
+    flags.Promotions = append(flags.Promotions, summary)
+  }
+
+  templates.ElmApp(w, req, "Promotions", flags)
+}
+
+
+// Edits promotions at /admin/restaurants/{restaurantID}/promotions/{id}
+type EditPromotionForm struct {}
+
+func NewEditPromotionForm() ef.Form {
+  return new(EditPromotionForm)
+}
+
+func (f *EditPromotionForm) New() interface{} {
+  return &Promotion{Kind: DiscountPercent, Enabled: "yes", FirstOrderOnly: "no"}
+}
+
+func promotionsUrl(req *http.Request) string {
+  return "/admin/restaurants/" + mux.Vars(req)["restaurantID"] + "/promotions"
+}
+
+func (f *EditPromotionForm) Layout(fi *ef.Instance) ef.Layout {
+  return ef.NewLayout(
+      "Promotion",
+      promotionsUrl(fi.Request),
+      promotionsUrl(fi.Request),
+      ef.Group("",
+        ef.Text("Name", "Name"),
+        ef.Text("Code", "Promo Code"),
+        ef.Text("Enabled", "Enabled")),
+      ef.Group("Kind is percent, amount or free-item, the value is the percentage, amount or menu item id",
+        ef.Text("Kind", "Kind"),
+        ef.Text("Value", "Value")),
+      ef.Group("Leave the code empty to apply automatically, and limits empty or 0 for no limit",
+        ef.Text("Items", "Menu Item Ids"),
+        ef.Text("MinSpend", "Minimum Spend"),
+        ef.Text("StartsOn", "Starts On"),
+        ef.Text("EndsOn", "Ends On"),
+        ef.Text("FirstOrderOnly", "First Order Only"),
+        ef.Text("UsesPerCustomer", "Uses Per Customer"),
+        ef.Text("MaxUses", "Total Uses")))
+}
+
+func (f *EditPromotionForm) Validate(fi *ef.Instance) {
+  restaurantID, err := strconv.Atoi(mux.Vars(fi.Request)["restaurantID"])
+  if err != nil {
+    panic(templates.BadRequest("Expecting integer restaurant id"))
+  }
+  fi.Data.(*Promotion).RestaurantID = uint(restaurantID)
+
+  fi.Validate("Name", "Name", ef.Trim, ef.Required)
+  fi.Validate("Code", "Promo Code", ef.Trim, validPromoCode)
+  fi.Validate("Enabled", "Enabled", ef.Trim, validYesNo)
+  fi.Validate("Kind", "Kind", ef.Trim, validDiscountKind)
+  fi.Validate("Value", "Value", ef.Trim, ef.Required, validDiscountValue(fi.Submission["Kind"]))
+  fi.Validate("Items", "Menu Item Ids", ef.Trim, validItemIds)
+  fi.Validate("MinSpend", "Minimum Spend", ef.Trim, validAmount)
+  fi.Validate("StartsOn", "Starts On", ef.Trim, validDate)
+  fi.Validate("EndsOn", "Ends On", ef.Trim, validDate)
+  fi.Validate("FirstOrderOnly", "First Order Only", ef.Trim, validYesNo)
+  fi.Validate("UsesPerCustomer", "Uses Per Customer", ef.Trim, validLimit)
+  fi.Validate("MaxUses", "Total Uses", ef.Trim, validLimit)
+}
+
+// Codes are matched ignoring case, they are stored in upper case to read clearly
+func validPromoCode(value string) (string, string) {
+  if strings.ContainsAny(value, " \t") {
+    return value, "%s cannot contain spaces."
+  }
+  return strings.ToUpper(value), ""
+}
+
+func validYesNo(value string) (string, string) {
+  if value != "yes" && value != "no" {
+    return value, "%s must be yes or no."
+  }
+  return value, ""
+}
+
+func validDiscountKind(value string) (string, string) {
+  if !contains(DiscountKinds, value) {
+    return value, "%s must be one of " + strings.Join(DiscountKinds, ", ") + "."
+  }
+  return value, ""
+}
+
+func validDiscountValue(kind string) ef.Validator {
+  return func(value string) (string, string) {
+    switch strings.TrimSpace(kind) {
+    case DiscountPercent:
+      return validTaxRate(value)
+    case DiscountFreeItem:
+      if _, err := strconv.Atoi(value); err != nil {
+        return value, "%s must be the id of the free menu item."
+      }
+      return value, ""
+    default:
+      return validAmount(value)
+    }
+  }
+}
+
+func validItemIds(value string) (string, string) {
+  if _, err := parseItemIds(value); err != nil {
+    return value, "%s must be menu item ids separated by commas."
+  }
+  return value, ""
+}
+
+// The restaurant's currency decides how many decimal places are allowed, which is checked when it is used
+func validAmount(value string) (string, string) {
+  if value == "" {
+    return value, ""
+  }
+  if amount, err := strconv.ParseFloat(value, 64); err != nil || amount < 0 {
+    return value, "%s must be an amount such as 5.00."
+  }
+  return value, ""
+}
+
+func validDate(value string) (string, string) {
+  if value == "" {
+    return value, ""
+  }
+  if _, err := time.Parse(reportDateFormat, value); err != nil {
+    return value, "%s must be a date as YYYY-MM-DD."
+  }
+  return value, ""
+}
+
+func validLimit(value string) (string, string) {
+  if value == "" {
+    return value, ""
+  }
+  if limit, err := strconv.Atoi(value); err != nil || limit < 0 {
+    return value, "%s must be a whole number."
+  }
+  return value, ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestRecalcDiscounts(t *testing.T) {
+  tenPercent := Discount{PromotionID: 1, Name: "10% off", Kind: "percent", Percent: 1000}
+  fiveOff := Discount{PromotionID: 2, Name: "$5 off", Kind: "amount", Amount: 500}
+  fiveOffChips := Discount{PromotionID: 3, Name: "$5 off chips", Kind: "amount", Amount: 500, ItemIds: []int{2}}
+  freeBurger := Discount{PromotionID: 4, Name: "Free burger", Kind: "free-item", ItemIds: []int{1}}
+  bigSpender := Discount{PromotionID: 5, Name: "10% off $50", Kind: "percent", Percent: 1000, MinSpend: 5000}
+
+  tests := []struct {
+    name string
+    rules TaxRules
+    discounts []Discount
+    amounts []Money
+    gst Money
+    total Money
+    lineDiscount []Money
+    lineTax []Money
+  }{
+    {"percent", testTaxRules(true, "half-up"), []Discount{tenPercent}, []Money{265}, 311, 2385, []Money{230, 35}, []Money{270, 41}},
+    {"percent before exclusive tax", testTaxRules(false, "half-up"), []Discount{tenPercent}, []Money{265}, 358, 2743, []Money{230, 35}, []Money{311, 47}},
+    {"amount capped at the item", testTaxRules(true, "half-up"), []Discount{fiveOffChips}, []Money{350}, 300, 2300, []Money{0, 350}, []Money{300, 0}},
+    {"free item", testTaxRules(true, "half-up"), []Discount{freeBurger}, []Money{1150}, 196, 1500, []Money{1150, 0}, []Money{150, 46}},
+    {"minimum spend not reached", testTaxRules(true, "half-up"), []Discount{bigSpender}, []Money{}, 346, 2650, []Money{0, 0}, []Money{300, 46}},
+    {"stacked", testTaxRules(true, "half-up"), []Discount{tenPercent, fiveOff}, []Money{265, 500}, 246, 1885, []Money{663, 102}, []Money{214, 32}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      order := Order{Menu: testMenu(), Items: OrderItems{{Id: 1, Qty: 2}, {Id: 2, Qty: 1}}}
+      order.Recalc(Pricing{Tax: test.rules, Currency: "NZD", Discounts: test.discounts})
+
+      if order.GST != test.gst || order.Total != test.total {
+        t.Errorf("Expecting GST %d and total %d, received GST %d and total %d", test.gst, test.total, order.GST, order.Total)
+      }
+
+      if len(order.Discounts) != len(test.amounts) {
+        t.Fatalf("Expecting %d discounts, received %#v", len(test.amounts), order.Discounts)
+      }
+      for i, discount := range order.Discounts {
+        if discount.Amount != test.amounts[i] {
+          t.Errorf("Expecting %d off for %s, received %d", test.amounts[i], discount.Name, discount.Amount)
+        }
+      }
+
+      for i, line := range order.Tax.Lines {
+        if line.Discount != test.lineDiscount[i] || line.Tax != test.lineTax[i] {
+          t.Errorf("Expecting discount %d and tax %d on line %d, received discount %d and tax %d",
+            test.lineDiscount[i], test.lineTax[i], i, line.Discount, line.Tax)
+        }
+      }
+    })
+  }
+}
@@ -0,0 +1,255 @@
+package main
+
+// Restaurants can be reached at their own domain as well as slug.DomainName.
+// The restaurant proves it controls the domain with a TXT record holding a
+// token, then the subdomain redirects to the domain. Until then the domain
+// redirects to the subdomain, so pointing DNS at us early doesn't break it.
+// The router looks hosts up in a table kept in memory rather than querying
+// for every request.
+
+import (
+  "encoding/json"
+  "log"
+  "net"
+  "net/http"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+  ef "feedme/server/editform"
+  "github.com/jinzhu/gorm"
+)
+
+// The TXT record is at this name under the domain
+const domainVerificationPrefix = "_feedme."
+
+const domainRefreshInterval = time.Minute
+
+// Kept out of Restaurant so saving the edit form doesn't clobber the verification
+type RestaurantDomain struct {
+  RestaurantID uint `gorm:"primary_key"`
+  Domain string `gorm:"not null"`
+  Token string `gorm:"not null"`
+  VerifiedAt *time.Time
+}
+
+type DomainResult struct {
+  Status string
+  Error string
+}
+
+// Looks up TXT records, FakeTXTRecords in config.json replaces DNS for development
+type TXTResolver interface {
+  LookupTXT(name string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+  return net.LookupTXT(name)
+}
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+  records, ok := r[name]
+  if !ok {
+    return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+  }
+  return records, nil
+}
+
+var resolver TXTResolver
+
+func initResolver() {
+  if Config.FakeTXTRecords != nil {
+    log.Printf("Using FakeTXTRecords instead of DNS for custom domains")
+    resolver = fakeResolver(Config.FakeTXTRecords)
+  } else {
+    resolver = netResolver{}
+  }
+}
+
+type domainEntry struct {
+  RestaurantID uint
+  Slug string
+  Domain string
+  Verified bool
+}
+
+type domainTable struct {
+  sync.RWMutex
+  byDomain map[string]domainEntry
+  bySlug map[string]domainEntry
+}
+
+var customDomains domainTable
+
+func (t *domainTable) load(db *gorm.DB) error {
+  var entries []domainEntry
+  err := db.Table("restaurant_domains").
+    Select("restaurant_domains.restaurant_id, restaurants.slug, restaurant_domains.domain, restaurant_domains.verified_at IS NOT NULL AS verified").
+    Joins("JOIN restaurants ON restaurants.id = restaurant_domains.restaurant_id").
+    Scan(&entries).Error
+  if err != nil {
+    return err
+  }
+
+  byDomain := make(map[string]domainEntry)
+  bySlug := make(map[string]domainEntry)
+  for _, entry := range entries {
+    byDomain[entry.Domain] = entry
+    bySlug[entry.Slug] = entry
+  }
+
+  t.Lock()
+  defer t.Unlock()
+  t.byDomain = byDomain
+  t.bySlug = bySlug
+  return nil
+}
+
+func (t *domainTable) lookup(host string) (domainEntry, bool) {
+  t.RLock()
+  defer t.RUnlock()
+  entry, ok := t.byDomain[host]
+  return entry, ok
+}
+
+// The verified domain for the restaurant, "" when it only has the subdomain.
+// With TLS on the domain also needs a certificate, otherwise sending
+// customers there would take the restaurant offline.
+func (t *domainTable) verifiedDomain(slug string) string {
+  t.RLock()
+  defer t.RUnlock()
+  if entry, ok := t.bySlug[slug]; ok && entry.Verified && canServeHost(entry.Domain) {
+    return entry.Domain
+  }
+  return ""
+}
+
+// Loads the table now and then reloads it regularly, so domains changed by
+// other servers, or removed from the edit form, are picked up
+func startDomainRefresher(db *gorm.DB) {
+  checkError(customDomains.load(db))
+
+  go func() {
+    for {
+      time.Sleep(domainRefreshInterval)
+      err := customDomains.load(db)
+      if err != nil {
+        log.Printf("Loading custom domains: %s", err)
+      }
+    }
+  }()
+}
+
+// Redirects to the restaurant's canonical host, returns false when the request is already there
+func canonicalHostRedirect(w http.ResponseWriter, req *http.Request) bool {
+  // Only pages, a redirected POST would lose its body
+  if req.Method != "GET" && req.Method != "HEAD" {
+    return false
+  }
+
+  host := hostname(req)
+  var canonical string
+
+  if entry, ok := customDomains.lookup(host); ok {
+    if entry.Verified {
+      return false
+    }
+    canonical = entry.Slug + "." + Config.DomainName
+  } else if slug, ok := slugFromHostname(host); ok {
+    canonical = customDomains.verifiedDomain(slug)
+    if canonical == "" {
+      return false
+    }
+  } else {
+    return false
+  }
+
+  http.Redirect(w, req, urlScheme() + "://" + canonical + port(req) + req.URL.RequestURI(), http.StatusMovedPermanently)
+  return true
+}
+
+func (r *Restaurant) AfterSave(tx *gorm.DB) error {
+  return syncRestaurantDomain(tx, r)
+}
+
+// Starts verification again whenever the domain is changed
+func syncRestaurantDomain(tx *gorm.DB, r *Restaurant) error {
+  var domain RestaurantDomain
+  err := tx.Where("restaurant_id=?", r.ID).First(&domain).Error
+  if err != nil && !gorm.IsRecordNotFoundError(err) {
+    return err
+  }
+  if err == nil && domain.Domain == r.CustomDomain {
+    return nil
+  }
+
+  err = tx.Where("restaurant_id=?", r.ID).Delete(RestaurantDomain{}).Error
+  if err != nil || r.CustomDomain == "" {
+    return err
+  }
+
+  return tx.Create(&RestaurantDomain{
+    RestaurantID: r.ID,
+    Domain: r.CustomDomain,
+    Token: randomToken(),
+  }).Error
+}
+
+func domainVerificationName(domain string) string {
+  return domainVerificationPrefix + domain
+}
+
+// The domain is used from the next refresh of the table, which only sees it
+// once this transaction has committed
+func postVerifyDomain(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+
+  var domain RestaurantDomain
+  checkError(tx.Where("restaurant_id=?", restaurantID).First(&domain).Error)
+
+  records, err := resolver.LookupTXT(domainVerificationName(domain.Domain))
+  if err != nil {
+    log.Printf("Looking up TXT record for %s: %s", domain.Domain, err)
+  }
+
+  verified := false
+  for _, record := range records {
+    if strings.TrimSpace(record) == domain.Token {
+      verified = true
+    }
+  }
+
+  if !verified {
+    json.NewEncoder(w).Encode(DomainResult{
+      Status: "ERR",
+      Error: "The TXT record for " + domainVerificationName(domain.Domain) + " was not found, DNS changes can take a while to appear.",
+    })
+    return
+  }
+
+  now := time.Now()
+  checkError(tx.Model(&domain).Update("verified_at", &now).Error)
+
+  json.NewEncoder(w).Encode(DomainResult{Status: "OK"})
+}
+
+var hostnameRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+func validCustomDomain(value string) (string, string) {
+  value = strings.TrimSuffix(strings.ToLower(value), ".")
+  if value == "" {
+    return value, ""
+  }
+
+  if len(value) > 253 || !hostnameRegexp.MatchString(value) {
+    return value, "%s must be a domain name such as order.example.com."
+  }
+  if value == Config.DomainName || strings.HasSuffix(value, "." + Config.DomainName) {
+    return value, "%s must not be under " + Config.DomainName + ", use the Slug for that."
+  }
+  return value, ""
+}
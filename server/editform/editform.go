@@ -10,6 +10,7 @@ import (
   "feedme/server/templates"
   "reflect"
   "log"
+  "regexp"
   "strings"
   "time"
  )
@@ -24,6 +25,10 @@ type Instance struct {
   Form Form
   Id uint
   Data interface{}
+  Request *http.Request
+
+  // The request's transaction, for validators that look at other rows
+  Tx *gorm.DB
 
   Submission map[string]string
   Errors map[string][]string
@@ -38,6 +43,8 @@ func Handler(factory FormFactory) HandlerFunc {
     f := factory()
     fi := new(Instance)
     fi.Form = f
+    fi.Request = req
+    fi.Tx = tx
 
     fi.Id = GetId(req)
 
@@ -218,6 +225,37 @@ func Trim(value string) (string, string) {
   return strings.TrimSpace(value), ""
 }
 
+func Lowercase(value string) (string, string) {
+  return strings.ToLower(value), ""
+}
+
+var dnsLabelRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Values used as a subdomain must be a single lowercase DNS label
+func DNSLabel(value string) (string, string) {
+  if value != "" && !dnsLabelRegexp.MatchString(value) {
+    return value, "%s may only contain lowercase letters, numbers and hyphens, must not start or end with a hyphen, and must be at most 63 characters."
+  }
+  return value, ""
+}
+
+// Rejects a value another row of table already has in column. Blank values
+// are left to Required.
+func (fi *Instance) Unique(table, column string) Validator {
+  return func(value string) (string, string) {
+    if value == "" {
+      return value, ""
+    }
+
+    var count int
+    checkError(fi.Tx.Table(table).Where(column + "=? AND id<>?", value, fi.Id).Count(&count).Error)
+    if count > 0 {
+      return value, "%s is already in use."
+    }
+    return value, ""
+  }
+}
+
 func checkError(err error) {
   if err != nil {
     panic(err)
@@ -6,6 +6,6 @@ import (
   "github.com/jinzhu/gorm"
 )
 
-func getFeedmeHome(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string) {
+func getFeedmeHome(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
   fmt.Fprintf(w, "<h1>Feedme</h1")
 }
@@ -9,58 +9,194 @@ import (
   "github.com/jinzhu/gorm"
   "log"
   "feedme/server/sse"
+  "feedme/server/images"
+  "feedme/server/webhooks"
+  "feedme/server/payments"
+  "feedme/server/challenge"
   "time"
+  "strconv"
+  "strings"
+  "github.com/gorilla/mux"
 )
 
-func getFrontEnd(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
+func getFrontEnd(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
   menu := fetchMenuForRestaurantID(tx, restaurant.ID)
 
   if menu == nil {
     menu = &Menu{Items: []MenuItem{}}
   }
 
+  var reorder *Reorder
+  if token := req.URL.Query().Get("reorder"); token != "" {
+    if order := fetchOrderByToken(tx, restaurant.ID, token); order != nil {
+      rebuilt := rebuildOrder(&order.Order, menu)
+      reorder = &rebuilt
+    }
+  }
+
   flags := struct {
     Restaurant *Restaurant
+    Customer *Customer
+    Reorder *Reorder
+    Logo images.Image
     MenuID uint
     Menu MenuItems
     GoogleStaticMapsKey string
+    PaymentsEnabled bool
+    PricesIncludeTax bool
+    TipOptions []int
+    Challenge *challenge.Challenge
+    DietaryTags []string
+    Allergens []string
+    MaxSpiceLevel int
   }{
     restaurant,
+    fetchSessionCustomer(tx, session),
+    reorder,
+    fetchRestaurantLogo(tx, restaurant.ID),
     menu.ID,
     menu.Items,
     Config.GoogleStaticMapsKey,
+    payments.Enabled(),
+    fetchTaxRules(tx, restaurant.ID).Inclusive,
+    restaurant.tipOptions(),
+    issueChallenge(),
+    DietaryTags,
+    Allergens,
+    MaxSpiceLevel,
   }
 
   templates.ElmApp(w, req, "FrontEnd.Main", flags)
 }
 
+// Public JSON menu, can be filtered with the query parameters:
+//   diet=Vegan - only items with all the given dietary tags, may be repeated
+//   exclude=Nuts - omit items containing the given allergen, may be repeated
+//   maxSpice=1 - omit items hotter than the given spice level
+func getMenuApi(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  menu := fetchMenuForRestaurantID(tx, restaurant.ID)
+
+  if menu == nil {
+    menu = &Menu{Items: []MenuItem{}}
+  }
+
+  result := struct {
+    MenuID uint
+    Menu MenuItems
+  }{
+    menu.ID,
+    menu.Items.Filter(parseMenuFilter(req)),
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  checkError(json.NewEncoder(w).Encode(result))
+}
+
+func parseMenuFilter(req *http.Request) MenuFilter {
+  query := req.URL.Query()
+  filter := MenuFilter{
+    Dietary: query["diet"],
+    ExcludeAllergens: query["exclude"],
+    MaxSpiceLevel: MaxSpiceLevel,
+  }
+
+  for _, tag := range filter.Dietary {
+    if !contains(DietaryTags, tag) {
+      panic(templates.BadRequest("Unknown dietary tag: " + tag))
+    }
+  }
+
+  for _, allergen := range filter.ExcludeAllergens {
+    if !contains(Allergens, allergen) {
+      panic(templates.BadRequest("Unknown allergen: " + allergen))
+    }
+  }
+
+  if maxSpice := query.Get("maxSpice"); maxSpice != "" {
+    level, err := strconv.Atoi(maxSpice)
+    if err != nil {
+      panic(templates.BadRequest("Expecting integer maxSpice, received: " + maxSpice))
+    }
+    filter.MaxSpiceLevel = level
+  }
+
+  return filter
+}
+
+
+// Redirects to the tracking page for the session's latest order, for old bookmarks
+func getFrontEndStatus(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  order := fetchLatestOrder(tx, restaurant.ID, session.ID)
+
+  if order == nil {
+    http.NotFound(w, req)
+    return
+  }
+
+  http.Redirect(w, req, order.TrackingURL(), http.StatusSeeOther)
+}
 
-func getFrontEndStatus(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
-  order := fetchLatestOrder(tx, restaurant.ID, sessionID)
+func getOrderStatus(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  order := fetchOrderByToken(tx, restaurant.ID, mux.Vars(req)["token"])
 
   if order == nil {
+    http.NotFound(w, req)
+    return
+  }
 
+  // Only the browser that placed the order can cancel it
+  var cancelUntil *time.Time
+  if order.SessionID == session.ID {
+    until := order.CreatedAt.Add(cancelWindow())
+    cancelUntil = &until
   }
 
   flags := struct {
     Restaurant *Restaurant
     Menu MenuItems
+    Number uint
+    DisplayNumber uint
     Order OrderItems
+    Discounts DiscountLines
+    Charges ChargeLines
+    ExclusiveTax Money
+    Total Money
     Status string
     StatusDate *time.Time
+    CancelUntil *time.Time
+    PaymentPending bool
+    Refunds []Refund
+    StreamURL string
+    RecentOrders []OrderSummary
   }{
     order.Menu.Restaurant,
     order.Menu.Items,
+    order.Number,
+    order.DisplayNumber,
     order.Items,
+    order.Discounts,
+    order.Charges,
+    order.exclusiveTax(),
+    order.Total,
     order.Status,
     order.StatusDate,
+    cancelUntil,
+    order.PaymentStatus == PaymentPending,
+    fetchRefunds(tx, restaurant.ID, order.Number),
+    order.TrackingURL() + "/stream",
+    fetchRecentOrders(tx, restaurant.ID, session.ID),
   }
 
   templates.ElmApp(w, req, "FrontEnd.Status", flags)
 }
 
-func getFrontEndStatusStream(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
-  order := fetchLatestOrder(tx, restaurant.ID, sessionID)
+func getOrderStatusStream(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  order := fetchOrderByToken(tx, restaurant.ID, mux.Vars(req)["token"])
+
+  if order == nil {
+    http.NotFound(w, req)
+    return
+  }
 
   initialEvent := sse.Event{
     "statusUpdate",
@@ -69,6 +205,7 @@ func getFrontEndStatusStream(w http.ResponseWriter, req *http.Request, tx *gorm.
       Number: order.Number,
       Status: order.Status,
       StatusDate: order.StatusDate,
+      CancelReason: order.CancelReason,
   }}
 
   sse.Stream(w, []sse.Event{initialEvent}, restaurantOrderStreamKey{order.RestaurantID, order.Number})
@@ -78,45 +215,206 @@ func getFrontEndStatusStream(w http.ResponseWriter, req *http.Request, tx *gorm.
 type OrderResult struct {
   Status string
   Error string
+  TrackingURL string `json:",omitempty"`
+  Number uint `json:",omitempty"`
+  PaymentIntentID string `json:",omitempty"`
+  ClientSecret string `json:",omitempty"`
+
+  // A new challenge when the last one failed, or for requesting a phone
+  // verification code
+  Challenge *challenge.Challenge `json:",omitempty"`
 }
 
-func postPlaceOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
-  var order OrderWithSessionID
+// The parts of an order the customer's browser sends, everything else is
+// worked out here so a client can't set IDs, totals or the customer
+type PlaceOrderRequest struct {
+  Name string
+  Telephone string
+  PromoCode string
+  Tip TipChoice
+  Challenge ChallengeResponse
+  MenuID uint
+  Items OrderItems
+}
+
+func postPlaceOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  var placeOrder PlaceOrderRequest
 
   body, _ := ioutil.ReadAll(req.Body)
-  checkError(json.Unmarshal(body, &order))
-  fmt.Printf("Order: %#v", order)
+  checkError(json.Unmarshal(body, &placeOrder))
+  fmt.Printf("Order: %#v", placeOrder)
+
+  var order OrderWithSessionID
+  order.Name = placeOrder.Name
+  order.Telephone = placeOrder.Telephone
+  order.PromoCode = placeOrder.PromoCode
+  order.Tip = placeOrder.Tip
+  order.MenuID = placeOrder.MenuID
+  order.Items = placeOrder.Items
+
   order.Menu = fetchMenu(tx, order.MenuID)
-  order.RestaurantID = order.Menu.RestaurantID
-  order.SessionID = sessionID
+  if order.Menu.RestaurantID != restaurant.ID {
+    panic(templates.BadRequest("Menu is not for this restaurant"))
+  }
+  order.RestaurantID = restaurant.ID
+  order.SessionID = session.ID
   order.Status = "New"
   order.CreatedAt = time.Now()
   order.StatusDate = &order.CreatedAt
+  order.TrackingToken = randomToken()
+  order.PaymentStatus = PaymentNotRequired
+  order.PromoCode = strings.ToUpper(strings.TrimSpace(order.PromoCode))
+  order.ClientIP = clientIP(req)
+  order.NormalisedTelephone = normaliseLogin(order.Telephone)
+
+  if isBlockedNumber(tx, restaurant.ID, order.NormalisedTelephone) {
+    log.Printf("Refused order from blocked number %s", order.NormalisedTelephone)
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: blockedMessage})
+    return
+  }
 
-  order.Recalc()
+  if limitError := orderLimitError(tx, &order); limitError != "" {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: limitError})
+    return
+  }
+
+  customer := fetchSessionCustomer(tx, session)
+  if customer != nil {
+    order.CustomerID = &customer.ID
+  }
+
+  // The customer is asked for a code texted to the number and then places the order again
+  if restaurant.requiresVerifiedPhone() && !isPhoneVerified(tx, session.ID, customer, order.NormalisedTelephone) {
+    json.NewEncoder(w).Encode(OrderResult{Status: "VERIFY", Error: "Please verify your phone number.", Challenge: issueChallenge()})
+    return
+  }
+
+  discounts, promoError := fetchDiscounts(tx, restaurant, &order)
+  if promoError != "" {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: promoError})
+    return
+  }
+
+  if !restaurant.validTip(order.Tip) {
+    panic(templates.BadRequest("Tips are not accepted or the tip is not one of the options offered"))
+  }
 
-  query := "UPDATE restaurant_order_numbers SET last_order_number=last_order_number+1 WHERE restaurant_id=$1 RETURNING last_order_number"
-  checkError(tx.CommonDB().QueryRow(query, order.RestaurantID).Scan(&order.Number))
+  order.Recalc(Pricing{
+    Tax: fetchTaxRules(tx, restaurant.ID),
+    Currency: restaurant.Currency,
+    Discounts: discounts,
+    Surcharges: fetchSurchargeRules(tx, restaurant, payments.Enabled()),
+    Tip: order.Tip,
+  })
+
+  if order.PromoCode != "" && !order.Discounts.hasCode(order.PromoCode) {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "That promo code does not apply to this order."})
+    return
+  }
+
+  // Checked last as challenges can only be answered once
+  if !verifyChallenge(req, placeOrder.Challenge) {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: challengeMessage, Challenge: issueChallenge()})
+    return
+  }
+
+  order.Suspicious = suspicionFlags(tx, restaurant, &order)
+
+  // Promotions can make an order free, there is nothing to pay then
+  if payments.Enabled() && order.Total > 0 {
+    order.PaymentStatus = PaymentPending
+  }
+
+  if customer != nil {
+    customer.rememberDetails(tx, order.Name, order.Telephone)
+  }
+
+  session.save(tx)
+  order.Number, order.DisplayNumber = nextOrderNumbers(tx, restaurant)
 
   checkError(tx.Table("orders").Create(&order).Error)
+  recordPromotionUses(tx, &order)
 
 
   log.Printf("PlaceOrder:\n%s\n%#v\n", body, order)
 
-  sse.Send(restaurantStreamKey(order.RestaurantID), &sse.Event{"order", &TillOrder{
-    Number: order.Number,
-    Name: order.Name,
-    Telephone: order.Telephone,
-    MenuID: order.MenuID,
-    MenuItems: order.Menu.Items,
-    Items: order.Items,
-    Status: order.Status,
-    StatusDate: order.StatusDate,
-    CreatedAt: order.CreatedAt,
-  }})
+  // Orders needing payment are held back from the till until the money arrives
+  if order.PaymentStatus == PaymentPending {
+    intent := createPaymentIntent(tx, &order)
+    json.NewEncoder(w).Encode(OrderResult{
+      Status: "PAY",
+      TrackingURL: order.TrackingURL(),
+      Number: order.Number,
+      PaymentIntentID: intent.ID,
+      ClientSecret: intent.ClientSecret,
+    })
+    return
+  }
 
-  json.NewEncoder(w).Encode(OrderResult{Status: "OK"})
+  publishNewOrder(tx, &order)
+
+  json.NewEncoder(w).Encode(OrderResult{Status: "OK", TrackingURL: order.TrackingURL()})
 }
 
 
 
+
+func postCancelOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  cancel := struct {
+    Number uint
+    Reason string
+  }{}
+  checkError(json.NewDecoder(req.Body).Decode(&cancel))
+
+  var order OrderWithSessionID
+  checkError(tx.Table("orders").
+    Where("restaurant_id=? AND number=? AND session_id=?", restaurant.ID, cancel.Number, session.ID).
+    First(&order).Error)
+
+  if order.Status != "New" {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "Your order has already been accepted, please telephone the shop to cancel it."})
+    return
+  }
+
+  // An unpaid order hasn't reached the till yet, and the payment could still go through
+  if order.PaymentStatus == PaymentPending {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "Your order has not been paid for yet, so there is nothing to cancel."})
+    return
+  }
+
+  if time.Since(order.CreatedAt) > cancelWindow() {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "It is too late to cancel your order, please telephone the shop."})
+    return
+  }
+
+  // Only cancel if the till has not changed the status, or a payment started, in the meantime
+  result := tx.Table("orders").
+    Where("restaurant_id=? AND number=? AND status='New' AND payment_status<>?", restaurant.ID, order.Number, PaymentPending).
+    Updates(map[string]interface{}{"status": "Cancelled", "status_date": nil, "cancel_reason": cancel.Reason})
+  checkError(result.Error)
+
+  if result.RowsAffected == 0 {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "Your order has already been accepted, please telephone the shop to cancel it."})
+    return
+  }
+
+  refundUnservedOrder(tx, &order.Order, "Order cancelled by customer")
+
+  update := &OrderStatusUpdate{
+    RestaurantID: order.RestaurantID,
+    Number: order.Number,
+    Status: "Cancelled",
+    CancelReason: cancel.Reason,
+  }
+  webhooks.Fire(tx, order.RestaurantID, webhooks.OrderStatusChanged, update)
+
+  event := &sse.Event{"statusUpdate", update}
+  sse.Send(restaurantOrderStreamKey{order.RestaurantID, order.Number}, event)
+  sse.Send(restaurantStreamKey(order.RestaurantID), event)
+
+  json.NewEncoder(w).Encode(OrderResult{Status: "OK"})
+}
+
+func cancelWindow() time.Duration {
+  return time.Duration(Config.CancelWindowMinutes) * time.Minute
+}
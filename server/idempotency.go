@@ -0,0 +1,157 @@
+package main
+
+// Clients can send an Idempotency-Key header so a retry after a network
+// failure gets the response to the original request instead of repeating it.
+// Keys are claimed with an insert on a unique index in the request's
+// transaction, so when the same key arrives twice at once the second request
+// waits for the first to commit and then replays its response, or claims the
+// key itself if the first rolled back.
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "strings"
+  "time"
+  "feedme/server/templates"
+  "github.com/jinzhu/gorm"
+)
+
+const maxIdempotencyKeyLength = 255
+
+type IdempotencyKey struct {
+  ID uint
+  SessionID string `gorm:"not null"`
+  Key string `gorm:"not null"`
+
+  // Of the method, path and body, a key can't be reused for a different request
+  RequestHash string `gorm:"not null"`
+
+  StatusCode int
+  ContentType string
+  Body string
+  CompletedAt *time.Time
+
+  CreatedAt time.Time
+}
+
+// Captures the handler's response so it can be stored before it is sent
+type responseRecorder struct {
+  header http.Header
+  statusCode int
+  body bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+  return r.header
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+  return r.body.Write(data)
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+  r.statusCode = statusCode
+}
+
+func (r *responseRecorder) copyTo(w http.ResponseWriter) {
+  for name, values := range r.header {
+    w.Header()[name] = values
+  }
+  w.WriteHeader(r.statusCode)
+  w.Write(r.body.Bytes())
+}
+
+func Idempotent(handler RestaurantHandlerFunc) RestaurantHandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+    key := strings.TrimSpace(req.Header.Get("Idempotency-Key"))
+    if key == "" {
+      handler(w, req, tx, session, restaurant)
+      return
+    }
+    if len(key) > maxIdempotencyKeyLength {
+      panic(templates.BadRequest("Idempotency-Key is too long"))
+    }
+
+    body, err := ioutil.ReadAll(req.Body)
+    checkError(err)
+    req.Body = ioutil.NopCloser(bytes.NewReader(body))
+    hash := fmt.Sprintf("%x", sha256.Sum256([]byte(req.Method + " " + req.URL.Path + "\n" + string(body))))
+
+    if !claimIdempotencyKey(tx, session.ID, key, hash) {
+      replayIdempotentResponse(w, tx, session.ID, key, hash)
+      return
+    }
+
+    recorder := &responseRecorder{header: make(http.Header), statusCode: http.StatusOK}
+    handler(recorder, req, tx, session, restaurant)
+
+    now := time.Now()
+    checkError(tx.Model(&IdempotencyKey{}).
+      Where("session_id=? AND key=?", session.ID, key).
+      Updates(map[string]interface{}{
+        "status_code": recorder.statusCode,
+        "content_type": recorder.header.Get("Content-Type"),
+        "body": recorder.body.String(),
+        "completed_at": &now,
+      }).Error)
+
+    recorder.copyTo(w)
+  }
+}
+
+// Returns false when another request already has the key. The insert waits
+// for any other transaction holding the key.
+func claimIdempotencyKey(tx *gorm.DB, sessionID, key, hash string) bool {
+  checkError(tx.Where("session_id=? AND key=? AND created_at<?", sessionID, key, idempotencyCutoff()).
+    Delete(IdempotencyKey{}).Error)
+
+  result := tx.Exec(
+    "INSERT INTO idempotency_keys (session_id, key, request_hash, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (session_id, key) DO NOTHING",
+    sessionID, key, hash, time.Now())
+  checkError(result.Error)
+
+  return result.RowsAffected == 1
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, tx *gorm.DB, sessionID, key, hash string) {
+  var stored IdempotencyKey
+  checkError(tx.Where("session_id=? AND key=?", sessionID, key).First(&stored).Error)
+
+  if stored.RequestHash != hash {
+    panic(templates.BadRequest("Idempotency-Key has already been used for a different request"))
+  }
+
+  if stored.CompletedAt == nil {
+    w.WriteHeader(http.StatusConflict)
+    fmt.Fprintln(w, "409 A request with this Idempotency-Key is still in progress")
+    return
+  }
+
+  if stored.ContentType != "" {
+    w.Header().Set("Content-Type", stored.ContentType)
+  }
+  w.Header().Set("Idempotent-Replayed", "true")
+  w.WriteHeader(stored.StatusCode)
+  fmt.Fprint(w, stored.Body)
+}
+
+func idempotencyCutoff() time.Time {
+  return time.Now().Add(-time.Duration(Config.IdempotencyRetentionHours) * time.Hour)
+}
+
+// Forgets keys after the retention window, hourly
+func startIdempotencyPurger(db *gorm.DB) {
+  go func() {
+    for {
+      err := db.Where("created_at<?", idempotencyCutoff()).Delete(IdempotencyKey{}).Error
+      if err != nil {
+        log.Printf("Purging idempotency keys: %s", err)
+      }
+      time.Sleep(time.Hour)
+    }
+  }()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+  "github.com/jinzhu/gorm"
+)
+
+// Needs a Postgres database, e.g. FEEDME_TEST_DB="dbname=feedme_test sslmode=disable"
+func testDB(t *testing.T) *gorm.DB {
+  source := os.Getenv("FEEDME_TEST_DB")
+  if source == "" {
+    t.Skip("FEEDME_TEST_DB is not set")
+  }
+
+  db := openDB(source)
+  db.LogMode(false)
+  return db
+}
+
+func TestIdempotentConcurrentReplay(t *testing.T) {
+  db := testDB(t)
+  defer db.Close()
+
+  sessionID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+  defer db.Where("session_id=?", sessionID).Delete(IdempotencyKey{})
+
+  var calls int32
+  claimed := make(chan struct{}, 1)
+  handler := Idempotent(func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+    atomic.AddInt32(&calls, 1)
+    claimed <- struct{}{}
+
+    // Hold the key while the other request arrives
+    time.Sleep(200 * time.Millisecond)
+    w.Header().Set("Content-Type", "application/json")
+    fmt.Fprint(w, `{"status":"OK"}`)
+  })
+
+  request := func() *httptest.ResponseRecorder {
+    tx := db.Begin()
+    defer tx.Rollback()
+
+    req := httptest.NewRequest("POST", "/till/updateOrder", strings.NewReader(`{"Id":1,"Status":"Ready"}`))
+    req.Header.Set("Idempotency-Key", "update-1")
+    w := httptest.NewRecorder()
+    handler(w, req, tx, &Session{ID: sessionID}, nil)
+
+    checkError(tx.Commit().Error)
+    return w
+  }
+
+  var first, second *httptest.ResponseRecorder
+  var wg sync.WaitGroup
+  wg.Add(2)
+  go func() {
+    defer wg.Done()
+    first = request()
+  }()
+  go func() {
+    defer wg.Done()
+    <-claimed
+    second = request()
+  }()
+  wg.Wait()
+
+  if calls != 1 {
+    t.Errorf("Expecting the handler to run once, it ran %d times", calls)
+  }
+  if first.Code != http.StatusOK || second.Code != http.StatusOK {
+    t.Errorf("Expecting both requests to succeed, received %d and %d", first.Code, second.Code)
+  }
+  if first.Body.String() != second.Body.String() {
+    t.Errorf("Expecting the same response twice, received %q and %q", first.Body.String(), second.Body.String())
+  }
+  if first.Header().Get("Idempotent-Replayed") != "" || second.Header().Get("Idempotent-Replayed") != "true" {
+    t.Error("Expecting only the second response to be a replay")
+  }
+}
@@ -0,0 +1,276 @@
+package images
+
+// Uploaded images (restaurant logos, menu item photos) are resized into a few
+// variants and stored under content hashed names, in the same way tools/hasher
+// handles static assets, so they can be cached forever.
+
+import (
+  "bytes"
+  "crypto/md5"
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "image"
+  "image/color"
+  "image/jpeg"
+  "image/png"
+  _ "image/gif"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+const urlPrefix = "/uploads/"
+const maxPixels = 40000000
+const jpegQuality = 85
+
+var ErrUnsupportedType = errors.New("Image must be a JPEG, PNG or GIF")
+var ErrTooLarge = errors.New("Image dimensions are too large")
+
+// Variants are resized so neither side exceeds the given number of pixels
+var Variants = []struct {
+  Name string
+  MaxSize int
+}{
+  {"small", 160},
+  {"medium", 480},
+  {"large", 1024},
+}
+
+// Image maps variant name to the URL the variant is served from
+type Image map[string]string
+
+var uploadsDir string
+
+func Init(dir string) {
+  uploadsDir = dir
+  checkError(os.MkdirAll(uploadsDir, 0755))
+}
+
+func Handler() http.Handler {
+  fileServer := http.StripPrefix(urlPrefix, http.FileServer(filesOnly{http.Dir(uploadsDir)}))
+
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    fileServer.ServeHTTP(&cacheOnSuccess{ResponseWriter: w}, req)
+  })
+}
+
+// Hides directories, so the uploads can't be listed
+type filesOnly struct {
+  fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+  file, err := f.fs.Open(name)
+  if err != nil {
+    return nil, err
+  }
+
+  info, err := file.Stat()
+  if err != nil || info.IsDir() {
+    file.Close()
+    return nil, os.ErrNotExist
+  }
+  return file, nil
+}
+
+// Filenames change whenever the content does, so files can be cached forever.
+// Errors mustn't be, a missing file may only be missing from this server.
+type cacheOnSuccess struct {
+  http.ResponseWriter
+  wroteHeader bool
+}
+
+func (w *cacheOnSuccess) WriteHeader(status int) {
+  if !w.wroteHeader && (status < 300 || status == http.StatusNotModified) {
+    w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+  }
+  w.wroteHeader = true
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheOnSuccess) Write(data []byte) (int, error) {
+  if !w.wroteHeader {
+    w.WriteHeader(http.StatusOK)
+  }
+  return w.ResponseWriter.Write(data)
+}
+
+func IsUploadURL(url string) bool {
+  return strings.HasPrefix(url, urlPrefix)
+}
+
+// Reads an uploaded image from req, stores its variants and returns their URLs.
+// Errors are problems with the upload, which should be reported as a bad request.
+func Upload(w http.ResponseWriter, req *http.Request, field string, maxBytes int64) (Image, error) {
+  req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
+
+  file, _, err := req.FormFile(field)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  data, err := ioutil.ReadAll(file)
+  if err != nil {
+    return nil, err
+  }
+
+  return Store(data)
+}
+
+func Store(data []byte) (Image, error) {
+  config, format, err := image.DecodeConfig(bytes.NewReader(data))
+  if err != nil {
+    return nil, ErrUnsupportedType
+  }
+
+  // Check dimensions before decoding so a small file cannot expand into a huge bitmap
+  if config.Width * config.Height > maxPixels {
+    return nil, ErrTooLarge
+  }
+
+  src, _, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return nil, ErrUnsupportedType
+  }
+
+  img := make(Image)
+
+  for _, variant := range Variants {
+    resized := fit(src, variant.MaxSize)
+
+    var buf bytes.Buffer
+    var ext string
+
+    // PNGs are kept as PNGs to preserve transparency in logos
+    if format == "png" {
+      ext = ".png"
+      checkError(png.Encode(&buf, resized))
+    } else {
+      ext = ".jpg"
+      checkError(jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality}))
+    }
+
+    name := variant.Name + "-" + contentHash(buf.Bytes()) + ext
+    checkError(writeOnce(filepath.Join(uploadsDir, name), buf.Bytes()))
+    img[variant.Name] = urlPrefix + name
+  }
+
+  return img, nil
+}
+
+func contentHash(data []byte) string {
+  return fmt.Sprintf("%x", md5.Sum(data))[0:16]
+}
+
+func writeOnce(path string, data []byte) error {
+  // Same name means same content, so an existing file can be left alone
+  if _, err := os.Stat(path); err == nil {
+    return nil
+  }
+
+  tmpPath := path + ".tmp"
+  err := ioutil.WriteFile(tmpPath, data, 0444)
+  if err != nil {
+    return err
+  }
+
+  return os.Rename(tmpPath, path)
+}
+
+// Scales src down so it fits within a maxSize square, small images are not enlarged
+func fit(src image.Image, maxSize int) image.Image {
+  bounds := src.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+
+  if width <= maxSize && height <= maxSize {
+    return src
+  }
+
+  if width > height {
+    height = max(1, height * maxSize / width)
+    width = maxSize
+  } else {
+    width = max(1, width * maxSize / height)
+    height = maxSize
+  }
+
+  return resize(src, width, height)
+}
+
+// Box filter: each destination pixel is the average of the source pixels it covers.
+// Only used for shrinking, where it gives good results without any dependencies.
+func resize(src image.Image, width, height int) *image.NRGBA {
+  bounds := src.Bounds()
+  srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+  dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+  for y := 0; y < height; y++ {
+    y0 := bounds.Min.Y + y * srcHeight / height
+    y1 := bounds.Min.Y + max((y + 1) * srcHeight / height, y * srcHeight / height + 1)
+
+    for x := 0; x < width; x++ {
+      x0 := bounds.Min.X + x * srcWidth / width
+      x1 := bounds.Min.X + max((x + 1) * srcWidth / width, x * srcWidth / width + 1)
+
+      var r, g, b, a, n uint64
+      for sy := y0; sy < y1; sy++ {
+        for sx := x0; sx < x1; sx++ {
+          pr, pg, pb, pa := src.At(sx, sy).RGBA()
+          r += uint64(pr)
+          g += uint64(pg)
+          b += uint64(pb)
+          a += uint64(pa)
+          n++
+        }
+      }
+
+      // Averages are alpha premultiplied, convert back for NRGBA
+      if a == 0 {
+        dst.SetNRGBA(x, y, color.NRGBA{})
+        continue
+      }
+      dst.SetNRGBA(x, y, color.NRGBA{
+        R: uint8(r * 0xff / a),
+        G: uint8(g * 0xff / a),
+        B: uint8(b * 0xff / a),
+        A: uint8(a / n >> 8),
+      })
+    }
+  }
+
+  return dst
+}
+
+func max(a, b int) int {
+  if a > b {
+    return a
+  }
+  return b
+}
+
+func (i *Image) Scan(src interface{}) error {
+  switch src.(type) {
+  case string:
+    return json.Unmarshal([]byte(src.(string)), i)
+  case []byte:
+    return json.Unmarshal(src.([]byte), i)
+  default:
+    return errors.New("Incompatible type for Image")
+  }
+}
+
+func (i Image) Value() (driver.Value, error) {
+  data, err := json.Marshal(i)
+  return string(data), err
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}
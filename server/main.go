@@ -8,55 +8,137 @@ import (
   "os"
   "feedme/server/templates"
   "feedme/server/editform"
+  "feedme/server/images"
+  "feedme/server/notify"
+  "feedme/server/webhooks"
+  "feedme/server/printing"
   "github.com/jinzhu/gorm"
  )
 
 func main() {
   loadConfig()
+  initSessions()
   templates.Init()
+  initPayments()
+  initChallenge()
+  initResolver()
+  images.Init(Config.UploadsDir)
   db := initDB()
 
+  notify.SetEmail(notify.New(Config.EmailNotifier))
+  notify.SetSMS(notify.New(Config.SMSNotifier))
+  notify.StartWorker(db)
+  webhooks.StartWorker(db)
+  printing.StartWorker(db)
+  startIdempotencyPurger(db)
+  startSessionPurger(db)
+  startDomainRefresher(db)
+
   feedmeRouter := mux.NewRouter()
   feedmeRouter.HandleFunc("/", RequestHandler(db, getFeedmeHome)).Methods("GET")
+  feedmeRouter.HandleFunc("/payments/webhook", RequestHandler(db, postPaymentWebhook)).Methods("POST")
   addCommonRoutes(feedmeRouter, db)
 
   restaurantRouter := mux.NewRouter()
   restaurantRouter.HandleFunc("/", RestaurantHandler(db, getFrontEnd)).Methods("GET")
   restaurantRouter.HandleFunc("/status", RestaurantHandler(db, getFrontEndStatus)).Methods("GET")
-  restaurantRouter.HandleFunc("/status/stream", RestaurantHandler(db, getFrontEndStatusStream)).Methods("GET")
-  restaurantRouter.HandleFunc("/placeOrder", RestaurantHandler(db, postPlaceOrder)).Methods("POST")
+  restaurantRouter.HandleFunc("/orders/{token}", RestaurantHandler(db, getOrderStatus)).Methods("GET")
+  restaurantRouter.HandleFunc("/orders/{token}/stream", RestaurantHandlerNoTx(db, getOrderStatusStream)).Methods("GET")
+  restaurantRouter.HandleFunc("/api/menu", RestaurantHandler(db, getMenuApi)).Methods("GET")
+  restaurantRouter.HandleFunc("/placeOrder", RestaurantHandler(db, Idempotent(postPlaceOrder))).Methods("POST")
+  restaurantRouter.HandleFunc("/verifyPhone/start", RestaurantHandler(db, postVerifyPhoneStart)).Methods("POST")
+  restaurantRouter.HandleFunc("/verifyPhone/check", RestaurantHandler(db, postVerifyPhoneCheck)).Methods("POST")
+  restaurantRouter.HandleFunc("/payOrder", RestaurantHandler(db, postPayOrder)).Methods("POST")
+  restaurantRouter.HandleFunc("/cancelOrder", RestaurantHandler(db, postCancelOrder)).Methods("POST")
   restaurantRouter.HandleFunc("/till", RestaurantHandler(db, getTill)).Methods("GET")
   restaurantRouter.HandleFunc("/till/events", RestaurantHandlerNoTx(db, getTillStream)).Methods("GET")
-  restaurantRouter.HandleFunc("/till/updateOrder", RestaurantHandlerNoTx(db, postUpdateOrder)).Methods("POST")
+  restaurantRouter.HandleFunc("/till/updateOrder", RestaurantHandler(db, Idempotent(postUpdateOrder))).Methods("POST")
+  restaurantRouter.HandleFunc("/till/printOrder", RestaurantHandler(db, postPrintOrder)).Methods("POST")
+  restaurantRouter.HandleFunc("/till/blockNumber", RestaurantHandler(db, postBlockNumber)).Methods("POST")
+  restaurantRouter.HandleFunc("/reports", RestaurantHandler(db, getSalesReport)).Methods("GET")
+  restaurantRouter.HandleFunc("/reports/z", RestaurantHandler(db, getZReports)).Methods("GET")
+  restaurantRouter.HandleFunc("/reports/z/{id}", RestaurantHandler(db, getZReports)).Methods("GET")
+  restaurantRouter.HandleFunc("/till/closeDay", RestaurantHandler(db, postCloseDay)).Methods("POST")
+  restaurantRouter.HandleFunc("/till/refundOrder", RestaurantHandler(db, postTillRefundOrder)).Methods("POST")
   addCommonRoutes(restaurantRouter, db)
 
   router := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
     if hostname(req) == Config.DomainName {
       feedmeRouter.ServeHTTP(w, req)
-    } else {
+    } else if !canonicalHostRedirect(w, req) {
       restaurantRouter.ServeHTTP(w, req)
     }
   })
 
-  server := Recover(router, Config.Debug)
+  server := SecurityHeaders(Recover(CSRFProtect(router), Config.Debug))
   server = logger.DefaultHandler(server)
 
-  log.Fatal(http.ListenAndServe(":" + listenPort(), server))
+  if tlsEnabled() {
+    log.Fatal(listenAndServeTLS(server))
+  } else {
+    log.Fatal(http.ListenAndServe(":" + listenPort(), server))
+  }
 }
 
 
 
 func addCommonRoutes(router *mux.Router, db *gorm.DB) {
+  router.HandleFunc("/account", RequestHandler(db, getAccount)).Methods("GET")
+  router.HandleFunc("/account/login", RequestHandler(db, postLoginStart)).Methods("POST")
+  router.HandleFunc("/account/verify", RequestHandler(db, postLoginVerify)).Methods("POST")
+  router.HandleFunc("/account/logout", RequestHandler(db, postLogout)).Methods("POST")
+  router.HandleFunc("/account/logoutAll", RequestHandler(db, postLogoutAll)).Methods("POST")
+
   router.HandleFunc("/admin/restaurants", RequestHandler(db, getRestaurants)).Methods("GET")
 
   restaurantEditForm := editform.Handler(NewEditRestaurantForm)
-  restaurantEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string) {
+  restaurantEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
     restaurantEditForm(w, req, tx)
   }
   router.Handle("/admin/restaurants/{id}", RequestHandler(db, restaurantEditFormAdapter))
 
+  notificationsEditForm := editform.Handler(NewEditNotificationsForm)
+  notificationsEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+    notificationsEditForm(w, req, tx)
+  }
+  router.Handle("/admin/restaurants/{id}/notifications", RequestHandler(db, notificationsEditFormAdapter))
+
+  taxEditForm := editform.Handler(NewEditTaxForm)
+  taxEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+    taxEditForm(w, req, tx)
+  }
+  router.Handle("/admin/restaurants/{id}/tax", RequestHandler(db, taxEditFormAdapter))
+
+  webhookEditForm := editform.Handler(NewEditWebhookForm)
+  webhookEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+    webhookEditForm(w, req, tx)
+  }
+  router.HandleFunc("/admin/restaurants/{id}/webhooks", RequestHandler(db, getWebhooks)).Methods("GET")
+  router.HandleFunc("/admin/restaurants/{id}/webhooks/deliveries/{deliveryID}/redeliver", RequestHandler(db, postRedeliverWebhook)).Methods("POST")
+  router.Handle("/admin/restaurants/{restaurantID}/webhooks/{id}", RequestHandler(db, webhookEditFormAdapter))
+
+  promotionEditForm := editform.Handler(NewEditPromotionForm)
+  promotionEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+    promotionEditForm(w, req, tx)
+  }
+  router.HandleFunc("/admin/restaurants/{id}/promotions", RequestHandler(db, getPromotions)).Methods("GET")
+  router.Handle("/admin/restaurants/{restaurantID}/promotions/{id}", RequestHandler(db, promotionEditFormAdapter))
+
+  surchargeEditForm := editform.Handler(NewEditSurchargeForm)
+  surchargeEditFormAdapter := func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+    surchargeEditForm(w, req, tx)
+  }
+  router.HandleFunc("/admin/restaurants/{id}/surcharges", RequestHandler(db, getSurcharges)).Methods("GET")
+  router.Handle("/admin/restaurants/{restaurantID}/surcharges/{id}", RequestHandler(db, surchargeEditFormAdapter))
+
+  router.HandleFunc("/admin/restaurants/{id}/domain/verify", RequestHandler(db, postVerifyDomain)).Methods("POST")
   router.HandleFunc("/admin/restaurants/{id}/menu", RequestHandler(db, editMenu)).Methods("GET", "POST")
+  router.HandleFunc("/admin/restaurants/{id}/orders/{number}/refund", RequestHandler(db, postAdminRefundOrder)).Methods("POST")
+  router.HandleFunc("/admin/restaurants/{id}/reports", RequestHandler(db, getAdminSalesReport)).Methods("GET")
+  router.HandleFunc("/admin/restaurants/{id}/menu/images", RequestHandler(db, postMenuImage)).Methods("POST")
+  router.HandleFunc("/admin/restaurants/{id}/logo", RequestHandler(db, postRestaurantLogo)).Methods("POST")
   router.PathPrefix("/assets/").Handler(templates.AssetsHandler())
+  router.PathPrefix("/uploads/").Handler(images.Handler())
 }
 
 func listenPort() string {
@@ -7,6 +7,8 @@ import (
   "github.com/jinzhu/gorm"
   "database/sql/driver"
   "time"
+  "fmt"
+  "feedme/server/images"
 )
 
 
@@ -27,8 +29,22 @@ type MenuItem struct {
   Name string
   Desc string
   Price Money
+
+  Dietary []string `json:",omitempty"`
+  Allergens []string `json:",omitempty"`
+  SpiceLevel int `json:",omitempty"`
+
+  // Empty for the restaurant's standard tax rate
+  TaxCategory string `json:",omitempty"`
+
+  Image images.Image `json:",omitempty"`
 }
 
+// Fixed vocabularies for tagging menu items, the Elm code relies on these exact strings
+var DietaryTags = []string{"Vegetarian", "Vegan", "GlutenFree"}
+var Allergens = []string{"Nuts", "Peanuts", "Dairy", "Egg", "Gluten", "Soy", "Fish", "Shellfish", "Sesame"}
+const MaxSpiceLevel = 3
+
 
 func fetchMenuForRestaurantID(tx *gorm.DB, ID uint) *Menu {
   return fetchMenuWhere(tx, "restaurant_id = ?", ID)
@@ -84,3 +100,72 @@ func (m *MenuItems)itemById(id int) *MenuItem {
   }
   return nil
 }
+
+func (m MenuItems) Validate() error {
+  ids := make(map[int]bool)
+
+  for _, item := range m {
+    if ids[item.Id] {
+      return fmt.Errorf("Duplicate menu item Id: %d", item.Id)
+    }
+    ids[item.Id] = true
+
+    for _, tag := range item.Dietary {
+      if !contains(DietaryTags, tag) {
+        return fmt.Errorf("Menu item %d: unknown dietary tag '%s'", item.Id, tag)
+      }
+    }
+
+    for _, allergen := range item.Allergens {
+      if !contains(Allergens, allergen) {
+        return fmt.Errorf("Menu item %d: unknown allergen '%s'", item.Id, allergen)
+      }
+    }
+
+    if item.SpiceLevel < 0 || item.SpiceLevel > MaxSpiceLevel {
+      return fmt.Errorf("Menu item %d: spice level must be between 0 and %d", item.Id, MaxSpiceLevel)
+    }
+
+    for _, url := range item.Image {
+      if !images.IsUploadURL(url) {
+        return fmt.Errorf("Menu item %d: image must be uploaded, not '%s'", item.Id, url)
+      }
+    }
+  }
+
+  return nil
+}
+
+type MenuFilter struct {
+  Dietary []string
+  ExcludeAllergens []string
+  MaxSpiceLevel int
+}
+
+func (m MenuItems) Filter(filter MenuFilter) MenuItems {
+  filtered := MenuItems{}
+
+  for _, item := range m {
+    if item.matches(filter) {
+      filtered = append(filtered, item)
+    }
+  }
+
+  return filtered
+}
+
+func (item *MenuItem) matches(filter MenuFilter) bool {
+  for _, tag := range filter.Dietary {
+    if !contains(item.Dietary, tag) {
+      return false
+    }
+  }
+
+  for _, allergen := range filter.ExcludeAllergens {
+    if contains(item.Allergens, allergen) {
+      return false
+    }
+  }
+
+  return item.SpiceLevel <= filter.MaxSpiceLevel
+}
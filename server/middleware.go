@@ -3,15 +3,27 @@ package main
 import (
   "fmt"
   "log"
+  "net"
   "net/http"
   "runtime/debug"
   "feedme/server/templates"
   "github.com/jinzhu/gorm"
+  "crypto/hmac"
   "crypto/rand"
+  "crypto/sha256"
   "encoding/base64"
+  "strconv"
   "strings"
+  "time"
 )
 
+// Paths called by other servers rather than from our pages, they check their own signatures
+var csrfExempt = map[string]bool{
+  "/payments/webhook": true,
+}
+
+var sessionSecret []byte
+
 func Recover(next http.Handler, debugFlag bool) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
     defer func() {
@@ -51,8 +63,8 @@ func Recover(next http.Handler, debugFlag bool) http.Handler {
 
 // TODO rename these, not just Gorm Tx
 
-type RequestHandlerFunc func(http.ResponseWriter, *http.Request, *gorm.DB, string)
-type RestaurantHandlerFunc func(http.ResponseWriter, *http.Request, *gorm.DB, string, *Restaurant)
+type RequestHandlerFunc func(http.ResponseWriter, *http.Request, *gorm.DB, *Session)
+type RestaurantHandlerFunc func(http.ResponseWriter, *http.Request, *gorm.DB, *Session, *Restaurant)
 
 func RequestHandler(db *gorm.DB, handler RequestHandlerFunc) http.HandlerFunc {
   return func(w http.ResponseWriter, req *http.Request) {
@@ -70,41 +82,112 @@ func RequestHandler(db *gorm.DB, handler RequestHandlerFunc) http.HandlerFunc {
         }
     }()
 
-    sessionID := startSession(w, req)
-    handler(w, req, tx, sessionID)
+    session := startSession(w, req, db)
+    req = templates.WithCSRFToken(req, csrfToken(session.ID))
+    handler(w, req, tx, session)
   }
 }
 
 func RestaurantHandler(db *gorm.DB, handler RestaurantHandlerFunc) http.HandlerFunc {
-  return RequestHandler(db, func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string) {
+  return RequestHandler(db, func(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
     restaurant := RestaurantFromHostname(tx, req)
-    handler(w, req, tx, sessionID, restaurant)
+    handler(w, req, tx, session, restaurant)
   })
 }
 
 func RestaurantHandlerNoTx(db *gorm.DB, handler RestaurantHandlerFunc) http.HandlerFunc {
   return func(w http.ResponseWriter, req *http.Request) {
-    sessionID := startSession(w, req)
+    session := startSession(w, req, db)
+    req = templates.WithCSRFToken(req, csrfToken(session.ID))
     restaurant := RestaurantFromHostname(db, req)
-    handler(w, req, db, sessionID, restaurant)
+    handler(w, req, db, session, restaurant)
   }
 }
 
-func startSession(w http.ResponseWriter, req *http.Request) string {
-  var cookie *http.Cookie
+// Rejects requests that change things unless they carry the session's CSRF
+// token, which only our own pages are given
+func CSRFProtect(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    switch req.Method {
+    case "GET", "HEAD", "OPTIONS":
+    default:
+      sessionID, _, ok := sessionFromRequest(req)
+      token := req.Header.Get("X-CSRF-Token")
+
+      if !csrfExempt[req.URL.Path] && (!ok || !hmac.Equal([]byte(token), []byte(csrfToken(sessionID)))) {
+        log.Printf("CSRF check failed for %s %s from %s", req.Method, req.URL.Path, clientIP(req))
+        w.WriteHeader(http.StatusForbidden)
+        fmt.Fprintln(w, "403 Forbidden")
+        return
+      }
+    }
+
+    next.ServeHTTP(w, req)
+  })
+}
+
+func initSessions() {
+  if Config.SessionSecret == "" {
+    log.Printf("No SessionSecret configured, sessions will not survive a restart")
+    sessionSecret = []byte(randomToken())
+  } else {
+    sessionSecret = []byte(Config.SessionSecret)
+  }
+
+  // Check the setting now rather than on the first request
+  cookieSameSite()
+}
 
+// The session ID and expiry from the cookie, false if there isn't one or we didn't sign it
+func sessionFromRequest(req *http.Request) (string, time.Time, bool) {
   cookie, err := req.Cookie("session")
+  if err != nil {
+    return "", time.Time{}, false
+  }
+
+  parts := strings.Split(cookie.Value, ".")
+  if len(parts) != 3 {
+    return "", time.Time{}, false
+  }
 
+  unix, err := strconv.ParseInt(parts[1], 10, 64)
   if err != nil {
-    cookie = &http.Cookie{
-      Name: "session",
-      Value: randomIdString(),
-      HttpOnly: true,
-    }
-    http.SetCookie(w, cookie)
+    return "", time.Time{}, false
   }
 
-  return cookie.Value
+  expires := time.Unix(unix, 0)
+  if !hmac.Equal([]byte(signSession(parts[0], expires)), []byte(cookie.Value)) {
+    return "", time.Time{}, false
+  }
+  return parts[0], expires, true
+}
+
+func signSession(sessionID string, expires time.Time) string {
+  value := sessionID + "." + strconv.FormatInt(expires.Unix(), 10)
+  return value + "." + sessionMAC("session:" + value)
+}
+
+func csrfToken(sessionID string) string {
+  return sessionMAC("csrf:" + sessionID)
+}
+
+func sessionMAC(value string) string {
+  mac := hmac.New(sha256.New, sessionSecret)
+  mac.Write([]byte(value))
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cookieSameSite() http.SameSite {
+  switch strings.ToLower(Config.CookieSameSite) {
+  case "lax":
+    return http.SameSiteLaxMode
+  case "strict":
+    return http.SameSiteStrictMode
+  case "none":
+    return http.SameSiteNoneMode
+  default:
+    panic("Unknown CookieSameSite: " + Config.CookieSameSite)
+  }
 }
 
 func randomIdString() string {
@@ -118,24 +201,67 @@ func randomIdString() string {
   return base64.URLEncoding.EncodeToString(id)
 }
 
+// Long enough to be unguessable when handed out in shareable links
+func randomToken() string {
+  token := make([]byte, 18)
+
+  _, err := rand.Read(token)
+  if err != nil {
+    panic(err)
+  }
+
+  return base64.RawURLEncoding.EncodeToString(token)
+}
+
 func RestaurantFromHostname(db *gorm.DB, req *http.Request) *Restaurant {
-  var slug string
   host := hostname(req)
-  domainName := Config.DomainName
-  splitPosition := len(host) - len(domainName) - 1
 
-  if splitPosition > 0 && host[splitPosition] == '.' && host[splitPosition+1:] == domainName {
-    slug = host[0:splitPosition]
-  } else {
+  if entry, ok := customDomains.lookup(host); ok && entry.Verified {
+    return fetchRestaurantBySlug(db, entry.Slug)
+  }
+
+  slug, ok := slugFromHostname(host)
+  if !ok {
     panic(gorm.ErrRecordNotFound)
   }
 
   return fetchRestaurantBySlug(db, slug)
 }
 
+func slugFromHostname(host string) (string, bool) {
+  domainName := Config.DomainName
+  splitPosition := len(host) - len(domainName) - 1
+
+  if splitPosition > 0 && host[splitPosition] == '.' && host[splitPosition+1:] == domainName {
+    return host[0:splitPosition], true
+  }
+  return "", false
+}
+
+// Lowercased, as host names are case insensitive and domains are stored lowercase
 func hostname(req *http.Request) string {
   // req.Host may be in format hostname:portnumber
-  return strings.Split(req.Host, ":")[0]
+  return strings.ToLower(strings.Split(req.Host, ":")[0])
+}
+
+// The address of the customer. Behind a trusted proxy that is the right-most
+// forwarded address, the one the proxy appended, as the client can send
+// whatever it likes before it.
+func clientIP(req *http.Request) string {
+  if Config.TrustProxyHeaders {
+    if headers := req.Header["X-Forwarded-For"]; len(headers) > 0 {
+      addresses := strings.Split(headers[len(headers) - 1], ",")
+      if forwarded := strings.TrimSpace(addresses[len(addresses) - 1]); forwarded != "" {
+        return forwarded
+      }
+    }
+  }
+
+  host, _, err := net.SplitHostPort(req.RemoteAddr)
+  if err != nil {
+    return req.RemoteAddr
+  }
+  return host
 }
 
 func port(req *http.Request) string {
@@ -0,0 +1,158 @@
+package main
+
+import (
+  "bytes"
+  "github.com/jinzhu/gorm"
+  ef "feedme/server/editform"
+  "feedme/server/notify"
+  "text/template"
+  "time"
+)
+
+// Message templates sent to customers when the till changes an order's status,
+// a blank body means no message for that status. ID is the restaurant's ID.
+type RestaurantNotifications struct {
+  ID uint
+
+  ExpectedSubject string
+  ExpectedBody string
+  ReadySubject string
+  ReadyBody string
+  RejectedSubject string
+  RejectedBody string
+}
+
+func defaultRestaurantNotifications(restaurantID uint) *RestaurantNotifications {
+  return &RestaurantNotifications{
+    ID: restaurantID,
+    ExpectedSubject: "Your {{.Restaurant}} order",
+    ExpectedBody: "Thanks {{.Name}}, your {{.Restaurant}} order #{{.Number}} will be ready at {{.ExpectedTime}}.",
+    ReadySubject: "Your {{.Restaurant}} order is ready",
+    ReadyBody: "Your {{.Restaurant}} order #{{.Number}} is ready to pick up.",
+  }
+}
+
+type notificationData struct {
+  Restaurant string
+  Number uint
+  Name string
+  ExpectedTime string
+}
+
+// Queues a message to the customer if the restaurant has one for the new status
+func notifyStatusChange(tx *gorm.DB, restaurant *Restaurant, order *Order) {
+  var settings RestaurantNotifications
+  err := tx.First(&settings, restaurant.ID).Error
+  if gorm.IsRecordNotFoundError(err) {
+    return
+  }
+  checkError(err)
+
+  var subject, body string
+  switch order.Status {
+  case "Expected":
+    subject, body = settings.ExpectedSubject, settings.ExpectedBody
+  case "Ready":
+    subject, body = settings.ReadySubject, settings.ReadyBody
+  case "Rejected":
+    subject, body = settings.RejectedSubject, settings.RejectedBody
+  }
+
+  if body == "" {
+    return
+  }
+
+  data := notificationData{
+    Restaurant: restaurant.Name,
+    Number: order.DisplayNumber,
+    Name: order.Name,
+  }
+  if order.StatusDate != nil {
+    data.ExpectedTime = order.StatusDate.In(restaurant.Location()).Format("3:04pm")
+  }
+
+  notify.Queue(tx, notify.Message{
+    To: orderRecipient(tx, order),
+    Subject: renderNotification(subject, data),
+    Body: renderNotification(body, data),
+  })
+}
+
+// Customers who logged in with an email address get emails, everyone else gets an SMS
+func orderRecipient(tx *gorm.DB, order *Order) string {
+  var customer Customer
+
+  err := tx.
+          Joins("JOIN orders ON orders.customer_id = customers.id").
+          Where("orders.restaurant_id=? AND orders.number=?", order.RestaurantID, order.Number).
+          First(&customer).Error
+
+  if err == nil && notify.IsEmail(customer.Login) {
+    return customer.Login
+  }
+  if !gorm.IsRecordNotFoundError(err) {
+    checkError(err)
+  }
+
+  return order.Telephone
+}
+
+func renderNotification(text string, data notificationData) string {
+  tmpl, err := template.New("notification").Parse(text)
+  checkError(err)
+
+  var buf bytes.Buffer
+  checkError(tmpl.Execute(&buf, data))
+  return buf.String()
+}
+
+
+type EditNotificationsForm struct {}
+
+func NewEditNotificationsForm() ef.Form {
+  return new(EditNotificationsForm)
+}
+
+func (f *EditNotificationsForm) New() interface{} {
+  return new(RestaurantNotifications)
+}
+
+func (f *EditNotificationsForm) Layout(fi *ef.Instance) ef.Layout {
+  return ef.NewLayout(
+      "Customer Notifications",
+      "/admin/restaurants",
+      "/admin/restaurants",
+      ef.Group("When the order is accepted",
+        ef.Text("ExpectedSubject", "Email Subject"),
+        ef.TextArea("ExpectedBody", "Message")),
+      ef.Group("When the order is ready",
+        ef.Text("ReadySubject", "Email Subject"),
+        ef.TextArea("ReadyBody", "Message")),
+      ef.Group("When the order is rejected",
+        ef.Text("RejectedSubject", "Email Subject"),
+        ef.TextArea("RejectedBody", "Message")))
+}
+
+func (f *EditNotificationsForm) Validate(fi *ef.Instance) {
+  fi.Validate("ExpectedSubject", "Email Subject", ef.Trim, validTemplate)
+  fi.Validate("ExpectedBody", "Message", ef.Trim, validTemplate)
+  fi.Validate("ReadySubject", "Email Subject", ef.Trim, validTemplate)
+  fi.Validate("ReadyBody", "Message", ef.Trim, validTemplate)
+  fi.Validate("RejectedSubject", "Email Subject", ef.Trim, validTemplate)
+  fi.Validate("RejectedBody", "Message", ef.Trim, validTemplate)
+}
+
+func validTemplate(value string) (string, string) {
+  tmpl, err := template.New("notification").Parse(value)
+  if err != nil {
+    return value, "%s is not a valid template."
+  }
+
+  // Catch references to fields that do not exist
+  sample := notificationData{"Restaurant", 1, "Name", time.Now().Format("3:04pm")}
+  if err := tmpl.Execute(new(bytes.Buffer), sample); err != nil {
+    return value, "%s uses an unknown field, use {{.Restaurant}}, {{.Number}}, {{.Name}} or {{.ExpectedTime}}."
+  }
+
+  return value, ""
+}
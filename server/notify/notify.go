@@ -0,0 +1,54 @@
+package notify
+
+// Notifiers deliver short messages to customers, by email or SMS depending on
+// the address. Real providers are plugged in with SetEmail and SetSMS, by
+// default messages are just logged which is handy for development.
+
+import (
+  "log"
+  "strings"
+)
+
+type Message struct {
+  To string
+  Subject string
+  Body string
+}
+
+type Notifier interface {
+  Send(Message) error
+}
+
+type LogNotifier struct {}
+
+func (n LogNotifier) Send(m Message) error {
+  log.Printf("Notify %s: %s\n%s\n", m.To, m.Subject, m.Body)
+  return nil
+}
+
+var email Notifier = LogNotifier{}
+var sms Notifier = LogNotifier{}
+
+func SetEmail(n Notifier) {
+  email = n
+}
+
+func SetSMS(n Notifier) {
+  sms = n
+}
+
+func IsEmail(address string) bool {
+  return strings.Contains(address, "@")
+}
+
+// Picks the notifier for the kind of address, email or phone number
+func For(address string) Notifier {
+  if IsEmail(address) {
+    return email
+  }
+  return sms
+}
+
+func Send(m Message) error {
+  return For(m.To).Send(m)
+}
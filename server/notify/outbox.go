@@ -0,0 +1,72 @@
+package notify
+
+// Messages are queued in an outbox table in the same transaction as the change
+// that caused them, then delivered by a background worker with retries. A slow
+// or failing provider never holds up the request that queued the message.
+
+import (
+  "github.com/jinzhu/gorm"
+  "time"
+  "feedme/server/queue"
+)
+
+const maxAttempts = 8
+const pollInterval = 30 * time.Second
+
+type OutboxMessage struct {
+  ID uint
+  To string `gorm:"not null"`
+  Subject string
+  Body string
+  Attempts int `gorm:"not null"`
+  NextAttemptAt time.Time `gorm:"not null"`
+  SentAt *time.Time
+  LastError string
+  CreatedAt time.Time
+}
+
+func (OutboxMessage) TableName() string {
+  return "notification_outbox"
+}
+
+var outbox = queue.New(queue.Options{
+  Name: "Notification",
+  Table: "notification_outbox",
+  DoneColumn: "sent_at",
+  MaxAttempts: maxAttempts,
+  PollInterval: pollInterval,
+  Backoff: backoff,
+  Do: deliver,
+})
+
+func Queue(tx *gorm.DB, m Message) {
+  checkError(tx.Create(&OutboxMessage{
+    To: m.To,
+    Subject: m.Subject,
+    Body: m.Body,
+    NextAttemptAt: time.Now(),
+  }).Error)
+
+  outbox.Nudge()
+}
+
+func StartWorker(db *gorm.DB) {
+  outbox.StartWorker(db)
+}
+
+func deliver(db *gorm.DB, id uint) error {
+  var m OutboxMessage
+  checkError(db.First(&m, id).Error)
+  return Send(Message{m.To, m.Subject, m.Body})
+}
+
+// 1, 2, 4, 8... minutes between attempts
+func backoff(attempts int) time.Duration {
+  return time.Minute << uint(attempts - 1)
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}
@@ -0,0 +1,180 @@
+package notify
+
+import (
+  "bytes"
+  "crypto/tls"
+  "encoding/json"
+  "fmt"
+  "net"
+  "net/http"
+  "net/smtp"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+const smtpDialTimeout = 10 * time.Second
+
+// For the whole conversation, smtp.SendMail would wait forever on a server
+// that stops responding
+const smtpTimeout = 30 * time.Second
+
+type SMTPNotifier struct {
+  Host string
+  Port int
+  Username string
+  Password string
+  From string
+}
+
+func (n SMTPNotifier) Send(m Message) error {
+  var auth smtp.Auth
+  if n.Username != "" {
+    auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+  }
+
+  msg := "From: " + n.From + "\r\n" +
+         "To: " + m.To + "\r\n" +
+         "Subject: " + m.Subject + "\r\n" +
+         "Content-Type: text/plain; charset=utf-8\r\n" +
+         "\r\n" +
+         strings.Replace(m.Body, "\n", "\r\n", -1)
+
+  conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", n.Host, n.Port), smtpDialTimeout)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+  c, err := smtp.NewClient(conn, n.Host)
+  if err != nil {
+    return err
+  }
+  defer c.Close()
+
+  // As smtp.SendMail does
+  if ok, _ := c.Extension("STARTTLS"); ok {
+    if err = c.StartTLS(&tls.Config{ServerName: n.Host}); err != nil {
+      return err
+    }
+  }
+  if auth != nil {
+    if err = c.Auth(auth); err != nil {
+      return err
+    }
+  }
+
+  if err = c.Mail(n.From); err != nil {
+    return err
+  }
+  if err = c.Rcpt(m.To); err != nil {
+    return err
+  }
+
+  w, err := c.Data()
+  if err != nil {
+    return err
+  }
+  if _, err = w.Write([]byte(msg)); err != nil {
+    return err
+  }
+  if err = w.Close(); err != nil {
+    return err
+  }
+
+  return c.Quit()
+}
+
+// Posts JSON {"From": ..., "To": ..., "Body": ...} to an SMS gateway, most
+// gateways can be made to accept this with a little glue.
+type HTTPSMSNotifier struct {
+  URL string
+  AuthToken string
+  From string
+}
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+func (n HTTPSMSNotifier) Send(m Message) error {
+  payload, err := json.Marshal(struct {
+    From, To, Body string
+  }{n.From, m.To, m.Body})
+  if err != nil {
+    return err
+  }
+
+  req, err := http.NewRequest("POST", n.URL, bytes.NewReader(payload))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  if n.AuthToken != "" {
+    req.Header.Set("Authorization", "Bearer " + n.AuthToken)
+  }
+
+  resp, err := httpClient.Do(req)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    return fmt.Errorf("SMS gateway responded %s", resp.Status)
+  }
+
+  return nil
+}
+
+// Appends messages to a file, for development without real providers
+type FileNotifier struct {
+  Path string
+}
+
+var fileMutex sync.Mutex
+
+func (n FileNotifier) Send(m Message) error {
+  fileMutex.Lock()
+  defer fileMutex.Unlock()
+
+  f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  _, err = fmt.Fprintf(f, "%s To: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC3339), m.To, m.Subject, m.Body)
+  return err
+}
+
+type Config struct {
+  // "smtp", "http", "file" or "log" (the default)
+  Provider string
+
+  Host string
+  Port int
+  Username string
+  Password string
+
+  URL string
+  AuthToken string
+
+  From string
+  Path string
+}
+
+func New(c Config) Notifier {
+  switch c.Provider {
+  case "smtp":
+    return SMTPNotifier{c.Host, c.Port, c.Username, c.Password, c.From}
+  case "http":
+    return HTTPSMSNotifier{c.URL, c.AuthToken, c.From}
+  case "file":
+    return FileNotifier{c.Path}
+  case "log", "":
+    return LogNotifier{}
+  default:
+    panic("Unknown notification provider: " + c.Provider)
+  }
+}
@@ -6,7 +6,10 @@ import (
   "encoding/json"
   "database/sql/driver"
   "errors"
+  "log"
   "time"
+  "feedme/server/templates"
+  "feedme/server/currency"
   "github.com/jinzhu/gorm"
 )
 
@@ -15,6 +18,12 @@ type Order struct {
   RestaurantID uint `gorm:"primary_key"`
   Number uint `gorm:"primary_key"`
 
+  // Unique across all restaurants, for integrations and accounting
+  ID uint `gorm:"AUTO_INCREMENT"`
+
+  // The number cashiers and customers see, it may restart each day
+  DisplayNumber uint `gorm:"not null"`
+
   Name string
   Telephone string
   MenuID uint
@@ -23,8 +32,29 @@ type Order struct {
   GST Money
   Total Money
 
+  // ISO 4217 code of the restaurant's currency when the order was placed
+  Currency string `gorm:"not null"`
+
+  // How GST was calculated, nil for orders from before tax rules were configurable
+  Tax *TaxBreakdown `gorm:"type:text" json:",omitempty"`
+
+  PromoCode string
+  Discounts DiscountLines `gorm:"type:text"`
+
+  // Tips and surcharges, Total includes them
+  Charges ChargeLines `gorm:"type:text"`
+
+  // As sent by the customer, the tip itself is in Charges
+  Tip TipChoice `gorm:"-"`
+
   Status string
   StatusDate *time.Time
+  CancelReason string
+
+  TrackingToken string `gorm:"not null"`
+
+  PaymentStatus string `gorm:"not null"`
+  PaymentIntentID string
 
   CreatedAt time.Time `gorm:"not null"`
 }
@@ -32,19 +62,48 @@ type Order struct {
 type OrderWithSessionID struct {
   Order
   SessionID string `gorm:"not null"`
+  CustomerID *uint
+
+  ClientIP string `gorm:"not null"`
+  NormalisedTelephone string `gorm:"not null"`
+  Suspicious SuspicionFlags `gorm:"type:text"`
+}
+
+type OrderSummary struct {
+  Number uint
+  DisplayNumber uint
+  Total Money
+  Status string
+  StatusDate *time.Time
+  CreatedAt time.Time
+  TrackingURL string
 }
 
 type TillOrder struct {
   Number uint
+  DisplayNumber uint
+  ID uint
 
   Name string
   Telephone string
   MenuID uint
   MenuItems MenuItems
   Items OrderItems
+  Allergens []string `gorm:"-"`
 
   Status string
   StatusDate *time.Time
+  CancelReason string
+  PaymentStatus string
+  Currency string
+  Total Money
+  Discounts DiscountLines
+  Charges ChargeLines
+  Refunded Money `gorm:"-"`
+
+  NormalisedTelephone string
+  Suspicious SuspicionFlags
+  Blocked bool `gorm:"-"`
 
   CreatedAt time.Time
 }
@@ -59,6 +118,7 @@ type OrderStatusUpdate struct {
   Number uint
   Status string
   StatusDate *time.Time
+  CancelReason string `json:",omitempty"`
 }
 
 type OrderItems []OrderItem
@@ -72,31 +132,102 @@ func fetchLatestOrder(tx *gorm.DB, restaurantID uint, sessionID string) *Order {
   var order Order
 
   err := tx.
-          Preload("Menu.Restaurant").
           Order("number desc").
           Where("restaurant_id=? AND orders.session_id=?", restaurantID, sessionID).
           First(&order).Error
 
+  if gorm.IsRecordNotFoundError(err) {
+    return nil
+  }
+
+  checkError(err)
+
+  return &order
+}
+
+func fetchOrderByToken(tx *gorm.DB, restaurantID uint, token string) *OrderWithSessionID {
+  var order OrderWithSessionID
+
+  err := tx.Table("orders").
+          Preload("Menu.Restaurant").
+          Where("restaurant_id=? AND tracking_token=?", restaurantID, token).
+          First(&order).Error
+
+  if gorm.IsRecordNotFoundError(err) {
+    return nil
+  }
+
   checkError(err)
 
   return &order
 }
 
+func fetchRecentOrders(tx *gorm.DB, restaurantID uint, sessionID string) []OrderSummary {
+  var orders []Order
+
+  checkError(tx.
+    Order("number desc").
+    Limit(10).
+    Where("restaurant_id=? AND session_id=?", restaurantID, sessionID).
+    Find(&orders).Error)
+
+  summaries := []OrderSummary{}
+  for _, order := range orders {
+    summaries = append(summaries, OrderSummary{order.Number, order.DisplayNumber, order.Total, order.Status, order.StatusDate, order.CreatedAt, order.TrackingURL()})
+  }
+
+  return summaries
+}
+
+func (o *Order) TrackingURL() string {
+  return "/orders/" + o.TrackingToken
+}
+
 
 func fetchTillOrders(tx *gorm.DB, restaurantID uint) []TillOrder {
   var orders []TillOrder
 
-  checkError(tx.Table("orders").Order("number asc").Where("restaurant_id=?", restaurantID).Find(&orders).Error)
+  checkError(tx.Table("orders").
+    Order("number asc").
+    Where("restaurant_id=? AND payment_status<>?", restaurantID, PaymentPending).
+    Find(&orders).Error)
 
   for i := range orders {
     var menu Menu
     checkError(tx.Take(&menu, orders[i].MenuID).Error)
     orders[i].MenuItems = menu.Items
+    orders[i].Allergens = orders[i].Items.allergens(menu.Items)
+    orders[i].Refunded = refundedTotal(fetchRefunds(tx, restaurantID, orders[i].Number))
+    orders[i].Blocked = isBlockedNumber(tx, restaurantID, orders[i].NormalisedTelephone)
   }
 
   return orders
 }
 
+// Allergens present in any of the ordered items, in vocabulary order so they read consistently on the till
+func (o OrderItems) allergens(menuItems MenuItems) []string {
+  present := make(map[string]bool)
+
+  for _, item := range o {
+    menuItem := menuItems.itemById(item.Id)
+    if menuItem == nil {
+      continue
+    }
+    for _, allergen := range menuItem.Allergens {
+      present[allergen] = true
+    }
+  }
+
+  allergens := []string{}
+  for _, allergen := range Allergens {
+    if present[allergen] {
+      allergens = append(allergens, allergen)
+    }
+  }
+
+  return allergens
+}
+
 func (o *OrderItems) Scan(src interface{}) error {
   switch src.(type) {
   case string:
@@ -112,33 +243,121 @@ func (o OrderItems) Value() (driver.Value, error) {
 }
 
 
+// An amount in the minor units of the restaurant's currency
 type Money int
 
+func (m Money) Format(c currency.Currency) string {
+  return c.Format(int64(m))
+}
+
+func (m Money) FormatPlain(c currency.Currency) string {
+  return c.FormatPlain(int64(m))
+}
+
+
+// Everything from the restaurant and the customer's choices that goes into
+// pricing an order. Amounts are in the minor units of Currency, which is kept with the totals.
+type Pricing struct {
+  Tax TaxRules
+  Currency string
+  Discounts []Discount
+  Surcharges []SurchargeRule
+  Tip TipChoice
+}
 
-func (o *Order) Recalc() {
+// Tax is calculated and rounded per line, the breakdown is kept on the order
+// so changing the restaurant's tax rules does not alter existing orders.
+// Discounts come off the lines before tax, surcharges and tips are
+// percentages of what is left.
+func (o *Order) Recalc(pricing Pricing) {
   fmt.Printf("Menu: %#v\n", o.Menu)
   fmt.Printf("Order: %#v\n", o.Items)
 
+  rules := pricing.Tax
+
   o.Total = 0
+  o.GST = 0
+  o.Currency = pricing.Currency
+  o.Tax = &TaxBreakdown{Rules: rules, Lines: []TaxLine{}}
+  o.Discounts = DiscountLines{}
+  o.Charges = ChargeLines{}
 
+  var subtotal Money
   for _, item := range o.Items{
     menuItem := o.Menu.Items.itemById(item.Id)
     fmt.Printf("Item: %#v\n", menuItem)
-    o.Total +=  Money(item.Qty) * menuItem.Price
+    if menuItem == nil {
+      panic(templates.BadRequest(fmt.Sprintf("Unknown menu item: %d", item.Id)))
+    }
+    if item.Qty <= 0 {
+      panic(templates.BadRequest(fmt.Sprintf("Expecting a positive quantity, received: %d", item.Qty)))
+    }
+
+    // The category may have been removed from the tax settings since the item was set up
+    rate, err := rules.rateFor(menuItem.TaxCategory)
+    if err != nil {
+      log.Printf("%s: %s, using the standard rate", menuItem.Name, err)
+      rate = rules.Rate
+    }
+
+    line := TaxLine{Id: item.Id, Qty: item.Qty, Category: menuItem.TaxCategory, Rate: rate}
+    line.Amount = Money(item.Qty) * menuItem.Price
+    o.Tax.Lines = append(o.Tax.Lines, line)
+    subtotal += line.Amount
   }
 
-  o.GST = integerGST(o.Total)
-}
+  for _, discount := range pricing.Discounts {
+    if amount := discount.apply(o.Tax.Lines, subtotal); amount > 0 {
+      o.Discounts = append(o.Discounts, DiscountLine{discount.PromotionID, discount.Name, discount.Code, amount})
+    }
+  }
+
+  var items, taxAdded Money
+  for i := range o.Tax.Lines {
+    line := &o.Tax.Lines[i]
+    line.Tax = rules.taxOn(line.Amount - line.Discount, line.Rate)
 
-func integerGST(total Money) Money {
-  intermediate := total * 15
-  gst := intermediate / 100
+    items += line.Amount - line.Discount
+    o.GST += line.Tax
+    taxAdded += line.Tax
+  }
+
+  percentOfItems := func(percent int) Money {
+    return Money(roundDiv(int64(items) * int64(percent), 10000, "half-up"))
+  }
+
+  for _, surcharge := range pricing.Surcharges {
+    amount := surcharge.Amount
+    if surcharge.Percent > 0 {
+      amount = percentOfItems(surcharge.Percent)
+    }
+    if amount <= 0 {
+      continue
+    }
+
+    line := rules.chargeLine(ChargeSurcharge, surcharge.Name, surcharge.Category, amount, true)
+    o.Charges = append(o.Charges, line)
+    o.GST += line.Tax
+    taxAdded += line.Tax
+  }
 
-  if (intermediate % 100) >= 50 {
-    gst += 1
+  tip := pricing.Tip.Amount
+  if pricing.Tip.Percent > 0 {
+    tip = percentOfItems(pricing.Tip.Percent)
+  }
+  if tip > 0 {
+    line := rules.chargeLine(ChargeTip, "Tip", "", tip, rules.TaxTips)
+    o.Charges = append(o.Charges, line)
+    o.GST += line.Tax
   }
 
-  return gst
+  o.Total = items
+  for _, line := range o.Charges {
+    o.Total += line.Amount
+  }
+  if !rules.Inclusive {
+    o.Total += taxAdded
+  }
 }
 
 
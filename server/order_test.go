@@ -0,0 +1,76 @@
+package main
+
+import (
+  "testing"
+)
+
+func testMenu() *Menu {
+  return &Menu{Items: MenuItems{
+    {Id: 1, Name: "Burger", Price: 1150},
+    {Id: 2, Name: "Chips", Price: 350},
+    {Id: 3, Name: "Water", Price: 300, TaxCategory: "zero"},
+    {Id: 4, Name: "Gift card", Price: 1000, TaxCategory: "removed"},
+  }}
+}
+
+func testTaxRules(inclusive bool, rounding string) TaxRules {
+  return TaxRules{
+    Rate: 1500,
+    Inclusive: inclusive,
+    Rounding: rounding,
+    Categories: map[string]int{"zero": 0},
+  }
+}
+
+func TestRecalcTax(t *testing.T) {
+  burgersAndChips := OrderItems{{Id: 1, Qty: 2}, {Id: 2, Qty: 1}}
+
+  tests := []struct {
+    name string
+    items OrderItems
+    rules TaxRules
+    gst Money
+    total Money
+    lineTax []Money
+  }{
+    {"inclusive", burgersAndChips, testTaxRules(true, "half-up"), 346, 2650, []Money{300, 46}},
+    {"inclusive rounding down", burgersAndChips, testTaxRules(true, "down"), 345, 2650, []Money{300, 45}},
+    {"exclusive", burgersAndChips, testTaxRules(false, "half-up"), 398, 3048, []Money{345, 53}},
+    {"exclusive rounding half-even", burgersAndChips, testTaxRules(false, "half-even"), 397, 3047, []Money{345, 52}},
+    {"exclusive rounding down", burgersAndChips, testTaxRules(false, "down"), 397, 3047, []Money{345, 52}},
+    {"exclusive rounding up", burgersAndChips, testTaxRules(false, "up"), 398, 3048, []Money{345, 53}},
+    {"zero-rated", OrderItems{{Id: 3, Qty: 2}}, testTaxRules(false, "half-up"), 0, 600, []Money{0}},
+    {"zero-rated with standard", OrderItems{{Id: 1, Qty: 1}, {Id: 3, Qty: 1}}, testTaxRules(false, "half-up"), 173, 1623, []Money{173, 0}},
+    {"unknown category at the standard rate", OrderItems{{Id: 4, Qty: 1}}, testTaxRules(false, "half-up"), 150, 1150, []Money{150}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      order := Order{Menu: testMenu(), Items: test.items}
+      order.Recalc(Pricing{Tax: test.rules, Currency: "NZD"})
+
+      if order.GST != test.gst || order.Total != test.total {
+        t.Errorf("Expecting GST %d and total %d, received GST %d and total %d", test.gst, test.total, order.GST, order.Total)
+      }
+      if len(order.Tax.Lines) != len(test.lineTax) {
+        t.Fatalf("Expecting %d tax lines, received %d", len(test.lineTax), len(order.Tax.Lines))
+      }
+      for i, line := range order.Tax.Lines {
+        if line.Tax != test.lineTax[i] {
+          t.Errorf("Expecting tax %d on line %d, received %d", test.lineTax[i], i, line.Tax)
+        }
+      }
+    })
+  }
+}
+
+func TestRecalcUnknownItem(t *testing.T) {
+  defer func() {
+    if recover() == nil {
+      t.Error("Expecting an unknown menu item to be refused")
+    }
+  }()
+
+  order := Order{Menu: testMenu(), Items: OrderItems{{Id: 99, Qty: 1}}}
+  order.Recalc(Pricing{Tax: testTaxRules(true, "half-up"), Currency: "NZD"})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+  "net/http"
+  "encoding/json"
+  "log"
+  "strings"
+  "feedme/server/payments"
+  "feedme/server/sse"
+  "feedme/server/webhooks"
+  "github.com/jinzhu/gorm"
+)
+
+const (
+  PaymentNotRequired = "NotRequired"
+  PaymentPending = "PaymentPending"
+  Paid = "Paid"
+)
+
+func createPaymentIntent(tx *gorm.DB, order *OrderWithSessionID) *payments.Intent {
+  intent, err := payments.Get().CreateIntent(int64(order.Total), order.Currency, order.TrackingToken)
+  checkError(err)
+
+  order.PaymentIntentID = intent.ID
+  checkError(tx.Table("orders").
+    Where("restaurant_id=? AND number=?", order.RestaurantID, order.Number).
+    Update("payment_intent_id", intent.ID).Error)
+
+  return intent
+}
+
+// Sends a new order to the till and any webhooks, once it is paid for if payment is needed
+func publishNewOrder(tx *gorm.DB, order *OrderWithSessionID) {
+  tillOrder := &TillOrder{
+    Number: order.Number,
+    DisplayNumber: order.DisplayNumber,
+    ID: order.ID,
+    Name: order.Name,
+    Telephone: order.Telephone,
+    MenuID: order.MenuID,
+    MenuItems: order.Menu.Items,
+    Items: order.Items,
+    Allergens: order.Items.allergens(order.Menu.Items),
+    Status: order.Status,
+    StatusDate: order.StatusDate,
+    PaymentStatus: order.PaymentStatus,
+    Currency: order.Currency,
+    Total: order.Total,
+    Discounts: order.Discounts,
+    Charges: order.Charges,
+    NormalisedTelephone: order.NormalisedTelephone,
+    Suspicious: order.Suspicious,
+    Blocked: isBlockedNumber(tx, order.RestaurantID, order.NormalisedTelephone),
+    CreatedAt: order.CreatedAt,
+  }
+
+  webhooks.Fire(tx, order.RestaurantID, webhooks.OrderPlaced, tillOrder)
+  sse.Send(restaurantStreamKey(order.RestaurantID), &sse.Event{"order", tillOrder})
+}
+
+// Marks the order paid and publishes it, it is fine for this to happen more
+// than once for the same intent as webhooks may be repeated. An order that is
+// no longer New by the time the money arrives is refunded rather than sent to
+// the till.
+func markPaid(tx *gorm.DB, intentID string) {
+  result := tx.Table("orders").
+    Where("payment_intent_id=? AND payment_status=?", intentID, PaymentPending).
+    Update("payment_status", Paid)
+  checkError(result.Error)
+
+  if result.RowsAffected == 0 {
+    return
+  }
+
+  var order OrderWithSessionID
+  checkError(tx.Table("orders").Preload("Menu").Where("payment_intent_id=?", intentID).First(&order).Error)
+
+  if order.Status != "New" {
+    log.Printf("Order %d was paid for while %s, refunding it", order.Number, order.Status)
+    refundUnservedOrder(tx, &order.Order, "Order " + strings.ToLower(order.Status) + " before payment")
+    return
+  }
+
+  publishNewOrder(tx, &order)
+}
+
+// Confirms payment for the fake provider, real providers confirm in the browser
+func postPayOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  pay := struct {
+    Number uint
+    PaymentMethod string
+  }{}
+  checkError(json.NewDecoder(req.Body).Decode(&pay))
+
+  var order OrderWithSessionID
+  checkError(tx.Table("orders").
+    Where("restaurant_id=? AND number=? AND session_id=?", restaurant.ID, pay.Number, session.ID).
+    First(&order).Error)
+
+  if order.PaymentStatus == PaymentPending {
+    // Only New orders can still go to the till, e.g. not ones cancelled meanwhile
+    if order.Status != "New" {
+      json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: "This order has been " + strings.ToLower(order.Status) + " and can no longer be paid for."})
+      return
+    }
+
+    intent, err := payments.Get().Confirm(order.PaymentIntentID, pay.PaymentMethod)
+    if err != nil {
+      json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: err.Error()})
+      return
+    }
+
+    if intent.Status == payments.Succeeded {
+      markPaid(tx, intent.ID)
+    }
+  }
+
+  json.NewEncoder(w).Encode(OrderResult{Status: "OK", TrackingURL: order.TrackingURL()})
+}
+
+func postPaymentWebhook(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  if !payments.Enabled() {
+    http.NotFound(w, req)
+    return
+  }
+
+  event, err := payments.Get().VerifyWebhook(req)
+  if err != nil {
+    log.Printf("Payment webhook rejected: %s", err)
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+
+  switch event.Type {
+  case payments.EventPaymentSucceeded:
+    markPaid(tx, event.IntentID)
+  default:
+    log.Printf("Payment webhook: ignoring %s for %s", event.Type, event.IntentID)
+  }
+
+  w.WriteHeader(http.StatusOK)
+}
+
+func initPayments() {
+  switch Config.PaymentProvider {
+  case "":
+  case "fake":
+    payments.Init(payments.NewFakeProvider(Config.PaymentWebhookSecret))
+  default:
+    panic("Unknown payment provider: " + Config.PaymentProvider)
+  }
+}
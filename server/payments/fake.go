@@ -0,0 +1,144 @@
+package payments
+
+// An in-process provider for development. Card 4242424242424242 succeeds and
+// anything else is declined. Webhooks are signed with the configured secret
+// like a real provider, so the verification path can be exercised locally.
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "sync"
+)
+
+const FakeGoodCard = "4242424242424242"
+
+type FakeProvider struct {
+  WebhookSecret string
+
+  mutex sync.Mutex
+  intents map[string]*Intent
+  refunded map[string]int64
+  refunds map[string]*Refund
+}
+
+func NewFakeProvider(webhookSecret string) *FakeProvider {
+  return &FakeProvider{
+    WebhookSecret: webhookSecret,
+    intents: make(map[string]*Intent),
+    refunded: make(map[string]int64),
+    refunds: make(map[string]*Refund),
+  }
+}
+
+func (p *FakeProvider) CreateIntent(amount int64, currency string, reference string) (*Intent, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if amount <= 0 {
+    return nil, errors.New("Amount must be positive")
+  }
+
+  intent := &Intent{
+    ID: "pi_fake_" + randomHex(12),
+    Amount: amount,
+    Currency: currency,
+    Status: RequiresPayment,
+    ClientSecret: randomHex(16),
+  }
+  p.intents[intent.ID] = intent
+
+  result := *intent
+  return &result, nil
+}
+
+func (p *FakeProvider) Confirm(intentID string, paymentMethod string) (*Intent, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  intent, ok := p.intents[intentID]
+  if !ok {
+    return nil, fmt.Errorf("No such payment intent: %s", intentID)
+  }
+
+  if intent.Status != Succeeded {
+    if strings.Replace(paymentMethod, " ", "", -1) == FakeGoodCard {
+      intent.Status = Succeeded
+    } else {
+      intent.Status = Failed
+      return nil, ErrDeclined
+    }
+  }
+
+  result := *intent
+  return &result, nil
+}
+
+func (p *FakeProvider) Refund(intentID string, amount int64, idempotencyKey string) (*Refund, error) {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+
+  if refund, ok := p.refunds[idempotencyKey]; ok {
+    result := *refund
+    return &result, nil
+  }
+
+  intent, ok := p.intents[intentID]
+  if !ok {
+    return nil, fmt.Errorf("No such payment intent: %s", intentID)
+  }
+
+  if intent.Status != Succeeded {
+    return nil, errors.New("Payment has not succeeded")
+  }
+
+  if p.refunded[intentID] + amount > intent.Amount {
+    return nil, errors.New("Refund exceeds the amount paid")
+  }
+
+  p.refunded[intentID] += amount
+  refund := &Refund{"re_fake_" + randomHex(12), intentID, amount, Succeeded}
+  p.refunds[idempotencyKey] = refund
+
+  result := *refund
+  return &result, nil
+}
+
+// Expects the JSON encoded Event signed in the X-Fake-Signature header
+func (p *FakeProvider) VerifyWebhook(req *http.Request) (*Event, error) {
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  expected := p.Sign(body)
+  if !hmac.Equal([]byte(expected), []byte(req.Header.Get("X-Fake-Signature"))) {
+    return nil, ErrBadSignature
+  }
+
+  var event Event
+  err = json.Unmarshal(body, &event)
+  return &event, err
+}
+
+func (p *FakeProvider) Sign(body []byte) string {
+  mac := hmac.New(sha256.New, []byte(p.WebhookSecret))
+  mac.Write(body)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) string {
+  b := make([]byte, n)
+  _, err := rand.Read(b)
+  if err != nil {
+    panic(err)
+  }
+  return hex.EncodeToString(b)
+}
@@ -0,0 +1,82 @@
+package payments
+
+// Card payments go through a Provider. The order is created with a payment
+// intent, the customer confirms it (directly for the fake provider, or in the
+// provider's own UI for real ones) and the provider's webhook tells us when
+// the money has actually arrived.
+
+import (
+  "errors"
+  "net/http"
+)
+
+const (
+  RequiresPayment = "requires_payment"
+  Succeeded = "succeeded"
+  Failed = "failed"
+)
+
+const (
+  EventPaymentSucceeded = "payment.succeeded"
+  EventPaymentFailed = "payment.failed"
+  EventRefundSucceeded = "refund.succeeded"
+)
+
+var ErrDeclined = errors.New("Your card was declined")
+var ErrBadSignature = errors.New("Webhook signature is not valid")
+
+type Intent struct {
+  ID string
+  Amount int64
+  Currency string
+  Status string
+
+  // Handed to the browser so it can confirm the payment with the provider
+  ClientSecret string
+}
+
+type Refund struct {
+  ID string
+  IntentID string
+  Amount int64
+  Status string
+}
+
+type Event struct {
+  Type string
+  IntentID string
+  RefundID string
+}
+
+type Provider interface {
+  // Amounts are in the currency's minor unit, e.g. cents
+  CreateIntent(amount int64, currency string, reference string) (*Intent, error)
+
+  // Confirms an intent with the customer's payment details, for providers
+  // where the server sees them (only the fake one here)
+  Confirm(intentID string, paymentMethod string) (*Intent, error)
+
+  // Refunds with the same idempotency key are only made once, a repeat
+  // returns the refund already made
+  Refund(intentID string, amount int64, idempotencyKey string) (*Refund, error)
+
+  // Checks a webhook request really came from the provider and decodes it
+  VerifyWebhook(req *http.Request) (*Event, error)
+}
+
+var provider Provider
+
+func Init(p Provider) {
+  provider = p
+}
+
+func Enabled() bool {
+  return provider != nil
+}
+
+func Get() Provider {
+  if provider == nil {
+    panic("Payments are not enabled")
+  }
+  return provider
+}
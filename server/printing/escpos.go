@@ -0,0 +1,127 @@
+package printing
+
+// Renders kitchen tickets as ESC/POS, the command language spoken by nearly
+// all receipt printers.
+
+import (
+  "bytes"
+  "fmt"
+  "strings"
+  "time"
+)
+
+const lineWidth = 42
+
+var (
+  cmdInit = []byte{0x1b, '@'}
+  cmdAlignLeft = []byte{0x1b, 'a', 0}
+  cmdAlignCenter = []byte{0x1b, 'a', 1}
+  cmdBoldOn = []byte{0x1b, 'E', 1}
+  cmdBoldOff = []byte{0x1b, 'E', 0}
+  cmdDoubleSize = []byte{0x1d, '!', 0x11}
+  cmdNormalSize = []byte{0x1d, '!', 0}
+  cmdInvertOn = []byte{0x1d, 'B', 1}
+  cmdInvertOff = []byte{0x1d, 'B', 0}
+  cmdFeedAndCut = []byte{0x1d, 'V', 66, 3}
+)
+
+type Ticket struct {
+  Restaurant string
+  Number uint
+  Name string
+  Telephone string
+  Lines []TicketLine
+  Allergens []string
+  PickupTime *time.Time
+  CreatedAt time.Time
+  Reprint bool
+
+  // The restaurant's time zone, times are printed in it
+  Location *time.Location
+}
+
+type TicketLine struct {
+  Qty int
+  Name string
+  Options []string
+}
+
+func Render(t Ticket) []byte {
+  var b bytes.Buffer
+
+  b.Write(cmdInit)
+
+  b.Write(cmdAlignCenter)
+  text(&b, t.Restaurant)
+  b.Write(cmdDoubleSize)
+  b.Write(cmdBoldOn)
+  text(&b, fmt.Sprintf("ORDER #%d", t.Number))
+  b.Write(cmdBoldOff)
+  b.Write(cmdNormalSize)
+  if t.Reprint {
+    text(&b, "** REPRINT **")
+  }
+  b.Write(cmdAlignLeft)
+  text(&b, "")
+
+  text(&b, "Name:    " + t.Name)
+  text(&b, "Phone:   " + t.Telephone)
+  text(&b, "Ordered: " + t.CreatedAt.In(t.Location).Format("3:04pm 2 Jan"))
+  if t.PickupTime != nil {
+    b.Write(cmdBoldOn)
+    text(&b, "Pickup:  " + t.PickupTime.In(t.Location).Format("3:04pm"))
+    b.Write(cmdBoldOff)
+  }
+
+  // Allergy warnings must not be missed in a busy kitchen
+  if len(t.Allergens) > 0 {
+    text(&b, "")
+    b.Write(cmdInvertOn)
+    b.Write(cmdBoldOn)
+    text(&b, pad(" ALLERGENS: " + strings.ToUpper(strings.Join(t.Allergens, ", "))))
+    b.Write(cmdBoldOff)
+    b.Write(cmdInvertOff)
+  }
+
+  text(&b, strings.Repeat("-", lineWidth))
+
+  for _, line := range t.Lines {
+    b.Write(cmdDoubleSize)
+    text(&b, fmt.Sprintf("%d x %s", line.Qty, line.Name))
+    b.Write(cmdNormalSize)
+    for _, option := range line.Options {
+      text(&b, "    " + option)
+    }
+  }
+
+  text(&b, strings.Repeat("-", lineWidth))
+  b.Write(cmdFeedAndCut)
+
+  return b.Bytes()
+}
+
+func text(b *bytes.Buffer, s string) {
+  b.WriteString(ascii(s))
+  b.WriteByte('\n')
+}
+
+func pad(s string) string {
+  if len(s) < lineWidth {
+    return s + strings.Repeat(" ", lineWidth - len(s))
+  }
+  return s
+}
+
+// Printers default to a code page rather than UTF-8, keep to the safe subset
+func ascii(s string) string {
+  return strings.Map(func(r rune) rune {
+    switch {
+    case r == '–' || r == '—':
+      return '-'
+    case r < 0x20 || r > 0x7e:
+      return '?'
+    default:
+      return r
+    }
+  }, s)
+}
@@ -0,0 +1,103 @@
+package printing
+
+import (
+  "io/ioutil"
+  "net"
+  "sync"
+)
+
+// A stand in for a network printer which records what it is sent, for tests
+// and for developing without a printer (see tools/fakeprinter).
+type FakePrinter struct {
+  listener net.Listener
+  mutex sync.Mutex
+  jobs [][]byte
+  received chan []byte
+}
+
+// Listens on addr, use "127.0.0.1:0" for a free port
+func NewFakePrinter(addr string) (*FakePrinter, error) {
+  listener, err := net.Listen("tcp", addr)
+  if err != nil {
+    return nil, err
+  }
+
+  p := &FakePrinter{listener: listener, received: make(chan []byte, 64)}
+  go p.serve()
+  return p, nil
+}
+
+func (p *FakePrinter) Addr() string {
+  return p.listener.Addr().String()
+}
+
+// Each connection is one job, like a real printer in raw mode
+func (p *FakePrinter) serve() {
+  for {
+    conn, err := p.listener.Accept()
+    if err != nil {
+      close(p.received)
+      return
+    }
+
+    go func() {
+      defer conn.Close()
+      data, err := ioutil.ReadAll(conn)
+      if err != nil {
+        return
+      }
+
+      p.mutex.Lock()
+      p.jobs = append(p.jobs, data)
+      p.mutex.Unlock()
+
+      select {
+      case p.received <- data:
+      default:
+      }
+    }()
+  }
+}
+
+func (p *FakePrinter) Jobs() [][]byte {
+  p.mutex.Lock()
+  defer p.mutex.Unlock()
+  return append([][]byte{}, p.jobs...)
+}
+
+// Jobs as they arrive
+func (p *FakePrinter) Received() <-chan []byte {
+  return p.received
+}
+
+func (p *FakePrinter) Close() error {
+  return p.listener.Close()
+}
+
+// Strips ESC/POS commands leaving the printed text, handy for assertions and logging
+func PlainText(data []byte) string {
+  var out []byte
+
+  for i := 0; i < len(data); i++ {
+    switch data[i] {
+    case 0x1b:
+      switch {
+      case i + 1 < len(data) && data[i+1] == '@':
+        i += 1
+      default:
+        i += 2
+      }
+    case 0x1d:
+      switch {
+      case i + 1 < len(data) && data[i+1] == 'V':
+        i += 3
+      default:
+        i += 2
+      }
+    default:
+      out = append(out, data[i])
+    }
+  }
+
+  return string(out)
+}
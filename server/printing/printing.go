@@ -0,0 +1,101 @@
+package printing
+
+// Tickets are queued in the same transaction as the change that caused them
+// and sent to the restaurant's printer over raw TCP (port 9100) by a
+// background worker, so an offline printer never holds up the till.
+
+import (
+  "github.com/jinzhu/gorm"
+  "net"
+  "strings"
+  "time"
+  "feedme/server/queue"
+)
+
+const defaultPort = "9100"
+const maxAttempts = 20
+const retryInterval = 30 * time.Second
+const dialTimeout = 5 * time.Second
+const writeTimeout = 10 * time.Second
+
+type Job struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+  OrderNumber uint `gorm:"not null"`
+  Printer string `gorm:"not null"`
+  Data []byte `gorm:"not null"`
+
+  Attempts int `gorm:"not null"`
+  NextAttemptAt time.Time `gorm:"not null"`
+  PrintedAt *time.Time
+  LastError string
+
+  CreatedAt time.Time
+}
+
+func (Job) TableName() string {
+  return "print_jobs"
+}
+
+var jobs = queue.New(queue.Options{
+  Name: "Print job",
+  Table: "print_jobs",
+  DoneColumn: "printed_at",
+  MaxAttempts: maxAttempts,
+  PollInterval: retryInterval,
+  Backoff: retry,
+  Do: printJob,
+})
+
+func Queue(tx *gorm.DB, restaurantID uint, printer string, t Ticket) {
+  checkError(tx.Create(&Job{
+    RestaurantID: restaurantID,
+    OrderNumber: t.Number,
+    Printer: printerAddress(printer),
+    Data: Render(t),
+    NextAttemptAt: time.Now(),
+  }).Error)
+
+  jobs.Nudge()
+}
+
+// Printers are usually configured as just a host name or IP address
+func printerAddress(printer string) string {
+  if _, _, err := net.SplitHostPort(printer); err == nil {
+    return printer
+  }
+  return net.JoinHostPort(strings.TrimSpace(printer), defaultPort)
+}
+
+func Send(address string, data []byte) error {
+  conn, err := net.DialTimeout("tcp", address, dialTimeout)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+  _, err = conn.Write(data)
+  return err
+}
+
+func StartWorker(db *gorm.DB) {
+  jobs.StartWorker(db)
+}
+
+func printJob(db *gorm.DB, id uint) error {
+  var job Job
+  checkError(db.First(&job, id).Error)
+  return Send(job.Printer, job.Data)
+}
+
+// Printers are usually just switched off or out of paper, keep trying at a steady rate
+func retry(attempts int) time.Duration {
+  return retryInterval
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}
@@ -0,0 +1,113 @@
+package printing
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "time"
+)
+
+func testTicket() Ticket {
+  pickup := time.Date(2024, 3, 1, 18, 30, 0, 0, time.UTC)
+  return Ticket{
+    Restaurant: "Test Kitchen",
+    Number: 42,
+    Name: "Sam",
+    Telephone: "021 555 1234",
+    Lines: []TicketLine{
+      {Qty: 2, Name: "Burger", Options: []string{"No onions", "Extra cheese"}},
+      {Qty: 1, Name: "Chips"},
+    },
+    Allergens: []string{"gluten", "dairy"},
+    PickupTime: &pickup,
+    CreatedAt: pickup.Add(-30 * time.Minute),
+    Location: time.UTC,
+  }
+}
+
+func sendToFakePrinter(t *testing.T, data []byte) []byte {
+  printer, err := NewFakePrinter("127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer printer.Close()
+
+  if err := Send(printer.Addr(), data); err != nil {
+    t.Fatal(err)
+  }
+
+  select {
+  case received := <-printer.Received():
+    return received
+  case <-time.After(5 * time.Second):
+    t.Fatal("The fake printer received nothing")
+    return nil
+  }
+}
+
+func TestPrintTicket(t *testing.T) {
+  received := sendToFakePrinter(t, Render(testTicket()))
+
+  if !bytes.HasPrefix(received, cmdInit) {
+    t.Errorf("Expecting the printer to be initialised first, received % x", received[:2])
+  }
+  if !bytes.HasSuffix(received, cmdFeedAndCut) {
+    t.Errorf("Expecting the ticket to end with feed and cut, received % x", received[len(received)-4:])
+  }
+
+  expected := [][]byte{
+    join(cmdAlignCenter, []byte("Test Kitchen\n"), cmdDoubleSize, cmdBoldOn, []byte("ORDER #42\n"), cmdBoldOff, cmdNormalSize),
+    join(cmdInvertOn, cmdBoldOn, []byte(pad(" ALLERGENS: GLUTEN, DAIRY") + "\n"), cmdBoldOff, cmdInvertOff),
+    join(cmdDoubleSize, []byte("2 x Burger\n"), cmdNormalSize, []byte("    No onions\n    Extra cheese\n")),
+    join(cmdDoubleSize, []byte("1 x Chips\n"), cmdNormalSize),
+  }
+  for _, e := range expected {
+    if !bytes.Contains(received, e) {
+      t.Errorf("Expecting the ticket to contain % x", e)
+    }
+  }
+
+  if bytes.Contains(received, []byte("REPRINT")) {
+    t.Error("Expecting no reprint banner on the first print")
+  }
+}
+
+func TestPrintTimeZone(t *testing.T) {
+  location, err := time.LoadLocation("Pacific/Auckland")
+  if err != nil {
+    t.Skip("No time zone data: ", err)
+  }
+
+  ticket := testTicket()
+  ticket.Location = location
+
+  text := PlainText(sendToFakePrinter(t, Render(ticket)))
+  if !strings.Contains(text, "Ordered: 7:00am 2 Mar\n") || !strings.Contains(text, "Pickup:  7:30am\n") {
+    t.Errorf("Expecting times in the restaurant's time zone, received:\n%s", text)
+  }
+}
+
+func TestPrintReprint(t *testing.T) {
+  ticket := testTicket()
+  ticket.Reprint = true
+
+  text := PlainText(sendToFakePrinter(t, Render(ticket)))
+  if !strings.Contains(text, "ORDER #42\n** REPRINT **\n") {
+    t.Errorf("Expecting the reprint banner under the order number, received:\n%s", text)
+  }
+}
+
+func TestPrintNonASCII(t *testing.T) {
+  ticket := testTicket()
+  ticket.Name = "Zoë"
+  ticket.Lines = []TicketLine{{Qty: 1, Name: "Fish – battered"}}
+
+  text := PlainText(sendToFakePrinter(t, Render(ticket)))
+  if !strings.Contains(text, "Name:    Zo?\n") || !strings.Contains(text, "1 x Fish - battered\n") {
+    t.Errorf("Expecting printable ASCII only, received:\n%s", text)
+  }
+}
+
+func join(parts ...[]byte) []byte {
+  return bytes.Join(parts, nil)
+}
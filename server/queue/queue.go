@@ -0,0 +1,149 @@
+package queue
+
+// Jobs such as notifications, webhooks and print tickets are queued as rows
+// in the same transaction as the change that caused them, then done by a
+// background worker with retries. A slow or failing destination never holds
+// up the request that queued the job.
+//
+// A queue's table has id, attempts, next_attempt_at and last_error columns,
+// and a column set to the time the job was done. The worker claims a job by
+// moving its next attempt on, so the row isn't locked while the job talks to
+// the outside world and other servers leave it alone meanwhile.
+
+import (
+  "github.com/jinzhu/gorm"
+  "log"
+  "time"
+)
+
+// Longer than any job should take, a job still unfinished after this is
+// assumed lost with its server and tried again
+const claimTime = 5 * time.Minute
+
+type Options struct {
+  // For logs, e.g. "Notification"
+  Name string
+
+  Table string
+  DoneColumn string
+
+  MaxAttempts int
+
+  // How often the worker looks for due jobs when it isn't nudged
+  PollInterval time.Duration
+
+  // How long to wait before trying again after the given number of attempts
+  Backoff func(attempts int) time.Duration
+
+  // Does the job with the ID, an error means it is tried again later
+  Do func(db *gorm.DB, id uint) error
+}
+
+type Queue struct {
+  Options
+  wake chan struct{}
+}
+
+func New(options Options) *Queue {
+  return &Queue{options, make(chan struct{}, 1)}
+}
+
+// Wakes the worker for a job just queued. Does not wait for the transaction
+// to commit, the next poll picks the job up if this misses.
+func (q *Queue) Nudge() {
+  select {
+  case q.wake <- struct{}{}:
+  default:
+  }
+}
+
+func (q *Queue) StartWorker(db *gorm.DB) {
+  go func() {
+    ticker := time.NewTicker(q.PollInterval)
+    defer ticker.Stop()
+
+    for {
+      q.doDue(db)
+
+      select {
+      case <-ticker.C:
+      case <-q.wake:
+        // Give the queuing transaction a moment to commit
+        time.Sleep(100 * time.Millisecond)
+      }
+    }
+  }()
+}
+
+func (q *Queue) doDue(db *gorm.DB) {
+  defer func() {
+    if err := recover(); err != nil {
+      log.Printf("%s queue: %s", q.Name, err)
+    }
+  }()
+
+  for q.doNext(db) {
+  }
+}
+
+// Does one due job, returns false when there are none left
+func (q *Queue) doNext(db *gorm.DB) bool {
+  id, attempts, ok := q.claimNext(db)
+  if !ok {
+    return false
+  }
+
+  doErr := q.Do(db, id)
+
+  updates := map[string]interface{}{}
+  if doErr == nil {
+    updates[q.DoneColumn] = time.Now()
+    updates["last_error"] = ""
+  } else {
+    log.Printf("%s %d failed (attempt %d): %s", q.Name, id, attempts, doErr)
+    updates["last_error"] = doErr.Error()
+    updates["next_attempt_at"] = time.Now().Add(q.Backoff(attempts))
+  }
+
+  checkError(db.Table(q.Table).Where("id=?", id).Updates(updates).Error)
+  return true
+}
+
+// Counts the attempt and moves the next one on by claimTime, returns false
+// when no jobs are due
+func (q *Queue) claimNext(db *gorm.DB) (uint, int, bool) {
+  tx := db.Begin()
+  defer tx.Rollback()
+
+  var job struct {
+    ID uint
+    Attempts int
+  }
+  err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+          Table(q.Table).
+          Select("id, attempts").
+          Where(q.DoneColumn + " IS NULL AND attempts < ? AND next_attempt_at <= ?", q.MaxAttempts, time.Now()).
+          Order("id").
+          Limit(1).
+          Scan(&job).Error
+
+  if gorm.IsRecordNotFoundError(err) {
+    return 0, 0, false
+  }
+  checkError(err)
+
+  job.Attempts++
+  checkError(tx.Table(q.Table).Where("id=?", job.ID).Updates(map[string]interface{}{
+    "attempts": job.Attempts,
+    "next_attempt_at": time.Now().Add(claimTime),
+  }).Error)
+  checkError(tx.Commit().Error)
+
+  return job.ID, job.Attempts, true
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}
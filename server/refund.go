@@ -0,0 +1,259 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "time"
+  "feedme/server/payments"
+  "feedme/server/sse"
+  ef "feedme/server/editform"
+  "github.com/gorilla/mux"
+  "github.com/jinzhu/gorm"
+)
+
+const (
+  PartiallyRefunded = "PartiallyRefunded"
+  Refunded = "Refunded"
+)
+
+// Refund rows are written before the provider is asked for the money
+const (
+  RefundPending = "pending"
+  RefundSucceeded = "succeeded"
+)
+
+// Money returned to the customer for an order. Lines is empty for a refund of
+// whatever was left on the order, otherwise it holds the items and quantities refunded.
+type Refund struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+  OrderNumber uint `gorm:"not null"`
+  Lines OrderItems `gorm:"type:text"`
+  Amount Money `gorm:"not null"`
+  Reason string `gorm:"not null"`
+  ProviderRefundID string `gorm:"not null" json:"-"`
+  Status string `gorm:"not null" json:"-"`
+  CreatedAt time.Time
+}
+
+// Till refund PINs are short, so after this many wrong ones in the lockout
+// time the restaurant can't refund from the till until it passes
+const refundPINMaxFailures = 5
+const refundPINLockout = 15 * time.Minute
+
+type RefundPINFailure struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+  ClientIP string
+  CreatedAt time.Time
+}
+
+type RefundRequest struct {
+  Number uint
+  Lines OrderItems
+  Reason string
+  PIN string
+}
+
+type RefundUpdate struct {
+  Number uint
+  PaymentStatus string
+  Refunded Money
+}
+
+func fetchRefunds(tx *gorm.DB, restaurantID, number uint) []Refund {
+  refunds := []Refund{}
+  checkError(tx.
+    Where("restaurant_id=? AND order_number=?", restaurantID, number).
+    Order("id asc").
+    Find(&refunds).Error)
+  return refunds
+}
+
+func refundedTotal(refunds []Refund) Money {
+  var total Money
+  for _, refund := range refunds {
+    total += refund.Amount
+  }
+  return total
+}
+
+// Refunds the given lines of an order, or everything not yet refunded when
+// lines is empty. Returns an error message for the cashier, or "" on success.
+func issueRefund(tx *gorm.DB, restaurantID, number uint, lines OrderItems, reason string) string {
+  // Locking the order stops two cashiers refunding the same money
+  var order Order
+  checkError(tx.Set("gorm:query_option", "FOR UPDATE").
+    Preload("Menu").
+    Where("restaurant_id=? AND number=?", restaurantID, number).
+    First(&order).Error)
+
+  if order.PaymentStatus != Paid && order.PaymentStatus != PartiallyRefunded {
+    return "This order has not been paid online."
+  }
+
+  refunds := fetchRefunds(tx, restaurantID, number)
+  remaining := order.Total - refundedTotal(refunds)
+
+  var amount Money
+  if len(lines) == 0 {
+    amount = remaining
+  } else {
+    var err string
+    amount, err = refundLinesAmount(&order, refunds, lines)
+    if err != "" {
+      return err
+    }
+  }
+
+  if amount <= 0 || amount > remaining {
+    return "Nothing left to refund on this order."
+  }
+
+  refund := Refund{
+    RestaurantID: restaurantID,
+    OrderNumber: number,
+    Lines: lines,
+    Amount: amount,
+    Reason: reason,
+    Status: RefundPending,
+  }
+  checkError(tx.Create(&refund).Error)
+
+  // If this transaction is rolled back after the money has gone, a retry
+  // works out the same key and the provider returns the refund it already made
+  key := fmt.Sprintf("refund-%s-%d-%d", order.PaymentIntentID, len(refunds) + 1, amount)
+
+  providerRefund, err := payments.Get().Refund(order.PaymentIntentID, int64(amount), key)
+  if err != nil {
+    log.Printf("Refund of order %d failed: %s", number, err)
+    checkError(tx.Delete(&refund).Error)
+    return "The payment provider refused the refund: " + err.Error()
+  }
+
+  checkError(tx.Model(&refund).Updates(map[string]interface{}{
+    "provider_refund_id": providerRefund.ID,
+    "status": RefundSucceeded,
+  }).Error)
+
+  update := RefundUpdate{number, PartiallyRefunded, order.Total - remaining + amount}
+  if amount == remaining {
+    update.PaymentStatus = Refunded
+  }
+
+  checkError(tx.Model(&order).Update("payment_status", update.PaymentStatus).Error)
+
+  sse.Send(restaurantStreamKey(restaurantID), &sse.Event{"refund", &update})
+  return ""
+}
+
+// Prices the refunded lines from the order's own menu, checking they are not
+// refunded more times than they were ordered.
+func refundLinesAmount(order *Order, refunds []Refund, lines OrderItems) (Money, string) {
+  refundedQty := make(map[int]int)
+  for _, refund := range refunds {
+    for _, line := range refund.Lines {
+      refundedQty[line.Id] += line.Qty
+    }
+  }
+
+  orderedQty := make(map[int]int)
+  for _, item := range order.Items {
+    orderedQty[item.Id] += item.Qty
+  }
+
+  var amount Money
+  for _, line := range lines {
+    menuItem := order.Menu.Items.itemById(line.Id)
+    if menuItem == nil || line.Qty <= 0 {
+      return 0, "That item is not on this order."
+    }
+
+    refundedQty[line.Id] += line.Qty
+    if refundedQty[line.Id] > orderedQty[line.Id] {
+      return 0, menuItem.Name + " has already been refunded."
+    }
+
+    amount += Money(line.Qty) * menuItem.Price - order.lineDiscount(line.Id, line.Qty) + order.lineTax(line.Id, line.Qty)
+  }
+
+  return amount, ""
+}
+
+// Rejected and cancelled orders never reach the customer so they get their
+// money back automatically. A failed refund must not stop the rejection or
+// cancellation, the cashier can retry it.
+func refundUnservedOrder(tx *gorm.DB, order *Order, reason string) {
+  if order.PaymentStatus != Paid && order.PaymentStatus != PartiallyRefunded {
+    return
+  }
+
+  if err := issueRefund(tx, order.RestaurantID, order.Number, nil, reason); err != "" {
+    log.Printf("Automatic refund of order %d failed: %s", order.Number, err)
+  }
+}
+
+func postTillRefundOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  var refund RefundRequest
+  checkError(json.NewDecoder(req.Body).Decode(&refund))
+
+  if err := checkRefundPIN(tx, restaurant, refund.PIN, clientIP(req)); err != "" {
+    writeRefundResult(w, err)
+    return
+  }
+
+  writeRefundResult(w, issueRefund(tx, restaurant.ID, refund.Number, refund.Lines, refund.Reason))
+}
+
+// Returns an error message for the cashier when the PIN is wrong or the till
+// is locked out
+func checkRefundPIN(tx *gorm.DB, restaurant *Restaurant, pin, clientIP string) string {
+  if restaurant.RefundPIN == "" {
+    return "Incorrect refund PIN."
+  }
+
+  // Locking the restaurant makes guesses sent at once wait their turn to be counted
+  checkError(tx.Set("gorm:query_option", "FOR UPDATE").Select("id").First(&Restaurant{}, restaurant.ID).Error)
+
+  var failures int
+  checkError(tx.Model(&RefundPINFailure{}).
+    Where("restaurant_id=? AND created_at>?", restaurant.ID, time.Now().Add(-refundPINLockout)).
+    Count(&failures).Error)
+  if failures >= refundPINMaxFailures {
+    log.Printf("Refund PIN locked for restaurant %d", restaurant.ID)
+    return fmt.Sprintf("Too many incorrect PINs, please try again in %d minutes.", int(refundPINLockout.Minutes()))
+  }
+
+  if subtle.ConstantTimeCompare([]byte(pin), []byte(restaurant.RefundPIN)) != 1 {
+    checkError(tx.Create(&RefundPINFailure{RestaurantID: restaurant.ID, ClientIP: clientIP}).Error)
+    return "Incorrect refund PIN."
+  }
+
+  checkError(tx.Where("restaurant_id=?", restaurant.ID).Delete(RefundPINFailure{}).Error)
+  return ""
+}
+
+func postAdminRefundOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  var refund RefundRequest
+  checkError(json.NewDecoder(req.Body).Decode(&refund))
+
+  number, err := strconv.ParseUint(mux.Vars(req)["number"], 10, 32)
+  checkError(err)
+
+  writeRefundResult(w, issueRefund(tx, ef.GetId(req), uint(number), refund.Lines, refund.Reason))
+}
+
+func writeRefundResult(w http.ResponseWriter, err string) {
+  w.Header().Set("Content-Type", "application/json")
+
+  if err != "" {
+    json.NewEncoder(w).Encode(OrderResult{Status: "ERR", Error: err})
+    return
+  }
+
+  json.NewEncoder(w).Encode(OrderResult{Status: "OK"})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+  "encoding/csv"
+  "fmt"
+  "net/http"
+  "sort"
+  "strconv"
+  "time"
+  "feedme/server/templates"
+  "feedme/server/currency"
+  ef "feedme/server/editform"
+  "github.com/jinzhu/gorm"
+)
+
+const reportDateFormat = "2006-01-02"
+const topItemsCount = 10
+
+type ReportFilter struct {
+  From string
+  To string
+  Period string
+}
+
+type ReportRow struct {
+  Period string
+  Orders int
+  // Item revenue, tips and surcharges are reported separately
+  Sales Money
+  Tips Money
+  Surcharges Money
+  GST Money
+  Refunds Money
+  NetSales Money
+  AverageOrder Money
+  Rejected int
+  RejectedRate float64
+  Cancelled int
+}
+
+type TopItem struct {
+  Name string
+  Qty int
+  Sales Money
+}
+
+type SalesReport struct {
+  Filter ReportFilter
+  TimeZone string
+  Currency currency.Currency
+  Rows []ReportRow
+  Total ReportRow
+  TopItems []TopItem
+}
+
+// Defaults to the last 30 days, by day
+func parseReportFilter(req *http.Request, location *time.Location) (ReportFilter, time.Time, time.Time) {
+  query := req.URL.Query()
+  today := time.Now().In(location)
+
+  filter := ReportFilter{
+    From: today.AddDate(0, 0, -29).Format(reportDateFormat),
+    To: today.Format(reportDateFormat),
+    Period: "day",
+  }
+
+  if from := query.Get("from"); from != "" {
+    filter.From = from
+  }
+  if to := query.Get("to"); to != "" {
+    filter.To = to
+  }
+  if period := query.Get("period"); period != "" {
+    filter.Period = period
+  }
+
+  if filter.Period != "day" && filter.Period != "week" && filter.Period != "month" {
+    panic(templates.BadRequest("Expecting period day, week or month, received: " + filter.Period))
+  }
+
+  from, err := time.ParseInLocation(reportDateFormat, filter.From, location)
+  if err != nil {
+    panic(templates.BadRequest("Expecting from date as YYYY-MM-DD, received: " + filter.From))
+  }
+
+  to, err := time.ParseInLocation(reportDateFormat, filter.To, location)
+  if err != nil {
+    panic(templates.BadRequest("Expecting to date as YYYY-MM-DD, received: " + filter.To))
+  }
+
+  // The to date is inclusive
+  return filter, from, to.AddDate(0, 0, 1)
+}
+
+// The first day of the period containing t, as reported
+func periodStart(t time.Time, period string) string {
+  switch period {
+  case "week":
+    // Weeks start on Monday
+    offset := (int(t.Weekday()) + 6) % 7
+    return t.AddDate(0, 0, -offset).Format(reportDateFormat)
+  case "month":
+    return t.Format("2006-01")
+  default:
+    return t.Format(reportDateFormat)
+  }
+}
+
+func buildSalesReport(tx *gorm.DB, restaurant *Restaurant, req *http.Request) *SalesReport {
+  location := restaurant.Location()
+  filter, from, to := parseReportFilter(req, location)
+
+  var orders []Order
+  checkError(tx.
+    Where("restaurant_id=? AND created_at>=? AND created_at<? AND payment_status<>?", restaurant.ID, from, to, PaymentPending).
+    Order("created_at asc").
+    Find(&orders).Error)
+
+  var refunds []Refund
+  checkError(tx.
+    Joins("JOIN orders ON orders.restaurant_id = refunds.restaurant_id AND orders.number = refunds.order_number").
+    Where("orders.restaurant_id=? AND orders.created_at>=? AND orders.created_at<?", restaurant.ID, from, to).
+    Find(&refunds).Error)
+
+  refunded := make(map[uint]Money)
+  for _, refund := range refunds {
+    refunded[refund.OrderNumber] += refund.Amount
+  }
+
+  report := &SalesReport{
+    Filter: filter,
+    TimeZone: location.String(),
+    Currency: restaurant.CurrencyFormat,
+    Rows: []ReportRow{},
+  }
+  rowIndex := make(map[string]int)
+  items := make(map[string]*TopItem)
+  menus := make(map[uint]*Menu)
+
+  for _, order := range orders {
+    key := periodStart(order.CreatedAt.In(location), filter.Period)
+    i, ok := rowIndex[key]
+    if !ok {
+      report.Rows = append(report.Rows, ReportRow{Period: key})
+      i = len(report.Rows) - 1
+      rowIndex[key] = i
+    }
+    row := &report.Rows[i]
+
+    for _, r := range []*ReportRow{row, &report.Total} {
+      r.Orders++
+      switch order.Status {
+      case "Rejected":
+        r.Rejected++
+      case "Cancelled":
+        r.Cancelled++
+      default:
+        tips, surcharges := order.chargeTotals()
+        r.Sales += order.Total - tips - surcharges
+        r.Tips += tips
+        r.Surcharges += surcharges
+        r.GST += order.GST
+        r.Refunds += refunded[order.Number]
+      }
+    }
+
+    if order.Status == "Rejected" || order.Status == "Cancelled" {
+      continue
+    }
+
+    // Item names and prices come from the menu the order was placed against
+    menu := menus[order.MenuID]
+    if menu == nil {
+      menu = fetchMenu(tx, order.MenuID)
+      menus[order.MenuID] = menu
+    }
+
+    for _, item := range order.Items {
+      menuItem := menu.Items.itemById(item.Id)
+      if menuItem == nil {
+        continue
+      }
+      topItem := items[menuItem.Name]
+      if topItem == nil {
+        topItem = &TopItem{Name: menuItem.Name}
+        items[menuItem.Name] = topItem
+      }
+      topItem.Qty += item.Qty
+      topItem.Sales += Money(item.Qty) * menuItem.Price
+    }
+  }
+
+  report.Total.Period = "Total"
+  for i := range report.Rows {
+    report.Rows[i].finish()
+  }
+  report.Total.finish()
+
+  report.TopItems = []TopItem{}
+  for _, item := range items {
+    report.TopItems = append(report.TopItems, *item)
+  }
+  sort.Slice(report.TopItems, func(i, j int) bool {
+    if report.TopItems[i].Qty != report.TopItems[j].Qty {
+      return report.TopItems[i].Qty > report.TopItems[j].Qty
+    }
+    return report.TopItems[i].Name < report.TopItems[j].Name
+  })
+  if len(report.TopItems) > topItemsCount {
+    report.TopItems = report.TopItems[:topItemsCount]
+  }
+
+  return report
+}
+
+// Net sales is everything taken less refunds
+func (r *ReportRow) finish() {
+  r.NetSales = r.Sales + r.Tips + r.Surcharges - r.Refunds
+
+  if completed := r.Orders - r.Rejected - r.Cancelled; completed > 0 {
+    r.AverageOrder = r.Sales / Money(completed)
+  }
+
+  if r.Orders > 0 {
+    r.RejectedRate = float64(r.Rejected) / float64(r.Orders)
+  }
+}
+
+func writeSalesReportCSV(w http.ResponseWriter, restaurant *Restaurant, report *SalesReport) {
+  filename := fmt.Sprintf("%s-sales-%s-%s.csv", restaurant.Slug, report.Filter.From, report.Filter.To)
+  w.Header().Set("Content-Type", "text/csv")
+  w.Header().Set("Content-Disposition", "attachment; filename=\"" + filename + "\"")
+
+  out := csv.NewWriter(w)
+  checkError(out.Write([]string{"Period", "Currency", "Orders", "Sales", "Tips", "Surcharges", "GST", "Refunds", "Net Sales", "Average Order", "Rejected", "Rejected Rate"}))
+
+  c := report.Currency
+  for _, row := range append(report.Rows, report.Total) {
+    checkError(out.Write([]string{
+      row.Period,
+      c.Code,
+      strconv.Itoa(row.Orders),
+      row.Sales.FormatPlain(c),
+      row.Tips.FormatPlain(c),
+      row.Surcharges.FormatPlain(c),
+      row.GST.FormatPlain(c),
+      row.Refunds.FormatPlain(c),
+      row.NetSales.FormatPlain(c),
+      row.AverageOrder.FormatPlain(c),
+      strconv.Itoa(row.Rejected),
+      strconv.FormatFloat(row.RejectedRate * 100, 'f', 1, 64) + "%",
+    }))
+  }
+
+  out.Flush()
+  checkError(out.Error())
+}
+
+func serveSalesReport(w http.ResponseWriter, req *http.Request, tx *gorm.DB, restaurant *Restaurant, url string) {
+  report := buildSalesReport(tx, restaurant, req)
+
+  if req.URL.Query().Get("format") == "csv" {
+    writeSalesReportCSV(w, restaurant, report)
+    return
+  }
+
+  flags := struct {
+    Restaurant *Restaurant
+    Url string
+    Report *SalesReport
+  }{
+    restaurant,
+    url,
+    report,
+  }
+
+  templates.ElmApp(w, req, "Reports", flags)
+}
+
+// For restaurant owners on their own site
+func getSalesReport(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  serveSalesReport(w, req, tx, restaurant, "/reports")
+}
+
+func getAdminSalesReport(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  var restaurant Restaurant
+  checkError(tx.First(&restaurant, ef.GetId(req)).Error)
+
+  serveSalesReport(w, req, tx, &restaurant, fmt.Sprintf("/admin/restaurants/%d/reports", restaurant.ID))
+}
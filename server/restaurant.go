@@ -3,6 +3,8 @@ package main
 import (
   "time"
   "github.com/jinzhu/gorm"
+  "feedme/server/images"
+  "feedme/server/currency"
 )
 
 type restaurantStreamKey int
@@ -23,17 +25,104 @@ type Restaurant struct {
 
   About string
 
+  // Host or host:port of an ESC/POS network printer for kitchen tickets
+  PrinterAddress string `json:"-"`
+
+  // Cashiers must enter this to refund from the till, refunds are admin only when empty
+  RefundPIN string `json:"-"`
+
+  // IANA name such as Pacific/Auckland, reports are by day in this zone
+  TimeZone string
+
+  // "daily" starts the numbers cashiers see from 1 each day, "never" keeps counting
+  OrderNumberReset string
+
+  // Comma separated percentages offered to customers as tips, empty when tips are not taken
+  TipOptions string
+
+  // The restaurant's own domain, such as order.example.com, used once verified
+  CustomDomain string
+
+  // "yes" makes customers verify their phone number with a texted code before ordering
+  VerifyPhone string
+
+  // ISO 4217 code, prices and totals are in its minor units. Can't change
+  // once there are orders, see currencyFixedOnceOrdered.
+  Currency string `gorm:"not null"`
+
+  // Symbol and decimal places for the currency, for the pages that show prices
+  CurrencyFormat currency.Currency `gorm:"-"`
+
   CreatedAt time.Time
   UpdatedAt time.Time
 }
 
 func (r *Restaurant) AfterCreate(tx *gorm.DB) (err error) {
-  return tx.Create(&RestaurantOrderNumber{r.ID, 0}).Error
+  err = tx.Create(&RestaurantOrderNumber{r.ID, 0, 0, ""}).Error
+  if err != nil { return err }
+
+  err = tx.Create(defaultRestaurantNotifications(r.ID)).Error
+  if err != nil { return err }
+
+  return tx.Create(defaultRestaurantTaxSettings(r.ID)).Error
+}
+
+func (r *Restaurant) AfterFind() error {
+  r.CurrencyFormat = currency.Get(r.Currency)
+  return nil
+}
+
+func (r *Restaurant) Location() *time.Location {
+  location, err := time.LoadLocation(r.TimeZone)
+  if err != nil {
+    return time.UTC
+  }
+  return location
 }
 
 type RestaurantOrderNumber struct {
   RestaurantID uint `gorm:"primary_key"`
   LastOrderNumber uint
+  LastDisplayNumber uint
+
+  // Day of the last display number in the restaurant's time zone, for daily resets
+  DisplayDate string
+}
+
+// Returns the internal order number, which always increases, and the number
+// shown to cashiers and customers, which restarts at 1 each day if the
+// restaurant resets daily.
+func nextOrderNumbers(tx *gorm.DB, restaurant *Restaurant) (number, displayNumber uint) {
+  today := time.Now().In(restaurant.Location()).Format("2006-01-02")
+  daily := restaurant.OrderNumberReset == "daily"
+
+  query := `UPDATE restaurant_order_numbers SET
+              last_order_number = last_order_number + 1,
+              last_display_number = CASE WHEN $2 AND display_date <> $3 THEN 1 ELSE last_display_number + 1 END,
+              display_date = $3
+            WHERE restaurant_id=$1
+            RETURNING last_order_number, last_display_number`
+  checkError(tx.CommonDB().QueryRow(query, restaurant.ID, daily, today).Scan(&number, &displayNumber))
+
+  return number, displayNumber
+}
+
+// Kept out of Restaurant so saving the edit form does not clobber it
+type RestaurantLogo struct {
+  RestaurantID uint `gorm:"primary_key"`
+  Image images.Image `gorm:"type:text"`
+}
+
+func fetchRestaurantLogo(tx *gorm.DB, restaurantID uint) images.Image {
+  var logo RestaurantLogo
+
+  err := tx.Where("restaurant_id=?", restaurantID).First(&logo).Error
+  if gorm.IsRecordNotFoundError(err) {
+    return nil
+  }
+
+  checkError(err)
+  return logo.Image
 }
 
 func fetchRestaurantBySlug(tx *gorm.DB, slug string) *Restaurant {
@@ -41,3 +130,10 @@ func fetchRestaurantBySlug(tx *gorm.DB, slug string) *Restaurant {
   checkError(tx.Where("slug=?", slug).Find(&restaurant).Error)
   return &restaurant
 }
+
+func restaurantURL(slug string, urlPort string) string {
+  if domain := customDomains.verifiedDomain(slug); domain != "" {
+    return urlScheme() + "://" + domain + urlPort + "/"
+  }
+  return urlScheme() + "://" + slug + "." + Config.DomainName + urlPort + "/"
+}
@@ -0,0 +1,159 @@
+package main
+
+// Sessions are stored so they can expire and be revoked. The cookie carries
+// the signed ID and expiry, handlers are given the row loaded by startSession.
+// The row is only written once something is saved against the session, so
+// bots and visitors who never log in or order don't each add one.
+
+import (
+  "log"
+  "net/http"
+  "time"
+  "github.com/jinzhu/gorm"
+)
+
+// Saving the last seen time on every request would mean a write for every
+// page view, so it is only updated this often
+const sessionTouchInterval = time.Hour
+
+type Session struct {
+  ID string `gorm:"primary_key"`
+
+  // Set while a customer is logged in
+  CustomerID *uint
+
+  CreatedAt time.Time
+  LastSeenAt time.Time
+  ExpiresAt time.Time
+  RevokedAt *time.Time
+
+  // Whether the row has been written yet
+  stored bool
+}
+
+func sessionIdleTime() time.Duration {
+  return time.Duration(Config.SessionIdleDays) * 24 * time.Hour
+}
+
+// Loads the session from the cookie, starting a new one when there isn't a
+// cookie or its session has expired or been revoked. A cookie we signed
+// without a row is a session nothing has been saved against yet. Rows are
+// kept until they expire, so a revoked session can't come back that way.
+func startSession(w http.ResponseWriter, req *http.Request, db *gorm.DB) *Session {
+  var session *Session
+  now := time.Now()
+
+  if sessionID, expires, ok := sessionFromRequest(req); ok && expires.After(now) {
+    stored := fetchSession(db, sessionID)
+    if stored == nil {
+      session = &Session{
+        ID: sessionID,
+        LastSeenAt: expires.Add(-sessionIdleTime()),
+        ExpiresAt: expires,
+      }
+    } else if stored.ExpiresAt.After(now) && stored.RevokedAt == nil {
+      session = stored
+    }
+  }
+
+  if session == nil {
+    session = newSession()
+    setSessionCookie(w, session)
+  } else if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+    session.LastSeenAt = now
+    session.ExpiresAt = now.Add(sessionIdleTime())
+    if session.stored {
+      checkError(db.Model(session).Updates(map[string]interface{}{
+        "last_seen_at": session.LastSeenAt,
+        "expires_at": session.ExpiresAt,
+      }).Error)
+    }
+    setSessionCookie(w, session)
+  }
+
+  return session
+}
+
+func newSession() *Session {
+  now := time.Now()
+  return &Session{
+    ID: randomIdString(),
+    LastSeenAt: now,
+    ExpiresAt: now.Add(sessionIdleTime()),
+  }
+}
+
+// Returns nil when there is no row for the session
+func fetchSession(db *gorm.DB, sessionID string) *Session {
+  var session Session
+
+  err := db.Where("id=?", sessionID).First(&session).Error
+  if gorm.IsRecordNotFoundError(err) {
+    return nil
+  }
+
+  checkError(err)
+  session.stored = true
+  return &session
+}
+
+// Writes the session's row the first time something is saved against it.
+// Two requests from a new session can get here at once, so a row the other
+// wrote is fine.
+func (s *Session) save(tx *gorm.DB) {
+  if s.stored {
+    return
+  }
+
+  checkError(tx.Exec(
+    "INSERT INTO sessions (id, customer_id, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING",
+    s.ID, s.CustomerID, time.Now(), s.LastSeenAt, s.ExpiresAt).Error)
+  s.stored = true
+}
+
+// Replaces the session with a new one under a new ID, revoking the old one.
+// Done on login and logout so an ID someone else planted or saw beforehand
+// is no use afterwards.
+func rotateSession(w http.ResponseWriter, tx *gorm.DB, session *Session) {
+  if session.stored {
+    checkError(tx.Model(&Session{}).Where("id=?", session.ID).Update("revoked_at", time.Now()).Error)
+  }
+
+  *session = *newSession()
+  setSessionCookie(w, session)
+}
+
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+  http.SetCookie(w, &http.Cookie{
+    Name: "session",
+    Value: signSession(session.ID, session.ExpiresAt),
+    Path: "/",
+    Expires: session.ExpiresAt,
+    HttpOnly: true,
+    Secure: Config.SecureCookies,
+    SameSite: cookieSameSite(),
+  })
+}
+
+// Revokes the customer's other sessions, for when they have logged in
+// somewhere they shouldn't have stayed logged in
+func revokeCustomerSessions(tx *gorm.DB, customerID uint, except *Session) {
+  checkError(tx.Model(&Session{}).
+    Where("customer_id=? AND id<>? AND revoked_at IS NULL", customerID, except.ID).
+    Update("revoked_at", time.Now()).Error)
+}
+
+// Deletes sessions a day after they expire, hourly. Revoked sessions are kept
+// until then too, as their cookies are still signed.
+func startSessionPurger(db *gorm.DB) {
+  go func() {
+    for {
+      cutoff := time.Now().Add(-24 * time.Hour)
+      err := db.Where("expires_at<?", cutoff).Delete(Session{}).Error
+      if err != nil {
+        log.Printf("Purging sessions: %s", err)
+      }
+      time.Sleep(time.Hour)
+    }
+  }()
+}
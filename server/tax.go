@@ -0,0 +1,297 @@
+package main
+
+import (
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "math"
+  "strconv"
+  "strings"
+  "github.com/jinzhu/gorm"
+  ef "feedme/server/editform"
+)
+
+// Tax settings as entered in the admin, ID is the restaurant's ID.
+// Rates are percentages, Categories has one "name rate" per line for
+// menu items taxed differently to the standard rate, e.g. "zero 0".
+type RestaurantTaxSettings struct {
+  ID uint
+
+  Rate string
+  Prices string
+  Rounding string
+  Categories string
+  Tips string
+}
+
+const (
+  TaxInclusive = "inclusive"
+  TaxExclusive = "exclusive"
+)
+
+const (
+  TipsTaxed = "taxed"
+  TipsUntaxed = "untaxed"
+)
+
+var TaxRoundingModes = []string{"half-up", "half-even", "down", "up"}
+
+func defaultRestaurantTaxSettings(restaurantID uint) *RestaurantTaxSettings {
+  return &RestaurantTaxSettings{
+    ID: restaurantID,
+    Rate: "15",
+    Prices: TaxInclusive,
+    Rounding: "half-up",
+    Tips: TipsUntaxed,
+  }
+}
+
+// The parsed settings, stored on each order so it keeps the calculation it was placed with.
+// Rates are in basis points, 1500 is 15%.
+type TaxRules struct {
+  Rate int
+  Inclusive bool
+  Rounding string
+  Categories map[string]int `json:",omitempty"`
+  TaxTips bool `json:",omitempty"`
+}
+
+// Tax is charged on Amount less Discount, the line's share of any promotions
+type TaxLine struct {
+  Id int
+  Qty int `json:",omitempty"`
+  Category string `json:",omitempty"`
+  Rate int
+  Amount Money
+  Discount Money `json:",omitempty"`
+  Tax Money
+}
+
+type TaxBreakdown struct {
+  Rules TaxRules
+  Lines []TaxLine
+}
+
+func fetchTaxRules(tx *gorm.DB, restaurantID uint) TaxRules {
+  var settings RestaurantTaxSettings
+
+  err := tx.First(&settings, restaurantID).Error
+  if gorm.IsRecordNotFoundError(err) {
+    settings = *defaultRestaurantTaxSettings(restaurantID)
+  } else {
+    checkError(err)
+  }
+
+  rules, err := settings.Rules()
+  checkError(err)
+  return rules
+}
+
+func (s *RestaurantTaxSettings) Rules() (TaxRules, error) {
+  rate, err := parseTaxRate(s.Rate)
+  if err != nil {
+    return TaxRules{}, err
+  }
+
+  categories, err := parseTaxCategories(s.Categories)
+  if err != nil {
+    return TaxRules{}, err
+  }
+
+  return TaxRules{rate, s.Prices != TaxExclusive, s.Rounding, categories, s.Tips == TipsTaxed}, nil
+}
+
+func parseTaxRate(value string) (int, error) {
+  percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+  if err != nil || percent < 0 || percent > 100 {
+    return 0, errors.New("Tax rate must be a percentage between 0 and 100: " + value)
+  }
+  return int(math.Round(percent * 100)), nil
+}
+
+func parseTaxCategories(value string) (map[string]int, error) {
+  categories := make(map[string]int)
+
+  for _, line := range strings.Split(value, "\n") {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+      continue
+    }
+    if len(fields) != 2 {
+      return nil, errors.New("Expecting a category name and rate, received: " + line)
+    }
+
+    rate, err := parseTaxRate(fields[1])
+    if err != nil {
+      return nil, err
+    }
+    categories[fields[0]] = rate
+  }
+
+  return categories, nil
+}
+
+func (r TaxRules) rateFor(category string) (int, error) {
+  if category == "" {
+    return r.Rate, nil
+  }
+
+  rate, ok := r.Categories[category]
+  if !ok {
+    return 0, errors.New("Unknown tax category: " + category)
+  }
+  return rate, nil
+}
+
+// Tax on an amount, which includes the tax when prices are tax inclusive
+func (r TaxRules) taxOn(amount Money, rate int) Money {
+  if r.Inclusive {
+    return Money(roundDiv(int64(amount) * int64(rate), 10000 + int64(rate), r.Rounding))
+  }
+  return Money(roundDiv(int64(amount) * int64(rate), 10000, r.Rounding))
+}
+
+func roundDiv(n, d int64, mode string) int64 {
+  q, r := n / d, n % d
+
+  switch mode {
+  case "down":
+    return q
+  case "up":
+    if r > 0 {
+      return q + 1
+    }
+  case "half-even":
+    if 2 * r > d || (2 * r == d && q % 2 == 1) {
+      return q + 1
+    }
+  default:
+    if 2 * r >= d {
+      return q + 1
+    }
+  }
+
+  return q
+}
+
+// Tax charged on top of the menu prices and surcharges, zero when prices include it.
+// Tips always include their tax.
+func (o *Order) exclusiveTax() Money {
+  if o.Tax == nil || o.Tax.Rules.Inclusive {
+    return 0
+  }
+
+  tax := o.GST
+  for _, line := range o.Charges {
+    if line.Type == ChargeTip {
+      tax -= line.Tax
+    }
+  }
+  return tax
+}
+
+// Tax to refund with qty of an item, so exclusive tax is returned along with
+// the price. The item can be on more than one line, each with its own tax.
+func (o *Order) lineTax(itemId, qty int) Money {
+  if o.exclusiveTax() == 0 {
+    return 0
+  }
+
+  var tax Money
+  orderedQty := 0
+  for _, line := range o.Tax.Lines {
+    if line.Id == itemId {
+      tax += line.Tax
+      orderedQty += line.Qty
+    }
+  }
+
+  if orderedQty == 0 {
+    return 0
+  }
+  return tax * Money(qty) / Money(orderedQty)
+}
+
+func (b *TaxBreakdown) Scan(src interface{}) error {
+  switch src.(type) {
+  case string:
+    return json.Unmarshal([]byte(src.(string)), b)
+  case []byte:
+    return json.Unmarshal(src.([]byte), b)
+  default:
+    return errors.New("Incompatible type for TaxBreakdown")
+  }
+}
+
+func (b TaxBreakdown) Value() (driver.Value, error) {
+  data, err := json.Marshal(b)
+  return string(data), err
+}
+
+
+type EditTaxForm struct {}
+
+func NewEditTaxForm() ef.Form {
+  return new(EditTaxForm)
+}
+
+func (f *EditTaxForm) New() interface{} {
+  return new(RestaurantTaxSettings)
+}
+
+func (f *EditTaxForm) Layout(fi *ef.Instance) ef.Layout {
+  return ef.NewLayout(
+      "Tax",
+      "/admin/restaurants",
+      "/admin/restaurants",
+      ef.Group("",
+        ef.Text("Rate", "Rate (%)"),
+        ef.Text("Prices", "Menu Prices"),
+        ef.Text("Rounding", "Rounding"),
+        ef.Text("Tips", "Tips")),
+      ef.Group("Categories, one per line as name and rate, e.g. zero 0",
+        ef.TextArea("Categories", "Categories")))
+}
+
+func (f *EditTaxForm) Validate(fi *ef.Instance) {
+  fi.Validate("Rate", "Rate", ef.Trim, ef.Required, validTaxRate)
+  fi.Validate("Prices", "Menu Prices", ef.Trim, validTaxPrices)
+  fi.Validate("Rounding", "Rounding", ef.Trim, validTaxRounding)
+  fi.Validate("Categories", "Categories", ef.Trim, validTaxCategories)
+  fi.Validate("Tips", "Tips", ef.Trim, validTaxTips)
+}
+
+func validTaxRate(value string) (string, string) {
+  if _, err := parseTaxRate(value); err != nil {
+    return value, "%s must be a percentage between 0 and 100."
+  }
+  return value, ""
+}
+
+func validTaxPrices(value string) (string, string) {
+  if value != TaxInclusive && value != TaxExclusive {
+    return value, "%s must be inclusive or exclusive."
+  }
+  return value, ""
+}
+
+func validTaxRounding(value string) (string, string) {
+  if !contains(TaxRoundingModes, value) {
+    return value, "%s must be one of " + strings.Join(TaxRoundingModes, ", ") + "."
+  }
+  return value, ""
+}
+
+func validTaxTips(value string) (string, string) {
+  if value != TipsTaxed && value != TipsUntaxed {
+    return value, "%s must be taxed or untaxed."
+  }
+  return value, ""
+}
+
+func validTaxCategories(value string) (string, string) {
+  if _, err := parseTaxCategories(value); err != nil {
+    return value, "%s must have a name and percentage on each line."
+  }
+  return value, ""
+}
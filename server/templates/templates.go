@@ -1,6 +1,7 @@
 package templates
 
 import (
+  "context"
   "html/template"
   "net/http"
   "io/ioutil"
@@ -9,6 +10,29 @@ import (
 
 type BadRequest string
 
+type csrfTokenKey struct{}
+type cspNonceKey struct{}
+
+// The request handlers add the session's CSRF token so pages can send it back
+func WithCSRFToken(req *http.Request, token string) *http.Request {
+  return req.WithContext(context.WithValue(req.Context(), csrfTokenKey{}, token))
+}
+
+func CSRFToken(req *http.Request) string {
+  token, _ := req.Context().Value(csrfTokenKey{}).(string)
+  return token
+}
+
+// The security headers middleware adds the nonce that lets the page's scripts run
+func WithCSPNonce(req *http.Request, nonce string) *http.Request {
+  return req.WithContext(context.WithValue(req.Context(), cspNonceKey{}, nonce))
+}
+
+func CSPNonce(req *http.Request) string {
+  nonce, _ := req.Context().Value(cspNonceKey{}).(string)
+  return nonce
+}
+
 var assetMap map[string]string
 var Templates *template.Template
 
@@ -48,6 +72,8 @@ func ElmApp(w http.ResponseWriter, req *http.Request, appName string, flags inte
   var d struct {
     App template.JS
     Flags template.JS
+    CSRFToken string
+    Nonce string
   }
 
   flagsJson, err := json.MarshalIndent(flags, "", "  ")
@@ -55,6 +81,8 @@ func ElmApp(w http.ResponseWriter, req *http.Request, appName string, flags inte
 
   d.App = template.JS(appName)
   d.Flags = template.JS(string(flagsJson))
+  d.CSRFToken = CSRFToken(req)
+  d.Nonce = CSPNonce(req)
 
   Templates.Lookup("elm-spa.tmpl").Execute(w, d)
 }
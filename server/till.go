@@ -4,6 +4,8 @@ import (
   "net/http"
   "feedme/server/templates"
   "feedme/server/sse"
+  "feedme/server/webhooks"
+  "feedme/server/printing"
   "github.com/jinzhu/gorm"
   "encoding/json"
   "time"
@@ -12,17 +14,19 @@ import (
   "fmt"
 )
 
-func getTill(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
+func getTill(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
   flags := struct {
     Restaurant *Restaurant
+    HasPrinter bool
   }{
     restaurant,
+    restaurant.PrinterAddress != "",
   }
 
   templates.ElmApp(w, req, "BackEnd.Till", flags)
 }
 
-func getTillStream(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
+func getTillStream(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
   var events [] sse.Event
   events = append(events, sse.Event{"reset", nil})
 
@@ -33,7 +37,7 @@ func getTillStream(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessio
   sse.Stream(w, events, restaurantStreamKey(restaurant.ID))
 }
 
-func postUpdateOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sessionID string, restaurant *Restaurant) {
+func postUpdateOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
   update := struct {
     Number int
     Status string
@@ -43,6 +47,16 @@ func postUpdateOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sess
   var order Order
   checkError(tx.Where("restaurant_id = ? AND Number = ?", restaurant.ID, update.Number).First(&order).Error)
 
+  if order.Status == "Cancelled" {
+    // The customer cancelled before the till got to it, put the till straight
+    resendTillStatus(&order)
+
+    w.Header().Set("Content-Type", "application/json")
+    fmt.Fprintln(w, "\"OK\"")
+    return
+  }
+
+  previousStatus := order.Status
   statusFields := strings.Fields(update.Status)
   order.Status = statusFields[0]
 
@@ -55,21 +69,116 @@ func postUpdateOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, sess
     order.StatusDate = nil
   }
 
-  checkError(tx.Save(order).Error)
+  // Only if the customer or another till hasn't changed the status since it was read
+  result := tx.Table("orders").
+    Where("id=? AND status=?", order.ID, previousStatus).
+    Updates(map[string]interface{}{"status": order.Status, "status_date": order.StatusDate})
+  checkError(result.Error)
+
+  if result.RowsAffected == 0 {
+    checkError(tx.Where("id=?", order.ID).First(&order).Error)
+    resendTillStatus(&order)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusConflict)
+    fmt.Fprintln(w, "\"The order has changed, please try again\"")
+    return
+  }
+
+  if order.Status != previousStatus {
+    notifyStatusChange(tx, restaurant, &order)
+  }
+
+  if previousStatus != "Rejected" && order.Status == "Rejected" {
+    refundUnservedOrder(tx, &order, "Order rejected")
+  }
+
+  // Accepting the order sends it to the kitchen
+  if previousStatus == "New" && order.Status == "Expected" {
+    printOrder(tx, restaurant, &order, false)
+  }
+
+  statusUpdate := &OrderStatusUpdate{
+    RestaurantID: order.RestaurantID,
+    Number: order.Number,
+    Status: order.Status,
+    StatusDate: order.StatusDate,
+  }
+  webhooks.Fire(tx, order.RestaurantID, webhooks.OrderStatusChanged, statusUpdate)
 
   // send status updates to customers and other tills
-  event := &sse.Event{
+  event := &sse.Event{"statusUpdate", statusUpdate}
+  sse.Send(restaurantOrderStreamKey{order.RestaurantID, order.Number}, event)
+  sse.Send(restaurantStreamKey(order.RestaurantID), event)
+
+
+  w.Header().Set("Content-Type", "application/json")
+  fmt.Fprintln(w, "\"OK\"")
+}
+
+// Sends the order's current status to the tills, for when one of them is out of date
+func resendTillStatus(order *Order) {
+  sse.Send(restaurantStreamKey(order.RestaurantID), &sse.Event{
     "statusUpdate",
     &OrderStatusUpdate{
       RestaurantID: order.RestaurantID,
       Number: order.Number,
       Status: order.Status,
       StatusDate: order.StatusDate,
-  }}
-  sse.Send(restaurantOrderStreamKey{order.RestaurantID, order.Number}, event)
-  sse.Send(restaurantStreamKey(order.RestaurantID), event)
+      CancelReason: order.CancelReason,
+  }})
+}
 
+func postPrintOrder(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  reprint := struct {
+    Number int
+  }{}
+  checkError(json.NewDecoder(req.Body).Decode(&reprint))
+
+  var order Order
+  checkError(tx.Where("restaurant_id = ? AND Number = ?", restaurant.ID, reprint.Number).First(&order).Error)
+
+  if restaurant.PrinterAddress == "" {
+    panic(templates.BadRequest("No kitchen printer configured"))
+  }
+
+  printOrder(tx, restaurant, &order, true)
 
   w.Header().Set("Content-Type", "application/json")
   fmt.Fprintln(w, "\"OK\"")
 }
+
+func printOrder(tx *gorm.DB, restaurant *Restaurant, order *Order, reprint bool) {
+  if restaurant.PrinterAddress == "" {
+    return
+  }
+
+  menu := fetchMenu(tx, order.MenuID)
+
+  ticket := printing.Ticket{
+    Restaurant: restaurant.Name,
+    Number: order.DisplayNumber,
+    Name: order.Name,
+    Telephone: order.Telephone,
+    Allergens: order.Items.allergens(menu.Items),
+    CreatedAt: order.CreatedAt,
+    Reprint: reprint,
+    Location: restaurant.Location(),
+  }
+
+  if order.Status == "Expected" {
+    ticket.PickupTime = order.StatusDate
+  }
+
+  // Order items are just a menu item and quantity, so there are no options to
+  // print, allergens are on the ticket once above the lines
+  for _, item := range order.Items {
+    line := printing.TicketLine{Qty: item.Qty, Name: "Unknown item"}
+    if menuItem := menu.Items.itemById(item.Id); menuItem != nil {
+      line.Name = menuItem.Name
+    }
+    ticket.Lines = append(ticket.Lines, line)
+  }
+
+  printing.Queue(tx, restaurant.ID, restaurant.PrinterAddress, ticket)
+}
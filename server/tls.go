@@ -0,0 +1,181 @@
+package main
+
+// Built-in HTTPS. TLSCertFile is normally a wildcard certificate covering
+// DomainName and *.DomainName, TLSCertificates adds certificates for
+// restaurants' own domains. The certificate is picked by the name the browser
+// asks for, and all of them are reloaded from disk on SIGHUP so renewed
+// certificates are used without a restart.
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "strings"
+  "sync"
+  "syscall"
+)
+
+type TLSCertificate struct {
+  CertFile string
+  KeyFile string
+}
+
+type certificateStore struct {
+  sync.RWMutex
+
+  // Keyed by lowercase DNS name, wildcards by the name with the "*."
+  byName map[string]*tls.Certificate
+  wildcards map[string]*tls.Certificate
+
+  // For browsers that don't send a name
+  fallback *tls.Certificate
+}
+
+var certificates certificateStore
+
+func tlsEnabled() bool {
+  return Config.TLSCertFile != ""
+}
+
+func urlScheme() string {
+  if tlsEnabled() {
+    return "https"
+  }
+  return "http"
+}
+
+func (s *certificateStore) load() error {
+  files := append([]TLSCertificate{{Config.TLSCertFile, Config.TLSKeyFile}}, Config.TLSCertificates...)
+
+  byName := make(map[string]*tls.Certificate)
+  wildcards := make(map[string]*tls.Certificate)
+  var fallback *tls.Certificate
+
+  for _, file := range files {
+    cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+    if err != nil {
+      return err
+    }
+
+    cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+      return err
+    }
+
+    if fallback == nil {
+      fallback = &cert
+    }
+
+    for _, name := range cert.Leaf.DNSNames {
+      name = strings.ToLower(name)
+      if strings.HasPrefix(name, "*.") {
+        wildcards[name[2:]] = &cert
+      } else {
+        byName[name] = &cert
+      }
+    }
+  }
+
+  s.Lock()
+  defer s.Unlock()
+  s.byName = byName
+  s.wildcards = wildcards
+  s.fallback = fallback
+  return nil
+}
+
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+  s.RLock()
+  defer s.RUnlock()
+
+  name := strings.ToLower(hello.ServerName)
+  if name == "" {
+    return s.fallback, nil
+  }
+
+  if cert := s.find(name); cert != nil {
+    return cert, nil
+  }
+  return nil, errors.New("No certificate for " + name)
+}
+
+// Whether a loaded certificate covers name, false until the certificates are loaded
+func (s *certificateStore) covers(name string) bool {
+  s.RLock()
+  defer s.RUnlock()
+  return s.find(strings.ToLower(name)) != nil
+}
+
+func (s *certificateStore) find(name string) *tls.Certificate {
+  if cert, ok := s.byName[name]; ok {
+    return cert
+  }
+
+  // A wildcard only covers one label
+  if i := strings.Index(name, "."); i > 0 {
+    if cert, ok := s.wildcards[name[i+1:]]; ok {
+      return cert
+    }
+  }
+
+  return nil
+}
+
+// Whether browsers can reach host over the scheme we link with
+func canServeHost(host string) bool {
+  return !tlsEnabled() || certificates.covers(host)
+}
+
+// Reloads the certificates on SIGHUP, keeping the old ones if the new ones can't be loaded
+func reloadCertificatesOnHangup() {
+  hangup := make(chan os.Signal, 1)
+  signal.Notify(hangup, syscall.SIGHUP)
+
+  go func() {
+    for range hangup {
+      err := certificates.load()
+      if err != nil {
+        log.Printf("Reloading TLS certificates: %s", err)
+      } else {
+        log.Printf("Reloaded TLS certificates")
+      }
+    }
+  }()
+}
+
+// Serves handler over HTTPS, with plain HTTP requests redirected to the same
+// host and path over HTTPS
+func listenAndServeTLS(handler http.Handler) error {
+  checkError(certificates.load())
+  reloadCertificatesOnHangup()
+
+  if !Config.NoHTTPRedirect {
+    go func() {
+      log.Fatal(http.ListenAndServe(":" + Config.HTTPPort, http.HandlerFunc(redirectToHTTPS)))
+    }()
+  }
+
+  server := &http.Server{
+    Addr: ":" + Config.HTTPSPort,
+    Handler: handler,
+    TLSConfig: &tls.Config{
+      GetCertificate: certificates.GetCertificate,
+      MinVersion: tls.VersionTLS12,
+    },
+  }
+
+  return server.ListenAndServeTLS("", "")
+}
+
+func redirectToHTTPS(w http.ResponseWriter, req *http.Request) {
+  host := hostname(req)
+  if Config.HTTPSPort != "443" {
+    host += ":" + Config.HTTPSPort
+  }
+
+  http.Redirect(w, req, "https://" + host + req.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -5,3 +5,12 @@ func checkError(err error) {
     panic(err)
   }
 }
+
+func contains(list []string, s string) bool {
+  for _, item := range list {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,111 @@
+package main
+
+// Restaurants can require customers to prove they have the phone they are
+// ordering with, by entering a code sent to it, before the first order from
+// a session. Codes work like login codes and are sent with the SMS notifier.
+
+import (
+  "encoding/json"
+  "net/http"
+  "time"
+  "feedme/server/challenge"
+  "feedme/server/notify"
+  "github.com/jinzhu/gorm"
+)
+
+const verifyChallengeMessage = "We couldn't check that this request came from your browser, please try again."
+
+type VerifiedPhone struct {
+  ID uint
+  SessionID string `gorm:"not null"`
+
+  // Normalised with normaliseLogin
+  Telephone string `gorm:"not null"`
+
+  CreatedAt time.Time
+}
+
+type VerifyResult struct {
+  Status string
+  Error string
+
+  // Each code request uses up its challenge, this is for the next one
+  Challenge *challenge.Challenge `json:",omitempty"`
+}
+
+func (r *Restaurant) requiresVerifiedPhone() bool {
+  return r.VerifyPhone == "yes"
+}
+
+// Customers who logged in with their phone number have already proved they have it
+func isPhoneVerified(tx *gorm.DB, sessionID string, customer *Customer, telephone string) bool {
+  if customer != nil && customer.Login == telephone {
+    return true
+  }
+
+  var count int
+  checkError(tx.Model(&VerifiedPhone{}).
+    Where("session_id=? AND telephone=?", sessionID, telephone).
+    Count(&count).Error)
+  return count > 0
+}
+
+func postVerifyPhoneStart(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  var start struct {
+    Telephone string
+    Challenge ChallengeResponse
+  }
+  checkError(json.NewDecoder(req.Body).Decode(&start))
+
+  telephone := normaliseLogin(start.Telephone)
+  if notify.IsEmail(telephone) || !validLogin(telephone) {
+    json.NewEncoder(w).Encode(VerifyResult{Status: "ERR", Error: "Please enter a mobile phone number.", Challenge: issueChallenge()})
+    return
+  }
+
+  if msg := codeLimitError(tx, CodePhone, telephone, session.ID, clientIP(req)); msg != "" {
+    json.NewEncoder(w).Encode(VerifyResult{Status: "ERR", Error: msg, Challenge: issueChallenge()})
+    return
+  }
+
+  // Checked last as challenges can only be answered once
+  if !verifyChallenge(req, start.Challenge) {
+    json.NewEncoder(w).Encode(VerifyResult{Status: "ERR", Error: verifyChallengeMessage, Challenge: issueChallenge()})
+    return
+  }
+
+  code := createLoginCode(tx, CodePhone, telephone, session.ID, clientIP(req))
+
+  err := notify.Send(notify.Message{
+    To: telephone,
+    Subject: restaurant.Name + " verification code",
+    Body: "Your " + restaurant.Name + " verification code is " + code,
+  })
+  if err != nil {
+    json.NewEncoder(w).Encode(VerifyResult{Status: "ERR", Error: "Sorry, we could not send you a code, please try again.", Challenge: issueChallenge()})
+    return
+  }
+
+  json.NewEncoder(w).Encode(VerifyResult{Status: "OK", Challenge: issueChallenge()})
+}
+
+func postVerifyPhoneCheck(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  var verify struct {
+    Telephone string
+    Code string
+  }
+  checkError(json.NewDecoder(req.Body).Decode(&verify))
+
+  telephone := normaliseLogin(verify.Telephone)
+  if msg := verifyLoginCode(tx, CodePhone, telephone, verify.Code); msg != "" {
+    json.NewEncoder(w).Encode(VerifyResult{Status: "ERR", Error: msg})
+    return
+  }
+
+  if !isPhoneVerified(tx, session.ID, nil, telephone) {
+    session.save(tx)
+    checkError(tx.Create(&VerifiedPhone{SessionID: session.ID, Telephone: telephone}).Error)
+  }
+
+  json.NewEncoder(w).Encode(VerifyResult{Status: "OK"})
+}
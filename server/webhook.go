@@ -0,0 +1,145 @@
+package main
+
+import (
+  "net/http"
+  "fmt"
+  "strconv"
+  "strings"
+  "net/url"
+  "time"
+  "feedme/server/templates"
+  "feedme/server/webhooks"
+  ef "feedme/server/editform"
+  "github.com/gorilla/mux"
+  "github.com/jinzhu/gorm"
+)
+
+func getWebhooks(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+
+  var subscriptions []webhooks.Subscription
+  checkError(tx.Where("restaurant_id=?", restaurantID).Order("id").Find(&subscriptions).Error)
+
+  type subscriptionSummary struct {
+    ID uint
+    URL string
+    Events string
+  }
+  type deliverySummary struct {
+    ID uint
+    URL string
+    Event string
+    Attempts int
+    LastStatus int
+    LastError string
+    DeliveredAt *time.Time
+    CreatedAt time.Time
+  }
+
+  flags := struct {
+    Url string
+    Subscriptions []subscriptionSummary
+    Deliveries []deliverySummary
+  }{
+    fmt.Sprintf("/admin/restaurants/%d/webhooks", restaurantID),
+    []subscriptionSummary{},
+    []deliverySummary{},
+  }
+
+  // Secrets are only shown on the edit form
+  for _, s := range subscriptions {
+    flags.Subscriptions = append(flags.Subscriptions, subscriptionSummary{s.ID, s.URL, s.Events})
+  }
+
+  for _, d := range webhooks.FetchDeliveries(tx, restaurantID, 50) {
+    flags.Deliveries = append(flags.Deliveries, deliverySummary{
+      d.ID, d.Subscription.URL, d.Event, d.Attempts, d.LastStatus, d.LastError, d.DeliveredAt, d.CreatedAt,
+    })
+  }
+
+  templates.ElmApp(w, req, "Webhooks", flags)
+}
+
+func postRedeliverWebhook(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session) {
+  restaurantID := ef.GetId(req)
+
+  deliveryID, err := strconv.Atoi(mux.Vars(req)["deliveryID"])
+  if err != nil {
+    panic(templates.BadRequest("Expecting integer delivery id"))
+  }
+
+  webhooks.Redeliver(tx, restaurantID, uint(deliveryID))
+
+  fmt.Fprint(w, "\"OK\"")
+}
+
+
+// Edits subscriptions at /admin/restaurants/{restaurantID}/webhooks/{id}
+type EditWebhookForm struct {}
+
+func NewEditWebhookForm() ef.Form {
+  return new(EditWebhookForm)
+}
+
+func (f *EditWebhookForm) New() interface{} {
+  return new(webhooks.Subscription)
+}
+
+func webhooksUrl(req *http.Request) string {
+  return "/admin/restaurants/" + mux.Vars(req)["restaurantID"] + "/webhooks"
+}
+
+func (f *EditWebhookForm) Layout(fi *ef.Instance) ef.Layout {
+  return ef.NewLayout(
+      "Webhook",
+      webhooksUrl(fi.Request),
+      webhooksUrl(fi.Request),
+      ef.Group("",
+        ef.Text("URL", "URL"),
+        ef.Text("Secret", "Secret"),
+        ef.Text("Events", "Events")))
+}
+
+func (f *EditWebhookForm) Validate(fi *ef.Instance) {
+  restaurantID, err := strconv.Atoi(mux.Vars(fi.Request)["restaurantID"])
+  if err != nil {
+    panic(templates.BadRequest("Expecting integer restaurant id"))
+  }
+  fi.Data.(*webhooks.Subscription).RestaurantID = uint(restaurantID)
+
+  fi.Validate("URL", "URL", ef.Trim, ef.Required, validWebhookURL)
+  fi.Validate("Secret", "Secret", ef.Trim, generateSecret)
+  fi.Validate("Events", "Events", validWebhookEvents)
+}
+
+func validWebhookURL(value string) (string, string) {
+  u, err := url.Parse(value)
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return value, "%s must be a full http:// or https:// address."
+  }
+  return value, ""
+}
+
+func generateSecret(value string) (string, string) {
+  if value == "" {
+    return randomToken(), ""
+  }
+  return value, ""
+}
+
+func validWebhookEvents(value string) (string, string) {
+  var events []string
+
+  for _, event := range strings.Split(value, ",") {
+    event = strings.TrimSpace(event)
+    if event == "" {
+      continue
+    }
+    if !contains(webhooks.Events, event) {
+      return value, "%s must be a comma separated list of: " + strings.Join(webhooks.Events, ", ") + "."
+    }
+    events = append(events, event)
+  }
+
+  return strings.Join(events, ","), ""
+}
@@ -0,0 +1,226 @@
+package webhooks
+
+// Order events are pushed to restaurants' own systems (e.g. a POS) as signed
+// JSON. Deliveries are queued in the same transaction as the change and sent
+// by a background worker, retrying with exponential backoff.
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "github.com/jinzhu/gorm"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "feedme/server/queue"
+)
+
+const (
+  OrderPlaced = "order.placed"
+  OrderStatusChanged = "order.status_changed"
+)
+
+var Events = []string{OrderPlaced, OrderStatusChanged}
+
+const maxAttempts = 10
+const pollInterval = 30 * time.Second
+
+type Subscription struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+  URL string `gorm:"not null"`
+  Secret string `gorm:"not null"`
+
+  // Comma separated, no events means the subscription is disabled
+  Events string
+
+  CreatedAt time.Time
+  UpdatedAt time.Time
+}
+
+func (Subscription) TableName() string {
+  return "webhook_subscriptions"
+}
+
+func (s *Subscription) wants(event string) bool {
+  for _, e := range strings.Split(s.Events, ",") {
+    if strings.TrimSpace(e) == event {
+      return true
+    }
+  }
+  return false
+}
+
+type Delivery struct {
+  ID uint
+  SubscriptionID uint `gorm:"not null"`
+  Subscription *Subscription `gorm:"association_autoupdate:false;association_autocreate:false"`
+  Event string `gorm:"not null"`
+  Payload string `gorm:"type:text;not null"`
+
+  Attempts int `gorm:"not null"`
+  NextAttemptAt time.Time `gorm:"not null"`
+  DeliveredAt *time.Time
+  LastStatus int
+  LastError string
+
+  CreatedAt time.Time
+}
+
+func (Delivery) TableName() string {
+  return "webhook_deliveries"
+}
+
+var deliveryQueue = queue.New(queue.Options{
+  Name: "Webhook",
+  Table: "webhook_deliveries",
+  DoneColumn: "delivered_at",
+  MaxAttempts: maxAttempts,
+  PollInterval: pollInterval,
+  Backoff: backoff,
+  Do: deliver,
+})
+
+// Queues a delivery of the event to each of the restaurant's subscriptions that want it
+func Fire(tx *gorm.DB, restaurantID uint, event string, data interface{}) {
+  var subscriptions []Subscription
+  checkError(tx.Where("restaurant_id=?", restaurantID).Find(&subscriptions).Error)
+
+  var payload []byte
+  queued := false
+
+  for _, subscription := range subscriptions {
+    if !subscription.wants(event) {
+      continue
+    }
+
+    if payload == nil {
+      var err error
+      payload, err = json.Marshal(struct {
+        Event string
+        Time time.Time
+        Data interface{}
+      }{event, time.Now(), data})
+      checkError(err)
+    }
+
+    checkError(tx.Create(&Delivery{
+      SubscriptionID: subscription.ID,
+      Event: event,
+      Payload: string(payload),
+      NextAttemptAt: time.Now(),
+    }).Error)
+    queued = true
+  }
+
+  if queued {
+    deliveryQueue.Nudge()
+  }
+}
+
+// Queues a fresh copy of a past delivery, e.g. after the restaurant fixed their endpoint
+func Redeliver(tx *gorm.DB, restaurantID uint, deliveryID uint) {
+  var delivery Delivery
+  checkError(tx.
+    Joins("JOIN webhook_subscriptions ON webhook_subscriptions.id = webhook_deliveries.subscription_id").
+    Where("webhook_deliveries.id=? AND webhook_subscriptions.restaurant_id=?", deliveryID, restaurantID).
+    First(&delivery).Error)
+
+  checkError(tx.Create(&Delivery{
+    SubscriptionID: delivery.SubscriptionID,
+    Event: delivery.Event,
+    Payload: delivery.Payload,
+    NextAttemptAt: time.Now(),
+  }).Error)
+
+  deliveryQueue.Nudge()
+}
+
+func FetchDeliveries(tx *gorm.DB, restaurantID uint, limit int) []Delivery {
+  var deliveries []Delivery
+  checkError(tx.
+    Preload("Subscription").
+    Joins("JOIN webhook_subscriptions ON webhook_subscriptions.id = webhook_deliveries.subscription_id").
+    Where("webhook_subscriptions.restaurant_id=?", restaurantID).
+    Order("webhook_deliveries.id desc").
+    Limit(limit).
+    Find(&deliveries).Error)
+  return deliveries
+}
+
+func StartWorker(db *gorm.DB) {
+  deliveryQueue.StartWorker(db)
+}
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+func deliver(db *gorm.DB, id uint) error {
+  var d Delivery
+  checkError(db.First(&d, id).Error)
+
+  var subscription Subscription
+  checkError(db.First(&subscription, d.SubscriptionID).Error)
+
+  status, err := post(&subscription, &d)
+  checkError(db.Model(&d).Update("last_status", status).Error)
+  return err
+}
+
+func post(subscription *Subscription, d *Delivery) (int, error) {
+  timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+  req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader([]byte(d.Payload)))
+  if err != nil {
+    return 0, err
+  }
+
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("X-Feedme-Event", d.Event)
+  req.Header.Set("X-Feedme-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+  req.Header.Set("X-Feedme-Timestamp", timestamp)
+  req.Header.Set("X-Feedme-Signature", "sha256=" + Sign(subscription.Secret, timestamp, []byte(d.Payload)))
+
+  resp, err := httpClient.Do(req)
+  if err != nil {
+    return 0, err
+  }
+  io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64 * 1024))
+  resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    return resp.StatusCode, fmt.Errorf("Endpoint responded %s", resp.Status)
+  }
+
+  return resp.StatusCode, nil
+}
+
+// Receivers verify deliveries by computing HMAC-SHA256 of "timestamp.payload"
+// with the shared secret and comparing it to X-Feedme-Signature.
+func Sign(secret, timestamp string, payload []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(timestamp))
+  mac.Write([]byte("."))
+  mac.Write(payload)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 1, 2, 4, 8... minutes between attempts, capped at a few hours
+func backoff(attempts int) time.Duration {
+  delay := time.Minute << uint(attempts - 1)
+  if delay > 4 * time.Hour {
+    delay = 4 * time.Hour
+  }
+  return delay
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+  "database/sql/driver"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+  "feedme/server/templates"
+  "feedme/server/currency"
+  "github.com/gorilla/mux"
+  "github.com/jinzhu/gorm"
+)
+
+// An end of day close-out. Each Z report covers the paid orders not in an
+// earlier one, so an order paid after a close-out goes in the next, and is
+// stored as it was produced, so later changes to orders do not alter what
+// was reported.
+type ZReport struct {
+  ID uint
+  RestaurantID uint `gorm:"not null"`
+
+  // Counts up per restaurant, like the Z count on a cash register
+  Number uint `gorm:"not null"`
+
+  From *time.Time
+  To time.Time `gorm:"not null"`
+
+  Data ZReportData `gorm:"type:text"`
+
+  CreatedAt time.Time
+}
+
+type ZReportData struct {
+  // Kept with the amounts in case the restaurant's currency changes later
+  Currency currency.Currency
+  Orders int
+  Sales Money
+  Tips Money
+  Surcharges Money
+  GST Money
+  Refunds Money
+  Statuses map[string]int
+  Lines []ZReportLine
+}
+
+type ZReportLine struct {
+  Number uint
+  DisplayNumber uint
+  Name string
+  Total Money
+  GST Money
+  Refunded Money
+  Status string
+  PaymentStatus string
+  CreatedAt time.Time
+}
+
+type ZReportSummary struct {
+  ID uint
+  Number uint
+  From *time.Time
+  To time.Time
+  Orders int
+  Sales Money
+  GST Money
+  Currency currency.Currency
+}
+
+func fetchLatestZReport(tx *gorm.DB, restaurantID uint) *ZReport {
+  var report ZReport
+
+  err := tx.Where("restaurant_id=?", restaurantID).Order("number desc").First(&report).Error
+  if gorm.IsRecordNotFoundError(err) {
+    return nil
+  }
+
+  checkError(err)
+  return &report
+}
+
+func closeDay(tx *gorm.DB, restaurant *Restaurant) *ZReport {
+  // Locking the order numbers row stops two tills closing the same orders
+  var numbers RestaurantOrderNumber
+  checkError(tx.Set("gorm:query_option", "FOR UPDATE").First(&numbers, restaurant.ID).Error)
+
+  report := &ZReport{
+    RestaurantID: restaurant.ID,
+    Number: 1,
+    To: time.Now(),
+    Data: ZReportData{
+      Currency: restaurant.CurrencyFormat,
+      Statuses: map[string]int{},
+      Lines: []ZReportLine{},
+    },
+  }
+
+  if previous := fetchLatestZReport(tx, restaurant.ID); previous != nil {
+    report.Number = previous.Number + 1
+    report.From = &previous.To
+  }
+
+  var orders []Order
+  checkError(tx.
+    Where("restaurant_id=? AND created_at<=? AND payment_status<>? AND z_report_id IS NULL", restaurant.ID, report.To, PaymentPending).
+    Order("number asc").
+    Find(&orders).Error)
+
+  for _, order := range orders {
+    line := ZReportLine{
+      Number: order.Number,
+      DisplayNumber: order.DisplayNumber,
+      Name: order.Name,
+      Total: order.Total,
+      GST: order.GST,
+      Refunded: refundedTotal(fetchRefunds(tx, restaurant.ID, order.Number)),
+      Status: order.Status,
+      PaymentStatus: order.PaymentStatus,
+      CreatedAt: order.CreatedAt,
+    }
+    report.Data.Lines = append(report.Data.Lines, line)
+
+    report.Data.Orders++
+    report.Data.Statuses[order.Status]++
+    if order.Status != "Rejected" && order.Status != "Cancelled" {
+      tips, surcharges := order.chargeTotals()
+      report.Data.Sales += order.Total - tips - surcharges
+      report.Data.Tips += tips
+      report.Data.Surcharges += surcharges
+      report.Data.GST += order.GST
+      report.Data.Refunds += line.Refunded
+    }
+  }
+
+  checkError(tx.Create(report).Error)
+
+  // z_report_id is left out of Order so saving an order from the till can't clear it
+  closed := []uint{}
+  for _, order := range orders {
+    closed = append(closed, order.Number)
+  }
+  if len(closed) > 0 {
+    checkError(tx.Table("orders").
+      Where("restaurant_id=? AND number IN (?)", restaurant.ID, closed).
+      Update("z_report_id", report.ID).Error)
+  }
+
+  return report
+}
+
+func zReportSummaries(tx *gorm.DB, restaurant *Restaurant) []ZReportSummary {
+  var reports []ZReport
+  checkError(tx.Where("restaurant_id=?", restaurant.ID).Order("number desc").Find(&reports).Error)
+
+  summaries := []ZReportSummary{}
+  for _, r := range reports {
+    r.inLocation(restaurant.Location())
+    summaries = append(summaries, ZReportSummary{r.ID, r.Number, r.From, r.To, r.Data.Orders, r.Data.Sales, r.Data.GST, r.Data.Currency})
+  }
+  return summaries
+}
+
+// Times are shown in the restaurant's time zone rather than the server's
+func (r *ZReport) inLocation(location *time.Location) {
+  if r.From != nil {
+    from := r.From.In(location)
+    r.From = &from
+  }
+  r.To = r.To.In(location)
+
+  for i := range r.Data.Lines {
+    r.Data.Lines[i].CreatedAt = r.Data.Lines[i].CreatedAt.In(location)
+  }
+}
+
+func postCloseDay(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  report := closeDay(tx, restaurant)
+
+  result := struct {
+    Status string
+    URL string
+  }{
+    "OK",
+    fmt.Sprintf("/reports/z/%d", report.ID),
+  }
+
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
+
+func getZReports(w http.ResponseWriter, req *http.Request, tx *gorm.DB, session *Session, restaurant *Restaurant) {
+  flags := struct {
+    Restaurant *Restaurant
+    TimeZone string
+    Reports []ZReportSummary
+    Report *ZReport
+  }{
+    restaurant,
+    restaurant.Location().String(),
+    zReportSummaries(tx, restaurant),
+    nil,
+  }
+
+  if id := mux.Vars(req)["id"]; id != "" {
+    reportID, err := strconv.Atoi(id)
+    if err != nil {
+      panic(templates.BadRequest("Expecting integer report id, received: " + id))
+    }
+
+    var report ZReport
+    checkError(tx.Where("restaurant_id=? AND id=?", restaurant.ID, reportID).First(&report).Error)
+    report.inLocation(restaurant.Location())
+    flags.Report = &report
+  }
+
+  templates.ElmApp(w, req, "ZReports", flags)
+}
+
+func (d *ZReportData) Scan(src interface{}) error {
+  var err error
+  switch src.(type) {
+  case string:
+    err = json.Unmarshal([]byte(src.(string)), d)
+  case []byte:
+    err = json.Unmarshal(src.([]byte), d)
+  default:
+    return errors.New("Incompatible type for ZReportData")
+  }
+
+  // Reports from before currencies were configurable
+  if err == nil && d.Currency.Code == "" {
+    d.Currency = currency.Get(currency.Default)
+  }
+  return err
+}
+
+func (d ZReportData) Value() (driver.Value, error) {
+  data, err := json.Marshal(d)
+  return string(data), err
+}
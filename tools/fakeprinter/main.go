@@ -0,0 +1,32 @@
+package main
+
+// Pretends to be a network receipt printer, printing tickets to stdout.
+// Set a restaurant's printer to localhost:9100 to use it.
+
+import (
+  "fmt"
+  "os"
+  "feedme/server/printing"
+)
+
+func main() {
+  addr := ":9100"
+  if len(os.Args) > 1 {
+    addr = os.Args[1]
+  }
+
+  printer, err := printing.NewFakePrinter(addr)
+  checkError(err)
+
+  fmt.Printf("Fake printer listening on %s\n", printer.Addr())
+
+  for data := range printer.Received() {
+    fmt.Printf("=== %d bytes ===\n%s\n", len(data), printing.PlainText(data))
+  }
+}
+
+func checkError(err error) {
+  if err != nil {
+    panic(err)
+  }
+}